@@ -0,0 +1,181 @@
+package autoscaler
+
+import (
+	"kinetik-server/data"
+	"kinetik-server/deploy"
+	"kinetik-server/logger"
+	"kinetik-server/models"
+	"sync"
+	"time"
+)
+
+type sample struct {
+	value float32
+	at    time.Time
+}
+
+var mu sync.Mutex
+var samples = make(map[string]map[string]sample) // By container ID then metric name
+var lastScaled = make(map[string]time.Time)      // By service identifier
+
+// staleness is how long a reported value is taken into account
+var staleness = time.Minute
+
+// Report records the metric values pushed for a container
+func Report(containerID string, values []*models.MetricValue) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	metrics, ok := samples[containerID]
+	if !ok {
+		metrics = make(map[string]sample)
+		samples[containerID] = metrics
+	}
+
+	now := time.Now()
+	for _, value := range values {
+		if value == nil || value.Name == "" || value.Value == nil {
+			continue
+		}
+		metrics[value.Name] = sample{
+			value: *value.Value,
+			at:    now,
+		}
+	}
+}
+
+// Start evaluates every autoscaled service every interval, forever. Values
+// older than three intervals are ignored.
+func Start(interval time.Duration) {
+	staleness = 3 * interval
+	go func() {
+		for {
+			time.Sleep(interval)
+			EvaluateAll()
+		}
+	}()
+}
+
+func EvaluateAll() {
+	known := make(map[string]bool)
+	for _, srv := range data.GetDB().GetServices() {
+		for _, inst := range srv.Instances {
+			known[inst.ContainerID] = true
+		}
+		if srv.Autoscale != nil {
+			evaluate(srv.Identifier())
+		}
+	}
+
+	mu.Lock()
+	for containerID := range samples {
+		if !known[containerID] {
+			delete(samples, containerID)
+		}
+	}
+	mu.Unlock()
+}
+
+// averages returns the mean of the fresh values of each metric over the
+// instances of the service. Metrics nobody reported are missing.
+func averages(srv *models.Service) map[string]float32 {
+	mu.Lock()
+	defer mu.Unlock()
+
+	sums := make(map[string]float32)
+	counts := make(map[string]int)
+	now := time.Now()
+
+	for _, inst := range srv.Instances {
+		for name, s := range samples[inst.ContainerID] {
+			if now.Sub(s.at) > staleness {
+				continue
+			}
+			sums[name] += s.value
+			counts[name]++
+		}
+	}
+
+	for name := range sums {
+		sums[name] /= float32(counts[name])
+	}
+	return sums
+}
+
+func evaluate(identifier string) {
+	unlock := deploy.LockService(identifier)
+	defer unlock()
+
+	srv := data.GetDB().GetService(identifier)
+	if srv == nil || srv.Autoscale == nil || srv.Stopped {
+		return
+	}
+	policy := srv.Autoscale
+
+	mu.Lock()
+	cooling := time.Since(lastScaled[identifier]) < time.Duration(policy.Cooldown)*time.Second
+	mu.Unlock()
+	if cooling {
+		return
+	}
+
+	values := averages(srv)
+	state := models.Unknown
+	for _, metric := range policy.Metrics {
+		value, ok := values[metric.Name]
+		if !ok {
+			continue
+		}
+		metricState := metric.Evaluate(value)
+		if state == models.Unknown || metricState > state {
+			state = metricState
+		}
+	}
+
+	action := ""
+	switch {
+	case srv.Replicas < policy.MinReplicas:
+		action = models.ScaleUp
+	case srv.Replicas > policy.MaxReplicas:
+		action = models.ScaleDown
+	case state == models.Unknown:
+		return
+	case state >= models.Critical && srv.Replicas < policy.MaxReplicas:
+		action = models.ScaleUp
+	case state == models.Ok && srv.Replicas > policy.MinReplicas:
+		action = models.ScaleDown
+	default:
+		return
+	}
+
+	decision := &models.ScalingDecision{
+		Action:    action,
+		State:     &state,
+		From:      srv.Replicas,
+		Metrics:   values,
+		CreatedAt: time.Now(),
+	}
+
+	var err error
+	if action == models.ScaleUp {
+		_, err = deploy.ScaleUp(srv)
+	} else {
+		_, err = deploy.ScaleDown(srv)
+	}
+	decision.To = srv.Replicas
+
+	if err != nil {
+		decision.Error = err.Error()
+		logger.ErrLog.Printf("Autoscaler : cannot %s %s : %s\n", action, identifier, err.Error())
+	} else {
+		logger.StdLog.Printf("Autoscaler : %s %s from %d to %d replicas\n", action, identifier, decision.From, decision.To)
+	}
+
+	mu.Lock()
+	lastScaled[identifier] = time.Now()
+	mu.Unlock()
+
+	if err := data.GetDB().AddScalingDecision(identifier, decision); err != nil {
+		logger.ErrLog.Printf("Autoscaler : cannot save decision for %s : %s\n", identifier, err.Error())
+	}
+}
@@ -0,0 +1,381 @@
+package autoscaler
+
+import (
+	"kinetik-server/control"
+	"kinetik-server/data"
+	"kinetik-server/deploy"
+	"kinetik-server/jobs"
+	"kinetik-server/logger"
+	"kinetik-server/models"
+	"kinetik-server/provider"
+	"kinetik-server/rand"
+	"kinetik-server/scheduler"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// AutoscaledLabel marks the nodes added by the cluster autoscaler. Only those
+// are removed by it.
+const AutoscaledLabel = "kinetik.autoscaled"
+
+var clusterPolicy = &models.ClusterPolicy{}
+
+// maxFailedNodes is the number of nodes failing to provision after which the
+// autoscaler stops adding nodes, until they are deleted
+const maxFailedNodes = 3
+
+var underusedSince = make(map[string]time.Time) // By node name
+var removalJob = 0
+
+func intFromEnv(name string, def int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || value < 0 {
+		return def
+	}
+	return value
+}
+
+// LoadClusterPolicy reads the policy of the cluster autoscaler from
+// CLUSTER_MIN_NODES, CLUSTER_MAX_NODES, CLUSTER_NODE_SIZE,
+// CLUSTER_NODE_REGION, CLUSTER_NODE_CPUS, CLUSTER_NODE_MEMORY_BYTES,
+// CLUSTER_SCALE_UP_AFTER, CLUSTER_SCALE_DOWN_AFTER (in seconds) and
+// CLUSTER_SCALE_DOWN_UTILIZATION
+func LoadClusterPolicy() *models.ClusterPolicy {
+	policy := &models.ClusterPolicy{
+		MinNodes:             intFromEnv("CLUSTER_MIN_NODES", 0),
+		MaxNodes:             intFromEnv("CLUSTER_MAX_NODES", 0),
+		NodeSize:             os.Getenv("CLUSTER_NODE_SIZE"),
+		NodeRegion:           os.Getenv("CLUSTER_NODE_REGION"),
+		NodeCPUs:             intFromEnv("CLUSTER_NODE_CPUS", 0),
+		NodeMemoryBytes:      intFromEnv("CLUSTER_NODE_MEMORY_BYTES", 0),
+		ScaleUpAfter:         intFromEnv("CLUSTER_SCALE_UP_AFTER", 120),
+		ScaleDownAfter:       intFromEnv("CLUSTER_SCALE_DOWN_AFTER", 600),
+		ScaleDownUtilization: 0.2,
+	}
+	if value, err := strconv.ParseFloat(os.Getenv("CLUSTER_SCALE_DOWN_UTILIZATION"), 64); err == nil && value >= 0 && value <= 1 {
+		policy.ScaleDownUtilization = value
+	}
+	if policy.MaxNodes > 0 && policy.MinNodes > policy.MaxNodes {
+		policy.MinNodes = policy.MaxNodes
+	}
+	return policy
+}
+
+// StartCluster evaluates the size of the cluster every interval, forever. It
+// does nothing unless CLUSTER_MAX_NODES is set.
+func StartCluster(interval time.Duration) {
+	// The environment is complete only now
+	clusterPolicy = LoadClusterPolicy()
+	if clusterPolicy.MaxNodes == 0 {
+		return
+	}
+	go func() {
+		for {
+			time.Sleep(interval)
+			EvaluateCluster()
+		}
+	}()
+}
+
+// GetClusterStatus returns the policy of the cluster autoscaler and the
+// demand it sees
+func GetClusterStatus() *models.ClusterStatus {
+	return &models.ClusterStatus{
+		Policy:  clusterPolicy,
+		Nodes:   len(clusterNodes()),
+		Failed:  failedNodes(),
+		Pending: deploy.PendingReplicas(),
+	}
+}
+
+// clusterNodes returns the inventory entries which are or will become nodes,
+// including those which joined by themselves, by name
+func clusterNodes() map[string]*models.NodeEntry {
+	entries := make(map[string]*models.NodeEntry)
+	known := make(map[string]bool)
+	for _, entry := range data.GetDB().GetNodeEntries() {
+		if entry.PublicIP != "" {
+			known[entry.PublicIP] = true
+		}
+		if entry.Phase == models.PhaseFailed {
+			continue
+		}
+		entries[entry.Name] = entry
+	}
+	for ip := range data.GetDB().GetNodes() {
+		if !known[ip] {
+			entries[ip] = &models.NodeEntry{Name: ip, PublicIP: ip, Phase: models.PhaseReady}
+		}
+	}
+	return entries
+}
+
+// failedNodes returns the number of nodes the autoscaler added which failed to
+// provision. Their entries are kept until an operator deletes them.
+func failedNodes() int {
+	failed := 0
+	for _, entry := range data.GetDB().GetNodeEntries() {
+		if entry.Phase == models.PhaseFailed && entry.Labels[AutoscaledLabel] == "true" {
+			failed++
+		}
+	}
+	return failed
+}
+
+// room returns how many nodes may be added, failed ones counting against
+// MaxNodes, and why none may be
+func room(policy *models.ClusterPolicy, nodes int, failed int) (int, string) {
+	if failed >= maxFailedNodes {
+		return 0, strconv.Itoa(failed) + " nodes failed to provision, delete them to add nodes again"
+	}
+	if nodes+failed >= policy.MaxNodes {
+		reason := "the cluster has its maximum of " + strconv.Itoa(policy.MaxNodes) + " nodes"
+		if failed > 0 {
+			reason += ", " + strconv.Itoa(failed) + " of which failed to provision"
+		}
+		return 0, reason
+	}
+	return policy.MaxNodes - nodes - failed, ""
+}
+
+// EvaluateCluster adds a node when replicas a new node could host wait for one
+// for too long, or removes an underused node the autoscaler added. Only one
+// node is added or removed at a time, except to reach MinNodes. Nodes which
+// failed to provision count against MaxNodes, and stop the additions once
+// maxFailedNodes failed.
+func EvaluateCluster() {
+	policy := clusterPolicy
+	nodes := clusterNodes()
+
+	provisioning := false
+	for _, entry := range nodes {
+		if entry.IsProvisioning() {
+			provisioning = true
+		}
+	}
+
+	failed := failedNodes()
+	if len(nodes) < policy.MinNodes {
+		reason := "below the minimum of " + strconv.Itoa(policy.MinNodes) + " nodes"
+		free, why := room(policy, len(nodes), failed)
+		if free == 0 {
+			logger.StdLog.Printf("Cluster autoscaler : %s but %s\n", reason, why)
+		}
+		for i := len(nodes); i < policy.MinNodes && i < len(nodes)+free; i++ {
+			addNode(policy, reason)
+		}
+		return
+	}
+
+	pending := deploy.PendingReplicas()
+	if len(pending) > 0 {
+		underusedSince = make(map[string]time.Time)
+		waiting := fittingReplicas(policy, pending)
+		if waiting == nil {
+			return
+		}
+		waited := time.Since(waiting.Since)
+		if provisioning || waited < time.Duration(policy.ScaleUpAfter)*time.Second {
+			return
+		}
+		if free, why := room(policy, len(nodes), failed); free == 0 {
+			logger.StdLog.Printf("Cluster autoscaler : %s waits for a node but %s\n", waiting.Service, why)
+			return
+		}
+		addNode(policy, waiting.Service+" waits for a node since "+waited.String())
+		return
+	}
+
+	if len(nodes) <= policy.MinNodes || removing() {
+		return
+	}
+
+	candidate := underusedNode(policy, nodes)
+	if candidate != nil {
+		removeNode(candidate)
+	}
+}
+
+// fittingReplicas returns the first pending replicas a new node could host,
+// nil if none. The others would not run on it either.
+func fittingReplicas(policy *models.ClusterPolicy, pending []*models.PendingReplicas) *models.PendingReplicas {
+	entry := models.NewNodeEntry("new-node", provider.GetProvider().Name())
+	entry.Size = policy.NodeSize
+	entry.Region = policy.NodeRegion
+	entry.Labels[AutoscaledLabel] = "true"
+	entry.Phase = models.PhaseReady
+	capacity := nodeCapacity(policy)
+
+	for _, replicas := range pending {
+		srv := data.GetDB().GetService(replicas.Service)
+		if srv == nil {
+			continue
+		}
+		fits, why := scheduler.FitsNewNode(scheduler.NewRequest(srv), entry, capacity)
+		if fits {
+			return replicas
+		}
+		logger.StdLog.Printf("Cluster autoscaler : %s waits for a node but a new node could not host it either, %s\n", replicas.Service, why)
+	}
+	return nil
+}
+
+// nodeCapacity returns an idle node of the size of the policy, nil if its
+// capacity is unknown
+func nodeCapacity(policy *models.ClusterPolicy) *models.Node {
+	cpus, memory := policy.NodeCPUs, float64(policy.NodeMemoryBytes)
+	if cpus == 0 || memory == 0 {
+		reports := data.GetDB().GetNodes()
+		for _, entry := range data.GetDB().GetNodeEntries() {
+			node := reports[entry.PublicIP]
+			if entry.Size != policy.NodeSize || node == nil || node.CPUCount == 0 || node.MemUsedPercent <= 0 {
+				continue
+			}
+			if cpus == 0 {
+				cpus = node.CPUCount
+			}
+			if memory == 0 {
+				memory = float64(node.MemUsedBytes) / node.MemUsedPercent
+			}
+			break
+		}
+	}
+	if cpus == 0 || memory == 0 {
+		return nil
+	}
+	// The scheduler derives the memory of a node from its usage
+	return &models.Node{
+		CPUCount:       cpus,
+		MemUsedBytes:   1,
+		MemUsedPercent: 1 / memory,
+	}
+}
+
+func addNode(policy *models.ClusterPolicy, reason string) {
+	p := provider.GetProvider()
+
+	entry := models.NewNodeEntry("klerk-"+rand.String(4), p.Name())
+	entry.Size = policy.NodeSize
+	entry.Region = policy.NodeRegion
+	entry.Labels[AutoscaledLabel] = "true"
+	if err := data.GetDB().SaveNodeEntry(entry); err != nil {
+		logger.ErrLog.Printf("Cluster autoscaler : cannot save node : %s\n", err.Error())
+		return
+	}
+
+	if _, err := control.StartProvisioning(p, entry); err != nil {
+		logger.ErrLog.Printf("Cluster autoscaler : cannot provision %s : %s\n", entry.Name, err.Error())
+		return
+	}
+	logger.StdLog.Printf("Cluster autoscaler : adding node %s, %s\n", entry.Name, reason)
+}
+
+// removing tells whether the last node removal is still running
+func removing() bool {
+	if removalJob == 0 {
+		return false
+	}
+	job := data.GetDB().GetJob(removalJob)
+	return job != nil && (job.State == models.JobPending || job.State == models.JobRunning)
+}
+
+// underusedNode returns the node added by the autoscaler which stayed underused
+// the longest, once it stayed so for ScaleDownAfter
+func underusedNode(policy *models.ClusterPolicy, nodes map[string]*models.NodeEntry) *models.NodeEntry {
+	reports := data.GetDB().GetNodes()
+	now := time.Now()
+
+	names := make([]string, 0)
+	for name, entry := range nodes {
+		node := reports[entry.PublicIP]
+		if entry.Labels[AutoscaledLabel] != "true" || entry.Phase != models.PhaseReady || node == nil || !node.IsSchedulable() || utilization(node) >= policy.ScaleDownUtilization {
+			delete(underusedSince, name)
+			continue
+		}
+		if _, ok := underusedSince[name]; !ok {
+			underusedSince[name] = now
+		}
+		if now.Sub(underusedSince[name]) >= time.Duration(policy.ScaleDownAfter)*time.Second {
+			names = append(names, name)
+		}
+	}
+	for name := range underusedSince {
+		if _, ok := nodes[name]; !ok {
+			delete(underusedSince, name)
+		}
+	}
+
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return underusedSince[names[i]].Before(underusedSince[names[j]])
+	})
+	return nodes[names[0]]
+}
+
+// utilization is the highest of the CPU and memory usage of the node, between
+// 0 and 1
+func utilization(node *models.Node) float64 {
+	cpu := 0.0
+	if node.CPUCount > 0 {
+		cpu = node.CPUUsedPercent / float64(100*node.CPUCount)
+	}
+	if node.MemUsedPercent > cpu {
+		return node.MemUsedPercent
+	}
+	return cpu
+}
+
+// removeNode cordons the node and, if the other nodes have room for its
+// instances, drains and deletes it
+func removeNode(entry *models.NodeEntry) {
+	setCordoned := func(cordoned bool) {
+		data.GetDB().UpdateNode(entry.PublicIP, func(node *models.Node) *models.Node {
+			if node == nil {
+				return nil
+			}
+			node.Cordoned = cordoned
+			return node
+		})
+	}
+	setCordoned(true)
+
+	replicas := make([]*scheduler.Request, 0)
+	for _, srv := range data.GetDB().GetServices() {
+		for _, inst := range srv.Instances {
+			if inst.NodeID == entry.PublicIP {
+				replicas = append(replicas, scheduler.NewRequest(srv))
+			}
+		}
+	}
+	for _, placement := range scheduler.GetScheduler().DryRun(replicas) {
+		if placement == "" {
+			logger.StdLog.Printf("Cluster autoscaler : %s is underused but the other nodes have no room for its instances\n", entry.Name)
+			setCordoned(false)
+			return
+		}
+	}
+
+	tracker, err := jobs.New(models.JobDeleteNode, "")
+	if err != nil {
+		logger.ErrLog.Printf("Cluster autoscaler : cannot remove %s : %s\n", entry.Name, err.Error())
+		setCordoned(false)
+		return
+	}
+	tracker.Update(func(job *models.Job) {
+		job.NodeID = entry.Name
+	})
+
+	deletion := &deploy.NodeDeletion{
+		NodeIP: entry.PublicIP,
+		Name:   entry.Name,
+	}
+	tracker.Run(deletion.Run, nil)
+
+	removalJob = tracker.ID()
+	delete(underusedSince, entry.Name)
+	logger.StdLog.Printf("Cluster autoscaler : removing underused node %s\n", entry.Name)
+}
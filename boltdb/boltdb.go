@@ -9,12 +9,16 @@ import (
 	"kinetik-server/models/internals"
 	"os"
 	"path"
+	"time"
 
 	"github.com/boltdb/bolt"
 )
 
 const PATH = "/etc/kinetik"
 
+// MaxScalingDecisions is the length of the scaling history kept per service
+const MaxScalingDecisions = 100
+
 func itob(v int) []byte {
 	b := make([]byte, 8)
 	binary.BigEndian.PutUint64(b, uint64(v))
@@ -34,7 +38,12 @@ type BoltDB struct {
 }
 
 func NewBoltDB() (*BoltDB, error) {
-	db, err := bolt.Open(path.Join(PATH, "kinetik.db"), 0600, nil)
+	return OpenBoltDB(path.Join(PATH, "kinetik.db"))
+}
+
+// OpenBoltDB opens, or creates, the database stored in file
+func OpenBoltDB(file string) (*BoltDB, error) {
+	db, err := bolt.Open(file, 0600, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -57,6 +66,34 @@ func NewBoltDB() (*BoltDB, error) {
 		if err != nil {
 			return err
 		}
+		_, err = tx.CreateBucketIfNotExists([]byte("jobs"))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists([]byte("revisions"))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists([]byte("scaling"))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists([]byte("registry"))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists([]byte("revoked"))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists([]byte("placements"))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists([]byte("stacks"))
+		if err != nil {
+			return err
+		}
 
 		return nil
 	})
@@ -97,8 +134,13 @@ func (b *BoltDB) GetNode(nodeId string) *models.Node {
 	b.client.View(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte("nodes"))
 		nodeBytes := bucket.Get([]byte(nodeId))
-		if nodeBytes != nil {
-			return json.Unmarshal(nodeBytes, node)
+		if nodeBytes == nil {
+			return nil
+		}
+		node = &models.Node{}
+		if err := json.Unmarshal(nodeBytes, node); err != nil {
+			node = nil
+			return err
 		}
 		return nil
 	})
@@ -122,17 +164,121 @@ func (b *BoltDB) AddNode(nodeid string, node *models.Node) error {
 	})
 }
 
-func (b *BoltDB) DeleteNode(nodeID int) error {
+// UpdateNode changes the stored node within a single transaction. fn gets nil
+// when the node is unknown and may return nil to skip the write.
+func (b *BoltDB) UpdateNode(nodeid string, fn func(node *models.Node) *models.Node) error {
 	return b.client.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte("nodes"))
 
-		// TODO : delete all instances linked on this node and reschedule
-		// That means also handle DO LB and so
+		var node *models.Node
+		if nodeBytes := bucket.Get([]byte(nodeid)); nodeBytes != nil {
+			node = &models.Node{}
+			if err := json.Unmarshal(nodeBytes, node); err != nil {
+				return err
+			}
+		}
+
+		node = fn(node)
+		if node == nil {
+			return nil
+		}
+
+		buf, err := json.Marshal(node)
+		if err != nil {
+			return err
+		}
+
+		return bucket.Put([]byte(nodeid), buf)
+	})
+}
+
+func (b *BoltDB) DeleteNode(nodeid string) error {
+	return b.client.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("nodes"))
+
+		// Instances are moved away before, see deploy.NodeDeletion
+		// TODO : handle DO LB and so
+
+		return bucket.Delete([]byte(nodeid))
+	})
+}
+
+func (b *BoltDB) GetNodeEntries() []*models.NodeEntry {
+	entries := make([]*models.NodeEntry, 0)
+
+	b.client.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte("registry")).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var e models.NodeEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			entries = append(entries, &e)
+		}
+
+		return nil
+	})
+
+	return entries
+}
+
+func (b *BoltDB) GetNodeEntry(name string) *models.NodeEntry {
+	var entry *models.NodeEntry
+
+	b.client.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket([]byte("registry")).Get([]byte(name))
+		if value == nil {
+			return nil
+		}
+		entry = &models.NodeEntry{}
+		return json.Unmarshal(value, entry)
+	})
+
+	return entry
+}
+
+func (b *BoltDB) SaveNodeEntry(entry *models.NodeEntry) error {
+	return b.client.Update(func(tx *bolt.Tx) error {
+		// The report is stored with the node
+		stored := *entry
+		stored.Node = nil
+
+		buf, err := json.Marshal(&stored)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte("registry")).Put([]byte(entry.Name), buf)
+	})
+}
 
-		return bucket.Delete(itob(nodeID))
+func (b *BoltDB) DeleteNodeEntry(name string) error {
+	return b.client.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("registry")).Delete([]byte(name))
 	})
 }
 
+// RevokeCert records the serial of a certificate kinetik must not trust anymore
+func (b *BoltDB) RevokeCert(serial string) error {
+	return b.client.Update(func(tx *bolt.Tx) error {
+		revokedAt, err := time.Now().MarshalText()
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte("revoked")).Put([]byte(serial), revokedAt)
+	})
+}
+
+func (b *BoltDB) IsCertRevoked(serial string) bool {
+	revoked := false
+
+	b.client.View(func(tx *bolt.Tx) error {
+		revoked = tx.Bucket([]byte("revoked")).Get([]byte(serial)) != nil
+		return nil
+	})
+
+	return revoked
+}
+
 func (b *BoltDB) GetServices() []*models.Service {
 	services := make([]*models.Service, 0)
 
@@ -154,15 +300,19 @@ func (b *BoltDB) GetServices() []*models.Service {
 }
 
 func (b *BoltDB) GetService(identifier string) *models.Service {
-	var service *models.Service = &models.Service{}
+	var service *models.Service
 
 	b.client.View(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte("services"))
 		value := bucket.Get([]byte(identifier))
-		logger.StdLog.Println(value)
+		if value == nil {
+			return nil
+		}
+		service = &models.Service{}
 		err := json.Unmarshal(value, service)
 		if err != nil {
 			logger.ErrLog.Println("Cannot unmarshal service", err)
+			service = nil
 		}
 		return err
 	})
@@ -179,18 +329,228 @@ func (b *BoltDB) AddService(service *models.Service) error {
 			return err
 		}
 
-		return bucket.Put([]byte(service.StackName+"/"+service.ServiceName), buf)
+		return bucket.Put([]byte(service.Identifier()), buf)
 	})
 }
 
-func (b *BoltDB) DeleteService(serviceID int) error {
+func (b *BoltDB) DeleteService(identifier string) error {
 	return b.client.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte("services"))
+		return bucket.Delete([]byte(identifier))
+	})
+}
 
-		// TODO : Delete all instances linked to this service
-		// That means also handle DO LB and so
+// AddRevision records the current spec of the service as a new revision and
+// sets the revision number on the service
+func (b *BoltDB) AddRevision(service *models.Service) error {
+	return b.client.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("revisions"))
+
+		subBucket, err := bucket.CreateBucketIfNotExists([]byte(service.Identifier()))
+		if err != nil {
+			return err
+		}
+
+		id, err := subBucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		service.Revision = int(id)
+
+		buf, err := json.Marshal(models.NewServiceRevision(service))
+		if err != nil {
+			return err
+		}
+
+		return subBucket.Put(itob(service.Revision), buf)
+	})
+}
 
-		return bucket.Delete(itob(serviceID))
+func (b *BoltDB) DeleteRevisions(identifier string) error {
+	return b.client.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("revisions"))
+		if bucket.Bucket([]byte(identifier)) == nil {
+			return nil
+		}
+		return bucket.DeleteBucket([]byte(identifier))
+	})
+}
+
+func (b *BoltDB) GetRevisions(identifier string) []*models.ServiceRevision {
+	revisions := make([]*models.ServiceRevision, 0)
+
+	b.client.View(func(tx *bolt.Tx) error {
+		subBucket := tx.Bucket([]byte("revisions")).Bucket([]byte(identifier))
+		if subBucket == nil {
+			return nil
+		}
+		c := subBucket.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var r models.ServiceRevision
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			revisions = append(revisions, &r)
+		}
+
+		return nil
+	})
+
+	return revisions
+}
+
+func (b *BoltDB) GetRevision(identifier string, revision int) *models.ServiceRevision {
+	var rev *models.ServiceRevision
+
+	b.client.View(func(tx *bolt.Tx) error {
+		subBucket := tx.Bucket([]byte("revisions")).Bucket([]byte(identifier))
+		if subBucket == nil {
+			return nil
+		}
+		value := subBucket.Get(itob(revision))
+		if value == nil {
+			return nil
+		}
+		rev = &models.ServiceRevision{}
+		return json.Unmarshal(value, rev)
+	})
+
+	return rev
+}
+
+// AddScalingDecision appends the decision to the history of the service. Only
+// the last MaxScalingDecisions are kept.
+func (b *BoltDB) AddScalingDecision(identifier string, decision *models.ScalingDecision) error {
+	return b.client.Update(func(tx *bolt.Tx) error {
+		subBucket, err := tx.Bucket([]byte("scaling")).CreateBucketIfNotExists([]byte(identifier))
+		if err != nil {
+			return err
+		}
+
+		id, err := subBucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		decision.ID = int(id)
+
+		buf, err := json.Marshal(decision)
+		if err != nil {
+			return err
+		}
+
+		if err := subBucket.Put(itob(decision.ID), buf); err != nil {
+			return err
+		}
+
+		keys := make([][]byte, 0)
+		c := subBucket.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			keys = append(keys, k)
+		}
+		for i := 0; i < len(keys)-MaxScalingDecisions; i++ {
+			if err := subBucket.Delete(keys[i]); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (b *BoltDB) GetScalingDecisions(identifier string) []*models.ScalingDecision {
+	decisions := make([]*models.ScalingDecision, 0)
+
+	b.client.View(func(tx *bolt.Tx) error {
+		subBucket := tx.Bucket([]byte("scaling")).Bucket([]byte(identifier))
+		if subBucket == nil {
+			return nil
+		}
+		c := subBucket.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var d models.ScalingDecision
+			if err := json.Unmarshal(v, &d); err != nil {
+				return err
+			}
+			decisions = append(decisions, &d)
+		}
+
+		return nil
+	})
+
+	return decisions
+}
+
+func (b *BoltDB) DeleteScalingDecisions(identifier string) error {
+	return b.client.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("scaling"))
+		if bucket.Bucket([]byte(identifier)) == nil {
+			return nil
+		}
+		return bucket.DeleteBucket([]byte(identifier))
+	})
+}
+
+// SavePlacement stores the placement decision of an instance, by container ID
+func (b *BoltDB) SavePlacement(decision *models.PlacementDecision) error {
+	buf, err := json.Marshal(decision)
+	if err != nil {
+		return err
+	}
+	return b.client.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("placements")).Put([]byte(decision.ContainerID), buf)
+	})
+}
+
+func (b *BoltDB) GetPlacement(containerID string) *models.PlacementDecision {
+	var decision *models.PlacementDecision
+
+	b.client.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket([]byte("placements")).Get([]byte(containerID))
+		if value == nil {
+			return nil
+		}
+		decision = &models.PlacementDecision{}
+		return json.Unmarshal(value, decision)
+	})
+
+	return decision
+}
+
+func (b *BoltDB) DeletePlacement(containerID string) error {
+	return b.client.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("placements")).Delete([]byte(containerID))
+	})
+}
+
+// GetStackPolicy returns the policy of the stack, the default one if none was
+// set
+func (b *BoltDB) GetStackPolicy(stack string) *models.StackPolicy {
+	policy := models.DefaultStackPolicy()
+
+	b.client.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket([]byte("stacks")).Get([]byte(stack))
+		if value == nil {
+			return nil
+		}
+		return json.Unmarshal(value, policy)
+	})
+
+	return policy
+}
+
+func (b *BoltDB) SetStackPolicy(stack string, policy *models.StackPolicy) error {
+	buf, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+	return b.client.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("stacks")).Put([]byte(stack), buf)
+	})
+}
+
+func (b *BoltDB) DeleteStackPolicy(stack string) error {
+	return b.client.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("stacks")).Delete([]byte(stack))
 	})
 }
 
@@ -267,3 +627,61 @@ func (b *BoltDB) GetConfig() *internals.Config {
 
 	return &config
 }
+
+func (b *BoltDB) GetJobs() []*models.Job {
+	jobs := make([]*models.Job, 0)
+
+	b.client.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("jobs"))
+		c := bucket.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var j models.Job
+			if err := json.Unmarshal(v, &j); err != nil {
+				return err
+			}
+			jobs = append(jobs, &j)
+		}
+
+		return nil
+	})
+
+	return jobs
+}
+
+func (b *BoltDB) GetJob(jobID int) *models.Job {
+	var job *models.Job
+
+	b.client.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("jobs"))
+		value := bucket.Get(itob(jobID))
+		if value == nil {
+			return nil
+		}
+		job = &models.Job{}
+		return json.Unmarshal(value, job)
+	})
+
+	return job
+}
+
+// SaveJob stores the job, giving it an ID on first save
+func (b *BoltDB) SaveJob(job *models.Job) error {
+	return b.client.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("jobs"))
+
+		if job.ID == 0 {
+			id, err := bucket.NextSequence()
+			if err != nil {
+				return err
+			}
+			job.ID = int(id)
+		}
+
+		buf, err := json.Marshal(job)
+		if err != nil {
+			return err
+		}
+
+		return bucket.Put(itob(job.ID), buf)
+	})
+}
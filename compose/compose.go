@@ -41,6 +41,11 @@ func convertEnv(srvEnv types.MappingWithEquals) []string {
 }
 
 func ConvertServiceToContainer(srvConfig *types.ServiceConfig) (*dockerTypes.ContainerCreateConfig, error) {
+	resources, err := convertResources(srvConfig)
+	if err != nil {
+		return nil, err
+	}
+
 	cntCreateConfig := &dockerTypes.ContainerCreateConfig{
 		Name: srvConfig.ContainerName,
 		Config: &container.Config{
@@ -70,6 +75,7 @@ func ConvertServiceToContainer(srvConfig *types.ServiceConfig) (*dockerTypes.Con
 				Name:              srvConfig.Restart,
 				MaximumRetryCount: 10,
 			},
+			Resources: resources,
 		},
 		NetworkingConfig: &network.NetworkingConfig{},
 	}
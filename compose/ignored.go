@@ -0,0 +1,108 @@
+package compose
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/docker/cli/cli/compose/types"
+)
+
+// Service keys used by ConvertServiceToContainer or by the stack deployment
+var handledKeys = map[string]bool{
+	"cap_add":        true,
+	"cap_drop":       true,
+	"command":        true,
+	"container_name": true,
+	"depends_on":     true,
+	"deploy":         true,
+	"domainname":     true,
+	"entrypoint":     true,
+	"environment":    true,
+	"extra_hosts":    true,
+	"healthcheck":    true,
+	"hostname":       true,
+	"image":          true,
+	"mac_address":    true,
+	"ports":          true,
+	"privileged":     true,
+	"restart":        true,
+	"stdin_open":     true,
+	"stop_signal":    true,
+	"tty":            true,
+	"user":           true,
+	"working_dir":    true,
+}
+
+// Labels and resources are looked into
+var handledDeployKeys = map[string]bool{
+	"labels":        true,
+	"placement":     true,
+	"replicas":      true,
+	"resources":     true,
+	"update_config": true,
+}
+
+// Keys of the limits and of the reservations
+var handledResourceKeys = map[string]bool{
+	"cpus":   true,
+	"memory": true,
+}
+
+// IgnoredKeys lists the keys set on the service that have no effect once
+// deployed by Kinetik. labels are the deploy labels Kinetik reads, any other
+// one is ignored.
+func IgnoredKeys(srvConfig *types.ServiceConfig, labels map[string]bool) []string {
+	ignored := unhandledKeys(reflect.ValueOf(*srvConfig), "", handledKeys)
+	ignored = append(ignored, unhandledKeys(reflect.ValueOf(srvConfig.Deploy), "deploy.", handledDeployKeys)...)
+
+	resources := srvConfig.Deploy.Resources
+	if resources.Limits != nil {
+		ignored = append(ignored, unhandledKeys(reflect.ValueOf(*resources.Limits), "deploy.resources.limits.", handledResourceKeys)...)
+	}
+	if resources.Reservations != nil {
+		ignored = append(ignored, unhandledKeys(reflect.ValueOf(*resources.Reservations), "deploy.resources.reservations.", handledResourceKeys)...)
+	}
+
+	for key := range srvConfig.Deploy.Labels {
+		if !labels[key] {
+			ignored = append(ignored, "deploy.labels."+key)
+		}
+	}
+
+	sort.Strings(ignored)
+	return ignored
+}
+
+func unhandledKeys(v reflect.Value, prefix string, handled map[string]bool) []string {
+	keys := make([]string, 0)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := composeKey(t.Field(i))
+		if key == "" || handled[key] || isEmpty(v.Field(i)) {
+			continue
+		}
+		keys = append(keys, prefix+key)
+	}
+	return keys
+}
+
+func composeKey(field reflect.StructField) string {
+	if field.PkgPath != "" || field.Name == "Name" || field.Name == "Extras" {
+		return ""
+	}
+	if tag := field.Tag.Get("mapstructure"); tag != "" {
+		return strings.Split(tag, ",")[0]
+	}
+	return strings.ToLower(field.Name)
+}
+
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map, reflect.String:
+		return v.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	}
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
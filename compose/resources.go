@@ -0,0 +1,74 @@
+package compose
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/docker/cli/cli/compose/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+// PidsLimitLabel is the deploy label limiting the processes of each container
+// of the service. The compose format we load has no pids limit.
+const PidsLimitLabel = "be.mikrodock.pids-limit"
+
+// PidsLimit returns the pids limit of the service, 0 if it has none
+func PidsLimit(srvConfig *types.ServiceConfig) (int64, error) {
+	value := srvConfig.Deploy.Labels[PidsLimitLabel]
+	if value == "" {
+		return 0, nil
+	}
+	pids, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || pids <= 0 {
+		return 0, errors.New("Invalid pids limit " + value)
+	}
+	return pids, nil
+}
+
+// ValidateLimits checks that no limit is below the matching reservation
+func ValidateLimits(resources types.Resources) error {
+	limits, reservations := resources.Limits, resources.Reservations
+	if limits == nil || reservations == nil {
+		return nil
+	}
+	if limits.NanoCPUs != "" && reservations.NanoCPUs != "" {
+		limit, _ := strconv.ParseFloat(limits.NanoCPUs, 64)
+		reserved, _ := strconv.ParseFloat(reservations.NanoCPUs, 64)
+		if limit < reserved {
+			return errors.New("cpus limit " + limits.NanoCPUs + " is below the reservation of " + reservations.NanoCPUs)
+		}
+	}
+	if limits.MemoryBytes > 0 && limits.MemoryBytes < reservations.MemoryBytes {
+		return errors.New("memory limit " + strconv.FormatInt(int64(limits.MemoryBytes), 10) + " is below the reservation of " + strconv.FormatInt(int64(reservations.MemoryBytes), 10))
+	}
+	return nil
+}
+
+// convertResources translates the limits of the service into the resources
+// of its containers
+func convertResources(srvConfig *types.ServiceConfig) (container.Resources, error) {
+	converted := container.Resources{}
+
+	if err := ValidateLimits(srvConfig.Deploy.Resources); err != nil {
+		return converted, err
+	}
+
+	if limits := srvConfig.Deploy.Resources.Limits; limits != nil {
+		if limits.NanoCPUs != "" {
+			cpus, err := strconv.ParseFloat(limits.NanoCPUs, 64)
+			if err != nil || cpus <= 0 {
+				return converted, errors.New("Invalid cpus limit " + limits.NanoCPUs)
+			}
+			converted.NanoCPUs = int64(cpus * 1e9)
+		}
+		converted.Memory = int64(limits.MemoryBytes)
+	}
+
+	pids, err := PidsLimit(srvConfig)
+	if err != nil {
+		return converted, err
+	}
+	converted.PidsLimit = pids
+
+	return converted, nil
+}
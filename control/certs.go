@@ -0,0 +1,128 @@
+package control
+
+import (
+	"errors"
+	"io/ioutil"
+	"kinetik-server/data"
+	"kinetik-server/jobs"
+	"kinetik-server/logger"
+	"kinetik-server/models"
+	"kinetik-server/pki"
+	"kinetik-server/provider"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// pushCerts issues a new certificate for the node and copies it, with the CA,
+// where its Docker daemon expects them. The daemon is not restarted.
+func pushCerts(kLog *log.Logger, client *ssh.Client, entry *models.NodeEntry) (*pki.Issued, error) {
+	ips := []string{entry.PublicIP}
+	if entry.OverlayIP != "" {
+		ips = append(ips, entry.OverlayIP)
+	}
+	issued, err := pki.IssueNodeCert(entry.Name, ips)
+	if err != nil {
+		return nil, errors.New("Cannot issue certificate : " + err.Error())
+	}
+	caPEM, err := pki.CACertPEM()
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := ioutil.TempDir("", "kinetik-certs")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	files := []struct {
+		name    string
+		content []byte
+		mode    os.FileMode
+	}{
+		{"ca.cert", caPEM, 0644},
+		{"cert.pem", issued.CertPEM, 0644},
+		{"key.pem", issued.KeyPEM, 0600},
+	}
+
+	for _, file := range files {
+		path := filepath.Join(dir, file.name)
+		if err := ioutil.WriteFile(path, file.content, file.mode); err != nil {
+			return nil, err
+		}
+		if err := copyFile(client, path, "/etc/docker"); err != nil {
+			return nil, errors.New("Cannot copy " + file.name + " : " + err.Error())
+		}
+	}
+
+	kLog.Printf("Certificate %s pushed, valid until %s\n", issued.Serial, issued.NotAfter.Format(time.RFC3339))
+	return issued, nil
+}
+
+// useCert records the certificate pushed on the node and revokes the one it
+// replaces
+func useCert(entry *models.NodeEntry, issued *pki.Issued) {
+	previous := entry.CertSerial
+	entry.CertSerial = issued.Serial
+	entry.CertExpiresAt = issued.NotAfter
+	saveEntry(entry)
+
+	if previous != "" && previous != issued.Serial {
+		if err := data.GetDB().RevokeCert(previous); err != nil {
+			logger.ErrLog.Printf("Cannot revoke certificate %s of %s : %s\n", previous, entry.Name, err.Error())
+		}
+	}
+}
+
+// RevokeNodeCert revokes the certificate of the node. kinetik refuses to talk
+// to its Docker daemon until a new certificate is rotated in. The serial stays
+// recorded, so that the node is not rotated automatically.
+func RevokeNodeCert(entry *models.NodeEntry) error {
+	if entry.CertSerial == "" {
+		return nil
+	}
+	if err := data.GetDB().RevokeCert(entry.CertSerial); err != nil {
+		return err
+	}
+	logger.StdLog.Printf("Certificate %s of %s revoked\n", entry.CertSerial, entry.Name)
+	return nil
+}
+
+// RenewNodeCert pushes a new certificate on the node, restarts its Docker
+// daemon and revokes the previous certificate. The containers of the node stop
+// with the daemon, it must have been drained.
+func RenewNodeCert(t *jobs.Tracker, entry *models.NodeEntry) error {
+	kLog := logger.NewLogger(entry.Name + ".log")
+
+	user, port := "root", 22
+	if entry.SSHUser != "" {
+		user, port = entry.SSHUser, entry.SSHPort
+	}
+	t.Logf("Connecting to %s", entry.Name)
+	client, err := connectSSH(kLog, provider.SSHKeyPath, entry.PublicIP, user, port, 3)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	t.Logf("Pushing a new certificate to %s", entry.Name)
+	issued, err := pushCerts(kLog, client, entry)
+	if err != nil {
+		return err
+	}
+
+	t.Logf("Restarting Docker on %s", entry.Name)
+	stdout, stderr, err := SSHCommand(client, "service docker restart")
+	if err != nil {
+		kLog.Printf("Error while restarting docker : %s\nSSHOut : %s\nSSHErr : %s\n", err.Error(), stdout, stderr)
+		return errors.New("Cannot restart Docker : " + err.Error())
+	}
+
+	useCert(entry, issued)
+	t.Logf("Certificate of %s is now %s", entry.Name, issued.Serial)
+	return nil
+}
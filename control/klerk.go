@@ -0,0 +1,205 @@
+package control
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"kinetik-server/data"
+	"kinetik-server/logger"
+	"kinetik-server/models"
+	"kinetik-server/provider"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/tmc/scp"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type DockerClusterOptions struct {
+	ClusterStoreAddress string
+	AdvertiseAddress    string
+	CAPath              string
+	CertPath            string
+	KeyPath             string
+}
+
+func (d *DockerClusterOptions) String() string {
+	var sb bytes.Buffer
+	if len(d.ClusterStoreAddress) != 0 {
+		sb.WriteString("--cluster-store=consul://" + d.ClusterStoreAddress + "\n")
+	}
+	if len(d.AdvertiseAddress) != 0 {
+		sb.WriteString("--cluster-advertise=" + d.AdvertiseAddress + "\n")
+	}
+	if len(d.CAPath) != 0 {
+		sb.WriteString("--cluster-store-opt kv.cacertfile=" + d.CAPath + "\n")
+	}
+	if len(d.CertPath) != 0 {
+		sb.WriteString("--cluster-store-opt kv.certfile=" + d.CertPath + "\n")
+	}
+	if len(d.KeyPath) != 0 {
+		sb.WriteString("--cluster-store-opt kv.keyfile=" + d.KeyPath + "\n")
+	}
+	return sb.String()
+}
+
+// StartDocker starts the Docker daemon of the node once it got its
+// certificates, which makes the node ready
+func StartDocker(ip string) error {
+	user, port := "root", 22
+	entry := data.FindNodeEntry(ip)
+	if entry != nil && entry.SSHUser != "" {
+		user, port = entry.SSHUser, entry.SSHPort
+	}
+	var kLog *log.Logger
+	if entry != nil {
+		kLog = logger.NewLogger(entry.Name + ".log")
+	} else {
+		kLog = logger.NewLogger(ip + ".log")
+	}
+
+	sshPath := provider.SSHKeyPath
+	sshClient, err := connectSSH(kLog, sshPath, ip, user, port, 3)
+	if err != nil {
+		kLog.Println("SSH error :", err.Error())
+		return err
+	}
+	defer sshClient.Close()
+	stdout, stderr, err := SSHCommand(sshClient, "service docker start")
+	if err != nil {
+		kLog.Printf("Error while starting docker : %s\nSSHOut : %s\nSSHErr : %s\n", err.Error(), stdout, stderr)
+		return err
+	}
+
+	if entry != nil {
+		entry.Phase = models.PhaseReady
+		entry.Error = ""
+		saveEntry(entry)
+	}
+	return nil
+}
+
+func saveEntry(entry *models.NodeEntry) {
+	if err := data.GetDB().SaveNodeEntry(entry); err != nil {
+		logger.ErrLog.Printf("Cannot save node %s : %s\n", entry.Name, err.Error())
+	}
+}
+
+func copyFile(sshClient *ssh.Client, source, destination string) error {
+	session, err := sshClient.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	return scp.CopyPath(source, destination, session)
+}
+
+func getMyIP() (string, error) {
+	netIf, err := net.InterfaceByName("eth0")
+	if err != nil {
+		return "", err
+	}
+
+	addrs, err := netIf.Addrs()
+	if err != nil {
+		return "", err
+	}
+
+	var ip net.IP
+
+	for _, addr := range addrs {
+		switch v := addr.(type) {
+		case *net.IPNet:
+			ip = v.IP
+		case *net.IPAddr:
+			ip = v.IP
+		}
+		if ip != nil && ip.To4() != nil {
+			break
+		}
+	}
+
+	if ip != nil {
+		return ip.String(), nil
+	} else {
+		return "", errors.New("Cannot resolve IP of eth0 interface")
+	}
+
+}
+
+func publicKeyFile(file string) ssh.AuthMethod {
+	buffer, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+
+	key, err := ssh.ParsePrivateKey(buffer)
+	if err != nil {
+		return nil
+	}
+	return ssh.PublicKeys(key)
+}
+
+// connectSSH dials the machine, up to attempts times 10 seconds apart
+func connectSSH(kLog *log.Logger, sshKeyPath, ip, user string, port int, attempts int) (*ssh.Client, error) {
+
+	logger.StdLog.Printf("Opening SSH connection to %s\n", ip)
+
+	sshConfig := &ssh.ClientConfig{
+		User: user,
+		Auth: []ssh.AuthMethod{
+			publicKeyFile(sshKeyPath),
+		},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         10 * time.Second,
+	}
+
+	var err error
+	for try := 1; try <= attempts; try++ {
+		var client *ssh.Client
+		client, err = ssh.Dial("tcp", ip+":"+strconv.Itoa(port), sshConfig)
+		if err == nil {
+			return client, nil
+		}
+		kLog.Printf("SSH : attempt %d/%d failed : %s\n", try, attempts, err.Error())
+		if try < attempts {
+			time.Sleep(10 * time.Second)
+		}
+	}
+
+	return nil, err
+}
+
+func SSHCommand(client *ssh.Client, cmd string) (string, string, error) {
+	sess, err := client.NewSession()
+	if err != nil {
+		return "", "", err
+	}
+	defer sess.Close()
+	var stdoutBuf bytes.Buffer
+	sess.Stdout = &stdoutBuf
+	var stderrBuf bytes.Buffer
+	sess.Stderr = &stderrBuf
+
+	err = sess.Run(cmd)
+
+	return stdoutBuf.String(), stderrBuf.String(), err
+}
+
+func LoadPrivateKey(file string) (ssh.Signer, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ssh.ParsePrivateKey(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
@@ -0,0 +1,408 @@
+package control
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"kinetik-server/data"
+	"kinetik-server/jobs"
+	"kinetik-server/logger"
+	"kinetik-server/models"
+	"kinetik-server/provider"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// A provisioning step is retried up to attempts times, each attempt being
+// given timeout. Steps must be safe to run again, since a provisioning
+// interrupted by a restart resumes at the step it was running, and must
+// return once their context is done.
+type provisioningStep struct {
+	name     string
+	phase    string
+	attempts int
+	timeout  time.Duration
+	run      func(p *Provisioning, ctx context.Context) error
+}
+
+var provisioningSteps = []provisioningStep{
+	{"create_machine", models.PhaseCreating, 3, 2 * time.Minute, (*Provisioning).createMachine},
+	{"wait_active", models.PhaseCreating, 1, 10 * time.Minute, (*Provisioning).waitActive},
+	{"wait_ip", models.PhaseCreating, 1, 2 * time.Minute, (*Provisioning).waitIP},
+	{"connect_ssh", models.PhaseConfiguring, 60, 30 * time.Second, (*Provisioning).connect},
+	{"write_env", models.PhaseConfiguring, 3, time.Minute, (*Provisioning).writeEnv},
+	{"configure_docker", models.PhaseConfiguring, 3, 2 * time.Minute, (*Provisioning).configureDocker},
+	{"install_client", models.PhaseConfiguring, 3, 5 * time.Minute, (*Provisioning).installClient},
+	{"start_client", models.PhaseConfiguring, 3, time.Minute, (*Provisioning).startClient},
+	{"install_certs", models.PhaseAwaitingCerts, 3, time.Minute, (*Provisioning).installCerts},
+	{"start_docker", models.PhaseAwaitingCerts, 3, 2 * time.Minute, (*Provisioning).startDocker},
+}
+
+// Provisioning creates the machine of a node with the provider, installs the
+// kinetik-client on it, pushes the certificates of its Docker daemon and
+// starts it. Progress is saved in the inventory entry.
+type Provisioning struct {
+	Provider provider.Provider
+	Entry    *models.NodeEntry
+
+	kLog   *log.Logger
+	client *ssh.Client
+}
+
+func NewProvisioning(p provider.Provider, entry *models.NodeEntry) *Provisioning {
+	return &Provisioning{
+		Provider: p,
+		Entry:    entry,
+	}
+}
+
+func (p *Provisioning) Run(t *jobs.Tracker) error {
+	p.kLog = logger.NewLogger(p.Entry.Name + ".log")
+	defer func() {
+		if p.client != nil {
+			p.client.Close()
+		}
+	}()
+
+	if p.Entry.Provider != p.Provider.Name() {
+		return p.fail(errors.New("Node " + p.Entry.Name + " belongs to provider " + p.Entry.Provider + ", not " + p.Provider.Name()))
+	}
+
+	start := 0
+	for i, step := range provisioningSteps {
+		if step.name == p.Entry.Step {
+			start = i
+		}
+	}
+	if start > 0 {
+		t.Logf("Resuming provisioning of %s at %s", p.Entry.Name, provisioningSteps[start].name)
+		p.kLog.Println("======== RESUME " + p.Entry.Name + " ========")
+	}
+
+	for _, step := range provisioningSteps[start:] {
+		p.Entry.Phase = step.phase
+		p.Entry.Step = step.name
+		p.Entry.Error = ""
+		saveEntry(p.Entry)
+
+		t.Logf("Step %s of %s", step.name, p.Entry.Name)
+		p.kLog.Println("Step", step.name)
+
+		var err error
+		for attempt := 1; attempt <= step.attempts; attempt++ {
+			err = p.runStep(step)
+			if err == nil {
+				break
+			}
+			t.Logf("Step %s failed (attempt %d/%d) : %s", step.name, attempt, step.attempts, err.Error())
+			p.kLog.Printf("Step %s failed (attempt %d/%d) : %s\n", step.name, attempt, step.attempts, err.Error())
+			if attempt < step.attempts {
+				time.Sleep(10 * time.Second)
+			}
+		}
+		if err != nil {
+			p.destroyMachine()
+			return p.fail(fmt.Errorf("%s : %s", step.name, err.Error()))
+		}
+	}
+
+	p.Entry.Phase = models.PhaseReady
+	p.Entry.Step = ""
+	saveEntry(p.Entry)
+
+	logger.StdLog.Printf("Node %s (%s) is now ready\n", p.Entry.Name, p.Entry.MachineID)
+	p.kLog.Println("======== END " + p.Entry.Name + " ========")
+
+	return nil
+}
+
+// runStep cancels the step after its timeout. The step has returned by the
+// time runStep does, so that it never races with the next attempt. A timed out
+// step may have closed the SSH connection, which is opened again.
+func (p *Provisioning) runStep(step provisioningStep) error {
+	ctx, cancel := context.WithTimeout(context.Background(), step.timeout)
+	defer cancel()
+
+	err := step.run(p, ctx)
+	if ctx.Err() == context.DeadlineExceeded {
+		if p.client != nil {
+			p.client.Close()
+			p.client = nil
+		}
+		return errors.New("Timed out after " + step.timeout.String())
+	}
+	return err
+}
+
+// sleep waits for d, or until ctx is done
+func sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// destroyMachine destroys the machine of a node which will not join, so that
+// it is not left running. A retry starts over with a new machine.
+func (p *Provisioning) destroyMachine() {
+	if p.Entry.MachineID == "" {
+		return
+	}
+	if err := p.Provider.DestroyMachine(p.Entry.MachineID); err != nil {
+		// Kept, deleting the node destroys it
+		p.kLog.Println("Cannot destroy machine", p.Entry.MachineID, ":", err.Error())
+		return
+	}
+	p.kLog.Println("Destroyed machine", p.Entry.MachineID)
+	p.Entry.MachineID = ""
+	p.Entry.PublicIP = ""
+	p.Entry.OverlayIP = ""
+	p.Entry.Step = ""
+}
+
+func (p *Provisioning) fail(err error) error {
+	p.Entry.Phase = models.PhaseFailed
+	p.Entry.Error = err.Error()
+	saveEntry(p.Entry)
+	p.kLog.Println("Provisioning failed :", err.Error())
+	return err
+}
+
+func (p *Provisioning) createMachine(ctx context.Context) error {
+	// Created before an interruption
+	if p.Entry.MachineID != "" {
+		return nil
+	}
+
+	// Created by an attempt which failed or timed out afterwards
+	machines, err := p.Provider.ListMachines()
+	if err != nil {
+		return err
+	}
+	var machine *provider.Machine
+	for _, m := range machines {
+		if m.Name == p.Entry.Name {
+			machine = m
+			p.kLog.Println("Machine", m.ID, "already exists")
+			break
+		}
+	}
+
+	if machine == nil {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		machine, err = p.Provider.CreateMachine(&provider.MachineOptions{
+			Name:   p.Entry.Name,
+			Size:   p.Entry.Size,
+			Region: p.Entry.Region,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	p.Entry.MachineID = machine.ID
+	p.Entry.SSHUser = machine.SSHUser
+	p.Entry.SSHPort = machine.SSHPort
+	saveEntry(p.Entry)
+	return nil
+}
+
+func (p *Provisioning) waitActive(ctx context.Context) error {
+	for {
+		status, err := p.Provider.Status(p.Entry.MachineID)
+		if err != nil {
+			return err
+		}
+		switch status {
+		case provider.StatusActive:
+			return nil
+		case provider.StatusOff:
+			return errors.New("Machine " + p.Entry.MachineID + " is off")
+		}
+		p.kLog.Println("Machine in state", status, ". Waiting 10 seconds")
+		if err := sleep(ctx, 10*time.Second); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *Provisioning) waitIP(ctx context.Context) error {
+	for {
+		ip, err := p.Provider.GetIP(p.Entry.MachineID)
+		if err == nil && ip != "" {
+			p.Entry.PublicIP = ip
+			saveEntry(p.Entry)
+			p.kLog.Println("Machine created. IP", ip)
+			logger.StdLog.Printf("Node %s (%s) is now running with IP %s\n", p.Entry.Name, p.Entry.MachineID, ip)
+			return nil
+		}
+		if err := sleep(ctx, time.Second); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *Provisioning) connect(ctx context.Context) error {
+	if p.client != nil {
+		return nil
+	}
+	client, err := connectSSH(p.kLog, provider.SSHKeyPath, p.Entry.PublicIP, p.Entry.SSHUser, p.Entry.SSHPort, 1)
+	if err != nil {
+		return err
+	}
+	// Given up on while dialing
+	if err := ctx.Err(); err != nil {
+		client.Close()
+		return err
+	}
+	p.client = client
+	p.kLog.Println("Machine SSH ready")
+	return nil
+}
+
+// interrupt closes the SSH connection if ctx is done before the returned func
+// is called, so that a hung command returns
+func (p *Provisioning) interrupt(ctx context.Context) func() {
+	client := p.client
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			client.Close()
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
+// run executes the command on the machine, logging its output when it fails
+func (p *Provisioning) run(ctx context.Context, cmd string) error {
+	if err := p.connect(ctx); err != nil {
+		return err
+	}
+	defer p.interrupt(ctx)()
+	stdout, stderr, err := SSHCommand(p.client, cmd)
+	if err != nil {
+		p.kLog.Printf("Error while running command %s\n Err : %s\nSSHOut : %s\nSSHErr : %s\n", cmd, err.Error(), stdout, stderr)
+	}
+	return err
+}
+
+func (p *Provisioning) writeEnv(ctx context.Context) error {
+	envVars := make(map[string]string)
+	envVars["CONSUL_IP"] = os.Getenv("CONSUL_IP")
+	myIP, _ := getMyIP()
+	envVars["KINETIK_MASTER"] = myIP + ":10513"
+
+	lines := make([]string, 0, len(envVars))
+	for key, value := range envVars {
+		lines = append(lines, fmt.Sprintf("export %s=%s", key, value))
+	}
+
+	return p.run(ctx, fmt.Sprintf("printf '%%s\\n' '%s' > ~/.env", strings.Join(lines, "' '")))
+}
+
+func (p *Provisioning) configureDocker(ctx context.Context) error {
+	err := p.run(ctx, "service docker stop")
+	if err != nil {
+		return err
+	}
+
+	dockerConfig := &DockerClusterOptions{
+		AdvertiseAddress:    p.Entry.PublicIP + ":2376",
+		ClusterStoreAddress: os.Getenv("CONSUL_IP"),
+		CAPath:              "/etc/docker/kv-ca.cert",
+		CertPath:            "/etc/docker/kv-cert.pem",
+		KeyPath:             "/etc/docker/kv-key.pem",
+	}
+
+	dockerConf := `DOCKER_OPTS='
+-H tcp://0.0.0.0:2376
+-H unix:///var/run/docker.sock
+--tlsverify
+--tlscacert /etc/docker/ca.cert
+--tlscert /etc/docker/cert.pem
+--tlskey /etc/docker/key.pem
+` + dockerConfig.String() + `'`
+
+	// DONT RESTART DOCKER YET, WE NEED TO SEND THE CERTIFICATE FROM THE CLIENT
+	return p.run(ctx, fmt.Sprintf("printf %%s \"%s\" | tee /etc/default/docker", dockerConf))
+}
+
+func (p *Provisioning) installClient(ctx context.Context) error {
+	err := p.run(ctx, "wget https://nsurleraux.be/kinetik-client -O /usr/bin/kinetik-client")
+	if err != nil {
+		return err
+	}
+
+	err = p.run(ctx, "chmod +x /usr/bin/kinetik-client")
+	if err != nil {
+		return err
+	}
+
+	// Installed by an interrupted attempt
+	p.run(ctx, "kinetik-client remove")
+
+	return p.run(ctx, "kinetik-client install")
+}
+
+func (p *Provisioning) startClient(ctx context.Context) error {
+	return p.run(ctx, "kinetik-client start")
+}
+
+func (p *Provisioning) installCerts(ctx context.Context) error {
+	if err := p.connect(ctx); err != nil {
+		return err
+	}
+	stop := p.interrupt(ctx)
+	issued, err := pushCerts(p.kLog, p.client, p.Entry)
+	stop()
+	if err != nil {
+		return err
+	}
+	useCert(p.Entry, issued)
+	return nil
+}
+
+func (p *Provisioning) startDocker(ctx context.Context) error {
+	return p.run(ctx, "service docker start")
+}
+
+// ResumeProvisioning restarts, in new jobs, the provisioning of the nodes a
+// previous run left unfinished
+func ResumeProvisioning() {
+	for _, entry := range data.GetDB().GetNodeEntries() {
+		if !entry.IsProvisioning() {
+			continue
+		}
+
+		if _, err := StartProvisioning(provider.GetProvider(), entry); err != nil {
+			logger.ErrLog.Printf("Cannot resume provisioning of %s : %s\n", entry.Name, err.Error())
+		}
+	}
+}
+
+// StartProvisioning starts a job provisioning the saved entry with the
+// provider
+func StartProvisioning(p provider.Provider, entry *models.NodeEntry) (*jobs.Tracker, error) {
+	tracker, err := jobs.New(models.JobProvisionNode, "")
+	if err != nil {
+		return nil, err
+	}
+	tracker.Update(func(job *models.Job) {
+		job.NodeID = entry.Name
+	})
+
+	tracker.Run(NewProvisioning(p, entry).Run, nil)
+	return tracker, nil
+}
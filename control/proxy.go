@@ -21,26 +21,41 @@ type IPWithWeight struct {
 	Weight int
 }
 
-func AddToDNS(serviceName string, stackName string, ips []IPWithWeight) {
+// The management containers are reached through the docker_gwbridge network,
+// which shares the last byte of their mikroverlay address
+func gatewayIP(overlayIP string) string {
+	parts := strings.Split(overlayIP, ".")
+	lastpart := parts[len(parts)-1]
+	return "172.18.0." + lastpart
+}
+
+func DNSIP() string {
+	return gatewayIP(data.GetDB().GetConfig().DNSIP)
+}
+
+func ProxyIP() string {
+	return gatewayIP(data.GetDB().GetConfig().ProxyIP)
+}
+
+func AddToDNS(serviceName string, stackName string, ips []IPWithWeight) error {
 	var wg sync.WaitGroup
 
 	wg.Add(len(ips))
+	errs := make(chan error, len(ips))
 
-	dnsIPParts := strings.Split(data.GetDB().GetConfig().DNSIP, ".")
-	lastpart := dnsIPParts[len(dnsIPParts)-1]
-	dnsIP := "172.18.0." + lastpart
+	dnsIP := DNSIP()
 
 	for _, ip := range ips {
 		go func(registerName string, ip IPWithWeight, wgI *sync.WaitGroup) {
+			defer wgI.Done()
 
 			res, err := netClient.Post("http://"+dnsIP+":8080/api/domains/"+registerName, "text/plain", bytes.NewBufferString(ip.IP+" "+strconv.Itoa(ip.Weight)))
 			if err != nil {
-				panic(err)
+				errs <- err
+				return
 			}
 			defer res.Body.Close()
 			ioutil.ReadAll(res.Body)
-
-			wgI.Done()
 		}(
 			serviceName+"."+stackName+".mikrodock",
 			ip,
@@ -49,6 +64,10 @@ func AddToDNS(serviceName string, stackName string, ips []IPWithWeight) {
 	}
 
 	wg.Wait()
+	close(errs)
+
+	// nil when every registration succeeded
+	return <-errs
 }
 
 type ServiceCreationRequest struct {
@@ -58,7 +77,7 @@ type ServiceCreationRequest struct {
 	InternalPort int    `json:"internal_port"`
 }
 
-func AddToProxy(serviceName string, stackName string, internalPort int, publicPort int) {
+func AddToProxy(serviceName string, stackName string, internalPort int, publicPort int) error {
 	srvCrReq := ServiceCreationRequest{
 		ServiceName:  serviceName,
 		StackName:    stackName,
@@ -69,39 +88,38 @@ func AddToProxy(serviceName string, stackName string, internalPort int, publicPo
 	jsonValue, _ := json.Marshal(srvCrReq)
 	jsonBuffer := bytes.NewBuffer(jsonValue)
 
-	proxyIPParts := strings.Split(data.GetDB().GetConfig().ProxyIP, ".")
-	lastpart := proxyIPParts[len(proxyIPParts)-1]
-	proxyIP := "172.18.0." + lastpart
-
-	res, _ := netClient.Post("http://"+proxyIP+":10512/services/", "application/json", jsonBuffer)
+	res, err := netClient.Post("http://"+ProxyIP()+":10512/services/", "application/json", jsonBuffer)
+	if err != nil {
+		return err
+	}
 	defer res.Body.Close()
 	ioutil.ReadAll(res.Body)
 
+	return nil
 }
 
-func RemoveFromProxy(serviceName, stackName string) {
+func RemoveFromProxy(serviceName, stackName string) error {
 	emptyBuffer := bytes.NewBuffer([]byte{})
 
-	proxyIPParts := strings.Split(data.GetDB().GetConfig().ProxyIP, ".")
-	lastpart := proxyIPParts[len(proxyIPParts)-1]
-	proxyIP := "172.18.0." + lastpart
-
-	res, _ := netClient.Post("http://"+proxyIP+":10512/services/"+stackName+"/"+serviceName, "application/json", emptyBuffer)
+	res, err := netClient.Post("http://"+ProxyIP()+":10512/services/"+stackName+"/"+serviceName, "application/json", emptyBuffer)
+	if err != nil {
+		return err
+	}
 	defer res.Body.Close()
 	ioutil.ReadAll(res.Body)
-}
 
-func RemoveFromDNS(serviceName, stackName, containerIP string) {
-	dnsIPParts := strings.Split(data.GetDB().GetConfig().DNSIP, ".")
-	lastpart := dnsIPParts[len(dnsIPParts)-1]
-	dnsIP := "172.18.0." + lastpart
+	return nil
+}
 
-	req, _ := http.NewRequest("DELETE", "http://"+dnsIP+":8080/api/domains/"+serviceName+"."+stackName+".mikrodock", bytes.NewBufferString(containerIP))
+func RemoveFromDNS(serviceName, stackName, containerIP string) error {
+	req, _ := http.NewRequest("DELETE", "http://"+DNSIP()+":8080/api/domains/"+serviceName+"."+stackName+".mikrodock", bytes.NewBufferString(containerIP))
 
 	res, err := netClient.Do(req)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer res.Body.Close()
 	ioutil.ReadAll(res.Body)
+
+	return nil
 }
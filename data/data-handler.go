@@ -11,16 +11,39 @@ type DataHandler interface {
 	GetNodes() map[string]*models.Node
 	GetNode(nodeId string) *models.Node
 	AddNode(nodeid string, node *models.Node) error
-	DeleteNode(nodeID int) error
+	UpdateNode(nodeid string, fn func(node *models.Node) *models.Node) error
+	DeleteNode(nodeid string) error
+	GetNodeEntries() []*models.NodeEntry
+	GetNodeEntry(name string) *models.NodeEntry
+	SaveNodeEntry(entry *models.NodeEntry) error
+	DeleteNodeEntry(name string) error
+	RevokeCert(serial string) error
+	IsCertRevoked(serial string) bool
+	SavePlacement(decision *models.PlacementDecision) error
+	GetPlacement(containerID string) *models.PlacementDecision
+	DeletePlacement(containerID string) error
+	GetStackPolicy(stack string) *models.StackPolicy
+	SetStackPolicy(stack string, policy *models.StackPolicy) error
+	DeleteStackPolicy(stack string) error
 	GetService(identifier string) *models.Service
 	GetServices() []*models.Service
 	AddService(service *models.Service) error
-	DeleteService(serviceID int) error
+	DeleteService(identifier string) error
+	AddRevision(service *models.Service) error
+	GetRevisions(identifier string) []*models.ServiceRevision
+	GetRevision(identifier string, revision int) *models.ServiceRevision
+	DeleteRevisions(identifier string) error
+	AddScalingDecision(identifier string, decision *models.ScalingDecision) error
+	GetScalingDecisions(identifier string) []*models.ScalingDecision
+	DeleteScalingDecisions(identifier string) error
 	GetInstances() []*models.Instance
 	AddInstance(stack string, service string, instance *models.Instance) error
 	DeleteInstance(instanceID int) error
 	SetConfig(config *internals.Config) error
 	GetConfig() *internals.Config
+	GetJobs() []*models.Job
+	GetJob(jobID int) *models.Job
+	SaveJob(job *models.Job) error
 }
 
 var dbInstance DataHandler
@@ -32,3 +55,25 @@ func GetDB() DataHandler {
 	})
 	return dbInstance
 }
+
+// UseDB makes GetDB return db instead of the database of the server. It has
+// no effect once GetDB was called.
+func UseDB(db DataHandler) {
+	once.Do(func() {
+		dbInstance = db
+	})
+}
+
+// FindNodeEntry returns the inventory record of the node with the given name
+// or public IP, nil if there is none
+func FindNodeEntry(id string) *models.NodeEntry {
+	if entry := GetDB().GetNodeEntry(id); entry != nil {
+		return entry
+	}
+	for _, entry := range GetDB().GetNodeEntries() {
+		if entry.PublicIP == id {
+			return entry
+		}
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package deploy
+
+import (
+	"errors"
+	"kinetik-server/control"
+	"kinetik-server/data"
+	"kinetik-server/jobs"
+	"kinetik-server/logger"
+	"kinetik-server/models"
+	"kinetik-server/pki"
+	"sync"
+	"time"
+)
+
+// Certificates are rotated when they expire within RotateBefore
+var RotateBefore = 30 * 24 * time.Hour
+
+// RotationsPerPass is how many nodes an automatic pass rotates at most
+var RotationsPerPass = 3
+
+var rotatingMu sync.Mutex
+var rotating = make(map[string]bool)
+
+// Held while a node is drained and its Docker daemon restarted, so that nodes
+// are rotated one at a time
+var restartMu sync.Mutex
+
+// CertRotation cordons and drains the node, pushes a new certificate on it,
+// restarts its Docker daemon and revokes the previous certificate. The node is
+// uncordoned afterwards, unless it was cordoned before. Nodes are rotated one
+// at a time.
+type CertRotation struct {
+	Name string
+}
+
+func (r *CertRotation) Run(t *jobs.Tracker) error {
+	rotatingMu.Lock()
+	if rotating[r.Name] {
+		rotatingMu.Unlock()
+		return errors.New("Certificate of " + r.Name + " is already being rotated")
+	}
+	rotating[r.Name] = true
+	rotatingMu.Unlock()
+	defer func() {
+		rotatingMu.Lock()
+		delete(rotating, r.Name)
+		rotatingMu.Unlock()
+	}()
+
+	restartMu.Lock()
+	defer restartMu.Unlock()
+
+	entry := data.GetDB().GetNodeEntry(r.Name)
+	if entry == nil {
+		return errors.New("Node " + r.Name + " not found")
+	}
+
+	wasCordoned, err := setCordoned(entry.PublicIP, true)
+	if err != nil {
+		return errors.New("Cannot cordon " + entry.Name + " : " + err.Error())
+	}
+	if !wasCordoned {
+		defer func() {
+			if _, err := setCordoned(entry.PublicIP, false); err != nil {
+				t.Logf("Cannot uncordon %s : %s", entry.Name, err.Error())
+			}
+		}()
+	}
+
+	t.Logf("Draining %s", entry.Name)
+	drain := &NodeDrain{NodeIP: entry.PublicIP}
+	if err := drain.Run(t); err != nil {
+		return errors.New(err.Error() + ", its certificate is left as is")
+	}
+
+	return control.RenewNodeCert(t, entry)
+}
+
+// setCordoned marks the node schedulable or not and tells whether it was
+// cordoned before
+func setCordoned(nodeIP string, cordoned bool) (bool, error) {
+	was := false
+	err := data.GetDB().UpdateNode(nodeIP, func(node *models.Node) *models.Node {
+		if node == nil {
+			return nil
+		}
+		was = node.Cordoned
+		node.Cordoned = cordoned
+		return node
+	})
+	return was, err
+}
+
+// RotateCert starts a job rotating the certificate of the node
+func RotateCert(name string) (*jobs.Tracker, error) {
+	tracker, err := jobs.New(models.JobRotateCert, "")
+	if err != nil {
+		return nil, err
+	}
+	tracker.Update(func(job *models.Job) {
+		job.NodeID = name
+	})
+
+	rotation := &CertRotation{
+		Name: name,
+	}
+	tracker.Run(rotation.Run, nil)
+	return tracker, nil
+}
+
+// StartCertRotation rotates, every interval, the certificates about to expire
+func StartCertRotation(interval time.Duration) {
+	go func() {
+		for {
+			RotateExpiring(time.Now().Add(RotateBefore))
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// RotateExpiring starts a rotation job for the ready nodes whose certificate
+// expires before deadline, and for the nodes whose certificate predates the CA,
+// including those which joined by themselves. At most RotationsPerPass nodes
+// are rotated, and none while the previous pass is not over. Revoked
+// certificates are only rotated on demand.
+func RotateExpiring(deadline time.Time) {
+	if !pki.HasCA() {
+		return
+	}
+
+	rotatingMu.Lock()
+	busy := len(rotating) > 0
+	rotatingMu.Unlock()
+	if busy {
+		return
+	}
+
+	entries := data.GetDB().GetNodeEntries()
+	known := make(map[string]bool)
+	for _, entry := range entries {
+		known[entry.PublicIP] = true
+	}
+	for ip := range data.GetDB().GetNodes() {
+		if known[ip] {
+			continue
+		}
+		// Node which joined by itself
+		entry := models.NewNodeEntry(ip, "")
+		entry.PublicIP = ip
+		entry.Phase = models.PhaseReady
+		if err := data.GetDB().SaveNodeEntry(entry); err != nil {
+			logger.ErrLog.Printf("Cannot save node %s : %s\n", ip, err.Error())
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	started := 0
+	for _, entry := range entries {
+		if entry.Phase != models.PhaseReady {
+			continue
+		}
+		if entry.CertSerial != "" && (entry.CertExpiresAt.After(deadline) || data.GetDB().IsCertRevoked(entry.CertSerial)) {
+			continue
+		}
+		if started == RotationsPerPass {
+			logger.StdLog.Println("Certificate rotation : more nodes are due, they are rotated by the next passes")
+			return
+		}
+
+		if _, err := RotateCert(entry.Name); err != nil {
+			logger.ErrLog.Printf("Cannot rotate certificate of %s : %s\n", entry.Name, err.Error())
+			continue
+		}
+		started++
+	}
+}
@@ -0,0 +1,256 @@
+package deploy
+
+import (
+	"kinetik-server/control"
+	"kinetik-server/data"
+	"kinetik-server/docker"
+	"kinetik-server/iptables"
+	"kinetik-server/logger"
+	"kinetik-server/models"
+	"kinetik-server/scheduler"
+	"sync"
+)
+
+var locksMu sync.Mutex
+var portsMu sync.Mutex
+var locks = make(map[string]*sync.Mutex)
+
+// LockService serializes every change made to the stored service, whether it
+// comes from the API or from the reconciler. Call the returned func to unlock.
+func LockService(identifier string) func() {
+	locksMu.Lock()
+	mu, ok := locks[identifier]
+	if !ok {
+		mu = &sync.Mutex{}
+		locks[identifier] = mu
+	}
+	locksMu.Unlock()
+
+	mu.Lock()
+	return mu.Unlock
+}
+
+// StartInstance schedules and runs a new container for the service. The
+// instance is neither registered in DNS nor added to the service. When no node
+// has room for it, an *UnschedulableError is returned.
+func StartInstance(srv *models.Service) (*models.Instance, error) {
+	decision, err := scheduler.GetScheduler().Select(scheduler.NewRequest(srv))
+	if err != nil {
+		return nil, err
+	}
+	if decision.NodeIP == "" && srv.Priority > 0 {
+		if preempted := preempt(srv); preempted != nil {
+			decision = preempted
+		}
+	}
+	return runInstance(srv, decision)
+}
+
+// StartInstanceOn is StartInstance restricted to the given nodes. Nothing is
+// preempted.
+func StartInstanceOn(srv *models.Service, nodes []string) (*models.Instance, error) {
+	req := scheduler.NewRequest(srv)
+	req.Nodes = nodes
+	decision, err := scheduler.GetScheduler().Select(req)
+	if err != nil {
+		return nil, err
+	}
+	return runInstance(srv, decision)
+}
+
+// runInstance runs the container of the service on the node of the decision.
+// The instance holds the claim of the decision until it is released.
+func runInstance(srv *models.Service, decision *models.PlacementDecision) (*models.Instance, error) {
+	nodeIP := decision.NodeIP
+	if nodeIP == "" {
+		return nil, &UnschedulableError{Identifier: srv.Identifier()}
+	}
+
+	inst, err := runContainer(srv, decision)
+	if err != nil {
+		if decision.Release != nil {
+			decision.Release()
+		}
+		return nil, err
+	}
+	inst.Release = decision.Release
+	return inst, nil
+}
+
+func runContainer(srv *models.Service, decision *models.PlacementDecision) (*models.Instance, error) {
+	nodeIP := decision.NodeIP
+
+	client, err := docker.GetRemoteClient(nodeIP)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	id, err := docker.RunContainerFromConfig(client, srv.ContainerConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	ip, err := docker.GetContainerIP(client, id, "mikroverlay")
+	if err != nil {
+		docker.StopAndRemoveContainer(client, id)
+		return nil, err
+	}
+
+	decision.ContainerID = id
+	if err := data.GetDB().SavePlacement(decision); err != nil {
+		logger.ErrLog.Printf("Cannot save placement of %s : %s\n", id, err.Error())
+	}
+
+	return &models.Instance{
+		ContainerID: id,
+		NodeID:      nodeIP,
+		IP:          ip,
+		Revision:    srv.Revision,
+	}, nil
+}
+
+// ReleaseClaims ends the claims the scheduler holds for the instances, once
+// they are saved in their service
+func ReleaseClaims(instances []*models.Instance) {
+	for _, inst := range instances {
+		if inst.Release != nil {
+			inst.Release()
+			inst.Release = nil
+		}
+	}
+}
+
+func RegisterInstances(srv *models.Service, instances []*models.Instance) error {
+	ipWeights := make([]control.IPWithWeight, 0, len(instances))
+	for _, inst := range instances {
+		ipWeights = append(ipWeights, control.IPWithWeight{
+			IP:     inst.IP,
+			Weight: 10,
+		})
+	}
+	return control.AddToDNS(srv.ServiceName, srv.StackName, ipWeights)
+}
+
+// StopInstance removes the instance from DNS then removes its container.
+// The instance is not removed from the service.
+func StopInstance(srv *models.Service, inst *models.Instance) error {
+	ReleaseClaims([]*models.Instance{inst})
+
+	if inst.IP != "" {
+		if err := control.RemoveFromDNS(srv.ServiceName, srv.StackName, inst.IP); err != nil {
+			logger.ErrLog.Printf("Cannot remove %s from DNS of %s : %s\n", inst.IP, srv.Identifier(), err.Error())
+		}
+	}
+
+	data.GetDB().DeletePlacement(inst.ContainerID)
+
+	client, err := docker.GetRemoteClient(inst.NodeID)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	return docker.StopAndRemoveContainer(client, inst.ContainerID)
+}
+
+// ForgetInstance removes the instance from DNS without touching its container,
+// for instances whose node cannot be reached anymore
+func ForgetInstance(srv *models.Service, inst *models.Instance) {
+	data.GetDB().DeletePlacement(inst.ContainerID)
+	if inst.IP == "" {
+		return
+	}
+	if err := control.RemoveFromDNS(srv.ServiceName, srv.StackName, inst.IP); err != nil {
+		logger.ErrLog.Printf("Cannot remove %s from DNS of %s : %s\n", inst.IP, srv.Identifier(), err.Error())
+	}
+}
+
+// PublishPorts registers the published ports of the service in the proxy and
+// links them on the host. Ports already linked are skipped.
+func PublishPorts(srv *models.Service) error {
+	if len(srv.Ports) == 0 {
+		return nil
+	}
+
+	portsMu.Lock()
+	defer portsMu.Unlock()
+
+	config := data.GetDB().GetConfig()
+	proxyIP := control.ProxyIP()
+
+	for _, portConfig := range srv.Ports {
+		err := control.AddToProxy(srv.ServiceName, srv.StackName, int(portConfig.Target), int(portConfig.Published))
+		if err != nil {
+			return err
+		}
+
+		if isBound(config.PortsBinding, int(portConfig.Published)) {
+			continue
+		}
+
+		err = iptables.NewLinkPort(proxyIP, int(portConfig.Published), int(portConfig.Target))
+		if err != nil {
+			return err
+		}
+		config.PortsBinding = append(config.PortsBinding, int(portConfig.Published))
+	}
+
+	return data.GetDB().SetConfig(config)
+}
+
+// UnpublishPorts removes the proxy routes of the service, and the port links
+// no other service uses anymore
+func UnpublishPorts(srv *models.Service) error {
+	if len(srv.Ports) == 0 {
+		return nil
+	}
+
+	portsMu.Lock()
+	defer portsMu.Unlock()
+
+	if err := control.RemoveFromProxy(srv.ServiceName, srv.StackName); err != nil {
+		return err
+	}
+
+	used := make(map[int]bool)
+	for _, other := range data.GetDB().GetServices() {
+		if other.Identifier() == srv.Identifier() || other.Stopped {
+			continue
+		}
+		for _, portConfig := range other.Ports {
+			used[int(portConfig.Published)] = true
+		}
+	}
+
+	config := data.GetDB().GetConfig()
+	proxyIP := control.ProxyIP()
+
+	for _, portConfig := range srv.Ports {
+		port := int(portConfig.Published)
+		if used[port] || !isBound(config.PortsBinding, port) {
+			continue
+		}
+		if err := iptables.RemoveLinkPort(proxyIP, port, int(portConfig.Target)); err != nil {
+			return err
+		}
+		bindings := make([]int, 0, len(config.PortsBinding))
+		for _, bound := range config.PortsBinding {
+			if bound != port {
+				bindings = append(bindings, bound)
+			}
+		}
+		config.PortsBinding = bindings
+	}
+
+	return data.GetDB().SetConfig(config)
+}
+
+func isBound(bindings []int, port int) bool {
+	for _, bound := range bindings {
+		if bound == port {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,150 @@
+package deploy
+
+import (
+	"fmt"
+	"kinetik-server/data"
+	"kinetik-server/docker"
+	"kinetik-server/jobs"
+	"kinetik-server/models"
+	"time"
+)
+
+// NodeDrain moves every instance off a cordoned node. Each instance is
+// replaced by a new one on another node, which takes its place in DNS before
+// the old container is stopped.
+type NodeDrain struct {
+	NodeIP string
+}
+
+func (d *NodeDrain) Run(t *jobs.Tracker) error {
+	failed := 0
+	for _, srv := range data.GetDB().GetServices() {
+		failed += drainService(t, srv.Identifier(), d.NodeIP)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d instances could not be moved off %s", failed, d.NodeIP)
+	}
+	return nil
+}
+
+// drainService migrates the instances of the service running on the node and
+// returns how many could not be migrated
+func drainService(t *jobs.Tracker, identifier string, nodeIP string) int {
+	unlock := LockService(identifier)
+	defer unlock()
+
+	srv := data.GetDB().GetService(identifier)
+	if srv == nil {
+		return 0
+	}
+
+	toMove := make([]int, 0)
+	for i, inst := range srv.Instances {
+		if inst.NodeID == nodeIP {
+			toMove = append(toMove, i)
+		}
+	}
+	if len(toMove) == 0 {
+		return 0
+	}
+
+	t.Logf("Moving %d instances of %s", len(toMove), identifier)
+	t.Update(func(job *models.Job) {
+		progress := job.Service(identifier)
+		progress.State = models.JobRunning
+		for _, i := range toMove {
+			replica := progress.Replica(i)
+			replica.ContainerID = srv.Instances[i].ContainerID
+			replica.NodeID = nodeIP
+		}
+	})
+
+	failed := 0
+	for _, i := range toMove {
+		if err := migrateInstance(t, srv, i, nil); err != nil {
+			failed++
+		}
+	}
+
+	t.Update(func(job *models.Job) {
+		if failed > 0 {
+			job.Service(identifier).State = models.JobFailed
+		} else {
+			job.Service(identifier).State = models.JobSucceeded
+		}
+	})
+
+	return failed
+}
+
+// migrateInstance replaces the i-th instance of the service, which must be
+// locked, by a new one on one of the nodes, any if nil. The old instance keeps
+// running when the new one cannot start or is not healthy.
+func migrateInstance(t *jobs.Tracker, srv *models.Service, i int, nodes []string) error {
+	old := srv.Instances[i]
+	identifier := srv.Identifier()
+
+	fail := func(err error) error {
+		t.Logf("Cannot move container %s of %s : %s", old.ContainerID, identifier, err.Error())
+		t.Update(func(job *models.Job) {
+			replica := job.Service(identifier).Replica(i)
+			replica.State = models.ReplicaFailed
+			replica.Error = err.Error()
+		})
+		return err
+	}
+
+	var inst *models.Instance
+	var err error
+	if nodes == nil {
+		inst, err = StartInstance(srv)
+	} else {
+		inst, err = StartInstanceOn(srv, nodes)
+	}
+	if err != nil {
+		return fail(err)
+	}
+
+	monitor := 5 * time.Second
+	if srv.UpdateConfig != nil && srv.UpdateConfig.Monitor > 0 {
+		monitor = time.Duration(srv.UpdateConfig.Monitor)
+	}
+	client, err := docker.GetRemoteClient(inst.NodeID)
+	if err == nil {
+		err = docker.WaitHealthy(client, inst.ContainerID, monitor)
+		if err != nil {
+			docker.StopAndRemoveContainer(client, inst.ContainerID)
+		}
+		client.Close()
+	}
+	if err != nil {
+		ReleaseClaims([]*models.Instance{inst})
+		return fail(err)
+	}
+
+	if err := RegisterInstances(srv, []*models.Instance{inst}); err != nil {
+		StopInstance(srv, inst)
+		return fail(err)
+	}
+
+	srv.Instances[i] = inst
+	if err := data.GetDB().AddService(srv); err != nil {
+		t.Logf("Cannot save %s : %s", identifier, err.Error())
+	}
+	ReleaseClaims([]*models.Instance{inst})
+
+	if err := StopInstance(srv, old); err != nil {
+		t.Logf("Cannot remove container %s of %s : %s", old.ContainerID, identifier, err.Error())
+	}
+
+	t.Logf("Moved container %s of %s to %s as %s", old.ContainerID, identifier, inst.NodeID, inst.ContainerID)
+	t.Update(func(job *models.Job) {
+		replica := job.Service(identifier).Replica(i)
+		replica.State = models.ReplicaMigrated
+		replica.ReplacedBy = inst.ContainerID
+		replica.MovedTo = inst.NodeID
+	})
+
+	return nil
+}
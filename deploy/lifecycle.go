@@ -0,0 +1,128 @@
+package deploy
+
+import (
+	"errors"
+	"kinetik-server/data"
+	"kinetik-server/jobs"
+	"kinetik-server/models"
+)
+
+// stackServices returns the stored services of the stack, ordered so that
+// every service comes after its dependencies
+func stackServices(stackName string) ([]*models.Service, error) {
+	byName := GetStackServices(stackName)
+	if len(byName) == 0 {
+		return nil, errors.New("Stack " + stackName + " does not exist")
+	}
+
+	services := make([]*models.Service, 0, len(byName))
+	for _, srv := range byName {
+		services = append(services, srv)
+	}
+	return OrderServices(services)
+}
+
+// StackDeletion removes every service of a stack, dependents first
+type StackDeletion struct {
+	StackName string
+}
+
+func (d *StackDeletion) Run(t *jobs.Tracker) error {
+	services, err := stackServices(d.StackName)
+	if err != nil {
+		return err
+	}
+
+	if err := RemoveServices(t, services, models.JobSucceeded); err != nil {
+		return err
+	}
+	return data.GetDB().DeleteStackPolicy(d.StackName)
+}
+
+// StackStop removes the containers of a stack, dependents first, but keeps
+// its services so that it can be started again
+type StackStop struct {
+	StackName string
+}
+
+func (s *StackStop) Run(t *jobs.Tracker) error {
+	services, err := stackServices(s.StackName)
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	for i := len(services) - 1; i >= 0; i-- {
+		if err := setStopped(t, services[i], true); err != nil {
+			t.Logf("Cannot stop %s : %s", services[i].ServiceName, err.Error())
+			lastErr = err
+		}
+	}
+
+	return lastErr
+}
+
+// StackStart starts the replicas of a stopped stack again, dependencies first
+type StackStart struct {
+	StackName string
+}
+
+func (s *StackStart) Run(t *jobs.Tracker) error {
+	services, err := stackServices(s.StackName)
+	if err != nil {
+		return err
+	}
+
+	for _, srv := range services {
+		if err := setStopped(t, srv, false); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func setStopped(t *jobs.Tracker, srv *models.Service, stopped bool) error {
+	unlock := LockService(srv.Identifier())
+	defer unlock()
+
+	srv = data.GetDB().GetService(srv.Identifier())
+	if srv == nil {
+		return nil
+	}
+
+	if stopped {
+		t.Logf("Stopping service %s", srv.ServiceName)
+	} else {
+		t.Logf("Starting service %s with %d replicas", srv.ServiceName, srv.Replicas)
+	}
+	t.Update(func(job *models.Job) {
+		job.Service(srv.ServiceName).State = models.JobRunning
+	})
+
+	srv.Stopped = stopped
+	if err := scaleTo(t, srv); err != nil {
+		t.Update(func(job *models.Job) {
+			job.Service(srv.ServiceName).State = models.JobFailed
+		})
+		return err
+	}
+
+	var err error
+	if stopped {
+		err = UnpublishPorts(srv)
+	} else {
+		err = PublishPorts(srv)
+	}
+	if err != nil {
+		t.Update(func(job *models.Job) {
+			job.Service(srv.ServiceName).State = models.JobFailed
+		})
+		return errors.New("Cannot update ports of service " + srv.ServiceName + " : " + err.Error())
+	}
+
+	t.Update(func(job *models.Job) {
+		job.Service(srv.ServiceName).State = models.JobSucceeded
+	})
+	return nil
+}
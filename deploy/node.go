@@ -0,0 +1,100 @@
+package deploy
+
+import (
+	"errors"
+	"kinetik-server/control"
+	"kinetik-server/data"
+	"kinetik-server/jobs"
+	"kinetik-server/models"
+	"kinetik-server/provider"
+)
+
+// NodeDeletion empties a cordoned node, destroys its machine and removes its
+// record, reservations included, and its inventory entry. Its certificate is
+// revoked. Nodes whose
+// provisioning failed may have no IP, and nodes which joined by themselves
+// no entry.
+type NodeDeletion struct {
+	NodeIP string
+	Name   string // Name of the inventory entry
+	Force  bool   // Drop the instances that cannot be moved
+}
+
+func (d *NodeDeletion) Run(t *jobs.Tracker) error {
+	if d.NodeIP != "" {
+		drain := &NodeDrain{NodeIP: d.NodeIP}
+		if err := drain.Run(t); err != nil {
+			if !d.Force {
+				return err
+			}
+			t.Logf("%s, dropping them", err.Error())
+			for _, srv := range data.GetDB().GetServices() {
+				dropNodeInstances(t, srv.Identifier(), d.NodeIP)
+			}
+		}
+	}
+
+	var entry *models.NodeEntry
+	if d.Name != "" {
+		entry = data.GetDB().GetNodeEntry(d.Name)
+	}
+
+	if entry == nil || entry.MachineID == "" {
+		t.Logf("Node %s was not created by kinetik, its machine is left running", d.NodeIP)
+	} else {
+		p := provider.GetProvider()
+		if entry.Provider != "" && entry.Provider != p.Name() {
+			return errors.New("Machine " + entry.MachineID + " belongs to provider " + entry.Provider + ", not " + p.Name())
+		}
+		t.Logf("Destroying machine %s", entry.MachineID)
+		if err := p.DestroyMachine(entry.MachineID); err != nil {
+			return errors.New("Cannot destroy machine " + entry.MachineID + " : " + err.Error())
+		}
+	}
+
+	if d.NodeIP != "" {
+		t.Logf("Removing node %s", d.NodeIP)
+		if err := data.GetDB().DeleteNode(d.NodeIP); err != nil {
+			return err
+		}
+	}
+	if entry != nil {
+		if err := control.RevokeNodeCert(entry); err != nil {
+			t.Logf("Cannot revoke certificate of %s : %s", entry.Name, err.Error())
+		}
+		return data.GetDB().DeleteNodeEntry(entry.Name)
+	}
+	return nil
+}
+
+// dropNodeInstances removes the instances of the service running on the node
+// from DNS and from the service, leaving their containers to die with the
+// machine. The reconciler starts their replacements.
+func dropNodeInstances(t *jobs.Tracker, identifier string, nodeIP string) {
+	unlock := LockService(identifier)
+	defer unlock()
+
+	srv := data.GetDB().GetService(identifier)
+	if srv == nil {
+		return
+	}
+
+	kept := make([]*models.Instance, 0, len(srv.Instances))
+	for _, inst := range srv.Instances {
+		if inst.NodeID != nodeIP {
+			kept = append(kept, inst)
+			continue
+		}
+		t.Logf("Dropping container %s of %s", inst.ContainerID, identifier)
+		ForgetInstance(srv, inst)
+	}
+
+	if len(kept) == len(srv.Instances) {
+		return
+	}
+
+	srv.Instances = kept
+	if err := data.GetDB().AddService(srv); err != nil {
+		t.Logf("Cannot save %s : %s", identifier, err.Error())
+	}
+}
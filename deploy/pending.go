@@ -0,0 +1,78 @@
+package deploy
+
+import (
+	"kinetik-server/models"
+	"sort"
+	"sync"
+	"time"
+)
+
+var pendingMu sync.Mutex
+var pending = make(map[string]*models.PendingReplicas) // By service identifier
+
+// UnschedulableError reports that no node has room for a new instance
+type UnschedulableError struct {
+	Identifier string
+}
+
+func (e *UnschedulableError) Error() string {
+	return "No node can host " + e.Identifier
+}
+
+func IsUnschedulable(err error) bool {
+	_, ok := err.(*UnschedulableError)
+	return ok
+}
+
+// SetPending records that count replicas of the service wait for a node. The
+// queue is rebuilt by the reconciler after a restart.
+func SetPending(srv *models.Service, count int) {
+	pendingMu.Lock()
+	defer pendingMu.Unlock()
+
+	if count <= 0 {
+		delete(pending, srv.Identifier())
+		return
+	}
+
+	if queued, ok := pending[srv.Identifier()]; ok {
+		queued.Count = count
+		queued.Resources = srv.Constraints
+		return
+	}
+
+	pending[srv.Identifier()] = &models.PendingReplicas{
+		Service:   srv.Identifier(),
+		Count:     count,
+		Resources: srv.Constraints,
+		Since:     time.Now(),
+	}
+}
+
+func ClearPending(identifier string) {
+	pendingMu.Lock()
+	defer pendingMu.Unlock()
+
+	delete(pending, identifier)
+}
+
+// PendingReplicas returns the queued replicas, those waiting the longest
+// first
+func PendingReplicas() []*models.PendingReplicas {
+	pendingMu.Lock()
+	defer pendingMu.Unlock()
+
+	queued := make([]*models.PendingReplicas, 0, len(pending))
+	for _, replicas := range pending {
+		copied := *replicas
+		queued = append(queued, &copied)
+	}
+	sort.Slice(queued, func(i, j int) bool {
+		if queued[i].Since.Equal(queued[j].Since) {
+			return queued[i].Service < queued[j].Service
+		}
+		return queued[i].Since.Before(queued[j].Since)
+	})
+
+	return queued
+}
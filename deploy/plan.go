@@ -0,0 +1,126 @@
+package deploy
+
+import (
+	"kinetik-server/compose"
+	"kinetik-server/control"
+	"kinetik-server/data"
+	"kinetik-server/iptables"
+	"kinetik-server/models"
+	"kinetik-server/scheduler"
+	"sort"
+)
+
+// PlanStack computes what deploying the compose file on the stack would do,
+// without touching Docker, DNS, the proxy or iptables
+func PlanStack(stackName, composeContent string) (*models.DeployPlan, error) {
+	services, err := BuildStack(stackName, composeContent)
+	if err != nil {
+		return nil, err
+	}
+
+	// BuildStack already validated the file
+	config, _ := compose.LoadYAMLWithEnv([]byte(composeContent), nil)
+	ignored := make(map[string][]string)
+	for _, srv := range config.Services {
+		ignored[srv.Name] = compose.IgnoredKeys(&srv, deployLabels)
+	}
+
+	stored := GetStackServices(stackName)
+	bindings := data.GetDB().GetConfig().PortsBinding
+	proxyIP := control.ProxyIP()
+
+	plan := &models.DeployPlan{
+		StackName: stackName,
+		Order:     make([]string, 0, len(services)),
+		Services:  make([]*models.ServicePlan, 0, len(services)),
+	}
+
+	// Every replica to start, in deployment order, so that the scheduler sees
+	// the earlier ones when placing the next
+	replicas := make([]*scheduler.Request, 0)
+	owners := make([]*models.ServicePlan, 0)
+
+	wanted := make(map[string]bool)
+	for _, next := range services {
+		wanted[next.ServiceName] = true
+		plan.Order = append(plan.Order, next.ServiceName)
+
+		srvPlan := &models.ServicePlan{
+			ServiceName: next.ServiceName,
+			Replicas:    next.Replicas,
+			Placements:  make([]string, 0),
+			Ports:       make([]*models.PortPlan, 0),
+			IgnoredKeys: ignored[next.ServiceName],
+		}
+		plan.Services = append(plan.Services, srvPlan)
+
+		toStart := next.Replicas
+		current, ok := stored[next.ServiceName]
+		switch {
+		case !ok:
+			srvPlan.Action = models.PlanCreate
+		case SpecChanged(current, next):
+			srvPlan.Action = models.PlanUpdate
+			srvPlan.CurrentReplicas = uint64(len(current.Instances))
+		case current.Replicas != next.Replicas:
+			srvPlan.Action = models.PlanScale
+			srvPlan.CurrentReplicas = uint64(len(current.Instances))
+			toStart = 0
+			if next.Replicas > srvPlan.CurrentReplicas {
+				toStart = next.Replicas - srvPlan.CurrentReplicas
+			}
+		default:
+			srvPlan.Action = models.PlanUnchanged
+			srvPlan.CurrentReplicas = uint64(len(current.Instances))
+			toStart = 0
+		}
+
+		for i := uint64(0); i < toStart; i++ {
+			replicas = append(replicas, scheduler.NewRequest(next))
+			owners = append(owners, srvPlan)
+		}
+
+		if srvPlan.Action == models.PlanUnchanged {
+			continue
+		}
+		for _, portConfig := range next.Ports {
+			portPlan := &models.PortPlan{
+				Published:     portConfig.Published,
+				Target:        portConfig.Target,
+				AlreadyLinked: isBound(bindings, int(portConfig.Published)),
+			}
+			if !portPlan.AlreadyLinked {
+				portPlan.Rules = iptables.LinkPortRules(proxyIP, int(portConfig.Published), int(portConfig.Target))
+			}
+			srvPlan.Ports = append(srvPlan.Ports, portPlan)
+		}
+	}
+
+	for i, nodeIP := range scheduler.GetScheduler().DryRun(replicas) {
+		if nodeIP == "" {
+			owners[i].Unschedulable++
+			continue
+		}
+		owners[i].Placements = append(owners[i].Placements, nodeIP)
+	}
+
+	removed := make([]string, 0)
+	for name := range stored {
+		if !wanted[name] {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(removed)
+	for _, name := range removed {
+		plan.Services = append(plan.Services, &models.ServicePlan{
+			ServiceName:     name,
+			Action:          models.PlanRemove,
+			CurrentReplicas: uint64(len(stored[name].Instances)),
+			Placements:      make([]string, 0),
+			Ports:           make([]*models.PortPlan, 0),
+			IgnoredKeys:     make([]string, 0),
+		})
+	}
+
+	return plan, nil
+}
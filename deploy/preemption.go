@@ -0,0 +1,126 @@
+package deploy
+
+import (
+	"kinetik-server/data"
+	"kinetik-server/logger"
+	"kinetik-server/models"
+	"kinetik-server/scheduler"
+)
+
+// preempt evicts instances of services of lower priority to make room for a
+// replica of the service, and returns the decision placing it, nil if no
+// eviction helps. The victims are chosen then the replica is placed as if they
+// were gone, and they are evicted only once the placement is confirmed. The
+// evicted replicas are queued until a node has room for them again.
+// Locks are only taken on services of strictly lower priority, so that two
+// preemptions never wait for each other.
+func preempt(srv *models.Service) *models.PlacementDecision {
+	policies := make(map[string]*models.StackPolicy)
+	victims := make([]*scheduler.Victim, 0)
+	for _, other := range data.GetDB().GetServices() {
+		if other.Priority >= srv.Priority || other.Constraints == nil {
+			continue
+		}
+		policy, ok := policies[other.StackName]
+		if !ok {
+			policy = data.GetDB().GetStackPolicy(other.StackName)
+			policies[other.StackName] = policy
+		}
+		if !policy.Preemptible {
+			continue
+		}
+		for _, inst := range other.Instances {
+			victims = append(victims, &scheduler.Victim{
+				Service:     other.Identifier(),
+				ContainerID: inst.ContainerID,
+				NodeIP:      inst.NodeID,
+				Priority:    other.Priority,
+				Resources:   other.Constraints,
+			})
+		}
+	}
+	if len(victims) == 0 {
+		return nil
+	}
+
+	nodeIP, evict := scheduler.Preempt(scheduler.NewRequest(srv), victims)
+	if nodeIP == "" {
+		return nil
+	}
+
+	req := scheduler.NewRequest(srv)
+	req.Nodes = []string{nodeIP}
+	req.Evicted = evict
+	decision, err := scheduler.GetScheduler().Select(req)
+	if err != nil || decision.NodeIP == "" {
+		if decision != nil && decision.Release != nil {
+			decision.Release()
+		}
+		return nil
+	}
+
+	byService := make(map[string]map[string]bool)
+	order := make([]string, 0)
+	for _, victim := range evict {
+		if _, ok := byService[victim.Service]; !ok {
+			byService[victim.Service] = make(map[string]bool)
+			order = append(order, victim.Service)
+		}
+		byService[victim.Service][victim.ContainerID] = true
+	}
+
+	evicted := make([]string, 0, len(evict))
+	for _, identifier := range order {
+		evicted = append(evicted, evictInstances(identifier, byService[identifier], srv.Identifier())...)
+	}
+	if len(evicted) < len(evict) {
+		// The node would be overcommitted
+		logger.ErrLog.Printf("Cannot preempt enough containers on %s for %s\n", nodeIP, srv.Identifier())
+		if decision.Release != nil {
+			decision.Release()
+		}
+		return nil
+	}
+
+	decision.Preempted = evicted
+	return decision
+}
+
+// evictInstances stops the containers of the service and queues their
+// replicas
+func evictInstances(identifier string, containers map[string]bool, by string) []string {
+	unlock := LockService(identifier)
+	defer unlock()
+
+	srv := data.GetDB().GetService(identifier)
+	if srv == nil {
+		return nil
+	}
+
+	evicted := make([]string, 0, len(containers))
+	kept := make([]*models.Instance, 0, len(srv.Instances))
+	for _, inst := range srv.Instances {
+		if !containers[inst.ContainerID] {
+			kept = append(kept, inst)
+			continue
+		}
+		logger.StdLog.Printf("Preempting container %s of %s on %s for %s\n", inst.ContainerID, identifier, inst.NodeID, by)
+		if err := StopInstance(srv, inst); err != nil {
+			logger.ErrLog.Printf("Cannot stop preempted container %s : %s\n", inst.ContainerID, err.Error())
+			kept = append(kept, inst)
+			continue
+		}
+		evicted = append(evicted, inst.ContainerID)
+	}
+
+	if len(evicted) == 0 {
+		return nil
+	}
+
+	srv.Instances = kept
+	if err := data.GetDB().AddService(srv); err != nil {
+		logger.ErrLog.Printf("Cannot save %s : %s\n", identifier, err.Error())
+	}
+	SetPending(srv, int(srv.DesiredReplicas())-len(srv.Instances))
+	return evicted
+}
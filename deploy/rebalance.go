@@ -0,0 +1,88 @@
+package deploy
+
+import (
+	"fmt"
+	"kinetik-server/data"
+	"kinetik-server/jobs"
+	"kinetik-server/models"
+)
+
+// DisruptionBudgetLabel is the deploy label giving how many instances of the
+// service the rebalancer may move per pass. 0 keeps them where they are.
+const DisruptionBudgetLabel = "be.mikrodock.disruption-budget"
+
+// Rebalance migrates instances to the nodes chosen by the rebalancer. Each
+// instance is replaced by a new one, which takes its place in DNS before the
+// old container is stopped.
+type Rebalance struct {
+	Moves []*models.RebalanceMove
+}
+
+func (r *Rebalance) Run(t *jobs.Tracker) error {
+	byService := make(map[string][]*models.RebalanceMove)
+	order := make([]string, 0)
+	for _, move := range r.Moves {
+		if _, ok := byService[move.Service]; !ok {
+			order = append(order, move.Service)
+		}
+		byService[move.Service] = append(byService[move.Service], move)
+	}
+
+	failed := 0
+	for _, identifier := range order {
+		failed += rebalanceService(t, identifier, byService[identifier])
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d instances could not be moved", failed)
+	}
+	return nil
+}
+
+// rebalanceService applies the moves of the service and returns how many
+// failed. Instances which moved or stopped meanwhile are skipped.
+func rebalanceService(t *jobs.Tracker, identifier string, moves []*models.RebalanceMove) int {
+	unlock := LockService(identifier)
+	defer unlock()
+
+	srv := data.GetDB().GetService(identifier)
+	if srv == nil {
+		return 0
+	}
+
+	t.Update(func(job *models.Job) {
+		job.Service(identifier).State = models.JobRunning
+	})
+
+	failed := 0
+	for _, move := range moves {
+		i := -1
+		for j, inst := range srv.Instances {
+			if inst.ContainerID == move.ContainerID && inst.NodeID == move.From {
+				i = j
+			}
+		}
+		if i < 0 {
+			t.Logf("Container %s of %s is not on %s anymore", move.ContainerID, identifier, move.From)
+			continue
+		}
+
+		t.Update(func(job *models.Job) {
+			replica := job.Service(identifier).Replica(i)
+			replica.ContainerID = move.ContainerID
+			replica.NodeID = move.From
+		})
+		if err := migrateInstance(t, srv, i, []string{move.To}); err != nil {
+			failed++
+		}
+	}
+
+	t.Update(func(job *models.Job) {
+		if failed > 0 {
+			job.Service(identifier).State = models.JobFailed
+		} else {
+			job.Service(identifier).State = models.JobSucceeded
+		}
+	})
+	return failed
+}
@@ -0,0 +1,77 @@
+package deploy
+
+import (
+	"errors"
+	"kinetik-server/data"
+	"kinetik-server/logger"
+	"kinetik-server/models"
+	"math/rand"
+)
+
+// ScaleUp starts one more instance of the service, which must be locked, and
+// raises its replica count. When no node has room for it, the replica is
+// queued and no instance is returned.
+func ScaleUp(srv *models.Service) (*models.Instance, error) {
+	inst, err := StartInstance(srv)
+	if IsUnschedulable(err) {
+		srv.Replicas++
+		SetPending(srv, int(srv.DesiredReplicas())-len(srv.Instances))
+		if err := data.GetDB().AddService(srv); err != nil {
+			return nil, errors.New("Cannot save service " + srv.ServiceName + " : " + err.Error())
+		}
+		logger.StdLog.Printf("Scaling up %s : no node has room, replica queued\n", srv.Identifier())
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.New("Cannot run service " + srv.ServiceName + " : " + err.Error())
+	}
+
+	srv.AddInstance(inst)
+	srv.Replicas++
+	if err := data.GetDB().AddService(srv); err != nil {
+		return inst, errors.New("Cannot save service " + srv.ServiceName + " : " + err.Error())
+	}
+	ReleaseClaims([]*models.Instance{inst})
+
+	if err := RegisterInstances(srv, []*models.Instance{inst}); err != nil {
+		return inst, errors.New("Cannot register service " + srv.ServiceName + " in DNS : " + err.Error())
+	}
+
+	if err := PublishPorts(srv); err != nil {
+		return inst, errors.New("Cannot publish ports of service " + srv.ServiceName + " : " + err.Error())
+	}
+
+	return inst, nil
+}
+
+// ScaleDown stops a random instance of the service, which must be locked, and
+// lowers its replica count
+func ScaleDown(srv *models.Service) (*models.Instance, error) {
+	if len(srv.Instances) == 0 {
+		return nil, errors.New("Service " + srv.Identifier() + " has no instance")
+	}
+
+	idx := rand.Intn(len(srv.Instances))
+	inst := srv.Instances[idx]
+
+	logger.StdLog.Printf("Scaling down %s : Container %s down with IP %s\n", srv.Identifier(), inst.NodeID, inst.IP)
+
+	return inst, RemoveInstance(srv, idx)
+}
+
+// RemoveInstance stops the idx-th instance of the service, which must be
+// locked, and lowers its replica count so that it is not replaced
+func RemoveInstance(srv *models.Service, idx int) error {
+	inst := srv.Instances[idx]
+
+	if err := StopInstance(srv, inst); err != nil {
+		return errors.New("Cannot stop container " + inst.ContainerID + " : " + err.Error())
+	}
+
+	srv.Instances = append(srv.Instances[:idx], srv.Instances[idx+1:]...)
+	if srv.Replicas > 0 {
+		srv.Replicas--
+	}
+
+	return data.GetDB().AddService(srv)
+}
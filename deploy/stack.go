@@ -0,0 +1,334 @@
+package deploy
+
+import (
+	"errors"
+	"fmt"
+	"kinetik-server/compose"
+	"kinetik-server/data"
+	"kinetik-server/jobs"
+	"kinetik-server/models"
+	"kinetik-server/scheduler"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types/network"
+)
+
+// Deploy labels read by BuildStack and by the conversion of the services
+var deployLabels = map[string]bool{
+	scheduler.StrategyLabel:     true,
+	scheduler.AntiAffinityLabel: true,
+	scheduler.AffinityLabel:     true,
+	scheduler.PriorityLabel:     true,
+	DisruptionBudgetLabel:       true,
+	compose.PidsLimitLabel:      true,
+}
+
+// BuildStack converts a compose file into the services of the stack, ordered
+// so that every service comes after its dependencies
+func BuildStack(stackName, composeContent string) ([]*models.Service, error) {
+	config, err := compose.LoadYAMLWithEnv([]byte(composeContent), nil)
+	if err != nil {
+		return nil, errors.New("Cannot decode YAML : " + err.Error())
+	}
+
+	services := make([]*models.Service, 0, len(config.Services))
+
+	for _, srv := range config.Services {
+
+		contConfig, err := compose.ConvertServiceToContainer(&srv)
+		if err != nil {
+			return nil, errors.New("Cannot convert service " + srv.Name + " : " + err.Error())
+		}
+		contConfig.HostConfig.DNS = []string{data.GetDB().GetConfig().DNSIP}
+		labels := make(map[string]string)
+		labels["be.mikrodock.stack"] = stackName
+		labels["be.mikrodock.service"] = srv.Name
+		contConfig.Config.Labels = labels
+		contConfig.HostConfig.DNSSearch = []string{stackName + ".mikrodock"}
+
+		endsConfig := make(map[string]*network.EndpointSettings)
+		endsConfig["mikroverlay"] = &network.EndpointSettings{
+			IPAMConfig: nil,
+			Links:      nil,
+		}
+		contConfig.NetworkingConfig = &network.NetworkingConfig{
+			EndpointsConfig: endsConfig,
+		}
+
+		serviceModel := models.NewService(stackName, srv.Name, contConfig)
+		serviceModel.Constraints = srv.Deploy.Resources.Reservations
+		// ConvertServiceToContainer already validated the limits
+		pids, _ := compose.PidsLimit(&srv)
+		if limits := srv.Deploy.Resources.Limits; limits != nil || pids > 0 {
+			serviceModel.Limits = &models.ResourceLimits{Pids: pids}
+			if limits != nil {
+				serviceModel.Limits.NanoCPUs = limits.NanoCPUs
+				serviceModel.Limits.MemoryBytes = int64(limits.MemoryBytes)
+			}
+		}
+		serviceModel.Ports = srv.Ports
+		serviceModel.UpdateConfig = srv.Deploy.UpdateConfig
+		serviceModel.DependsOn = srv.DependsOn
+		serviceModel.Strategy = srv.Deploy.Labels[scheduler.StrategyLabel]
+		if err := scheduler.ValidateStrategy(serviceModel.Strategy); err != nil {
+			return nil, errors.New("Invalid service " + srv.Name + " : " + err.Error())
+		}
+		if len(srv.Deploy.Placement.Constraints) > 0 || len(srv.Deploy.Placement.Preferences) > 0 {
+			placement := srv.Deploy.Placement
+			if err := scheduler.ValidatePlacement(&placement); err != nil {
+				return nil, errors.New("Invalid service " + srv.Name + " : " + err.Error())
+			}
+			serviceModel.Placement = &placement
+		}
+		serviceModel.AntiAffinity = srv.Deploy.Labels[scheduler.AntiAffinityLabel]
+		if err := scheduler.ValidateAntiAffinity(serviceModel.AntiAffinity); err != nil {
+			return nil, errors.New("Invalid service " + srv.Name + " : " + err.Error())
+		}
+		if affinity := srv.Deploy.Labels[scheduler.AffinityLabel]; affinity != "" {
+			for _, name := range strings.Split(affinity, ",") {
+				serviceModel.Affinity = append(serviceModel.Affinity, strings.TrimSpace(name))
+			}
+		}
+
+		if priority := srv.Deploy.Labels[scheduler.PriorityLabel]; priority != "" {
+			value, err := strconv.Atoi(priority)
+			if err != nil {
+				return nil, errors.New("Invalid service " + srv.Name + " : invalid priority " + priority)
+			}
+			serviceModel.Priority = value
+		}
+		if budget := srv.Deploy.Labels[DisruptionBudgetLabel]; budget != "" {
+			value, err := strconv.Atoi(budget)
+			if err != nil || value < 0 {
+				return nil, errors.New("Invalid service " + srv.Name + " : invalid disruption budget " + budget)
+			}
+			serviceModel.DisruptionBudget = &value
+		}
+
+		if srv.Deploy.Replicas == nil {
+			serviceModel.Replicas = 1
+		} else {
+			serviceModel.Replicas = *srv.Deploy.Replicas
+		}
+
+		services = append(services, serviceModel)
+	}
+
+	return OrderServices(services)
+}
+
+// OrderServices sorts the services of a stack so that every service comes
+// after its dependencies and the services it has an affinity with
+func OrderServices(services []*models.Service) ([]*models.Service, error) {
+	byName := make(map[string]*models.Service, len(services))
+	for _, srv := range services {
+		byName[srv.ServiceName] = srv
+	}
+
+	workGraph := make(models.Graph, 0, len(services))
+	for _, srv := range services {
+		deps := make([]string, 0, len(srv.DependsOn)+len(srv.Affinity))
+		for _, dep := range srv.DependsOn {
+			if _, ok := byName[dep]; !ok {
+				return nil, errors.New("Unknown dependency " + dep + " of " + srv.ServiceName)
+			}
+			deps = append(deps, dep)
+		}
+		for _, other := range srv.Affinity {
+			if _, ok := byName[other]; !ok || other == srv.ServiceName {
+				return nil, errors.New("Invalid affinity of " + srv.ServiceName + " : " + other + " is not another service of the stack")
+			}
+			deps = append(deps, other)
+		}
+		workGraph = append(workGraph, models.NewDepNode(srv.ServiceName, deps...))
+	}
+
+	depGraph, err := workGraph.Resolve()
+	if err != nil {
+		return nil, errors.New("Cannot resolve dependencies : " + err.Error())
+	}
+
+	ordered := make([]*models.Service, 0, len(depGraph))
+	for _, node := range depGraph {
+		ordered = append(ordered, byName[node.Name])
+	}
+
+	return ordered, nil
+}
+
+// StackCreation starts every replica of the services of a new stack, in
+// order. Rollback only undoes what Run did.
+type StackCreation struct {
+	Services []*models.Service
+	touched  []*models.Service
+}
+
+func (c *StackCreation) Run(t *jobs.Tracker) error {
+	for _, srv := range c.Services {
+		if data.GetDB().GetService(srv.Identifier()) != nil {
+			return errors.New("Service " + srv.Identifier() + " already exists")
+		}
+	}
+
+	for _, srv := range c.Services {
+		c.touched = append(c.touched, srv)
+		if err := createService(t, srv); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *StackCreation) Rollback(t *jobs.Tracker) error {
+	return RemoveServices(t, c.touched, models.JobRolledBack)
+}
+
+// GetStackServices returns the stored services of the stack, by name
+func GetStackServices(stackName string) map[string]*models.Service {
+	services := make(map[string]*models.Service)
+	for _, srv := range data.GetDB().GetServices() {
+		if srv.StackName == stackName {
+			services[srv.ServiceName] = srv
+		}
+	}
+	return services
+}
+
+func createService(t *jobs.Tracker, srv *models.Service) error {
+	unlock := LockService(srv.Identifier())
+	defer unlock()
+
+	if err := data.GetDB().AddRevision(srv); err != nil {
+		return errors.New("Cannot save revision of " + srv.ServiceName + " : " + err.Error())
+	}
+
+	t.Logf("Creating service %s with %d replicas", srv.ServiceName, srv.Replicas)
+	t.Update(func(job *models.Job) {
+		progress := job.Service(srv.ServiceName)
+		progress.State = models.JobRunning
+		for i := 0; i < int(srv.Replicas); i++ {
+			progress.Replica(i)
+		}
+	})
+
+	for i := 0; i < int(srv.Replicas); i++ {
+		inst, err := StartInstance(srv)
+		if IsUnschedulable(err) {
+			queueReplicas(t, srv, i)
+			break
+		}
+		if err != nil {
+			t.Update(func(job *models.Job) {
+				job.Service(srv.ServiceName).State = models.JobFailed
+				replica := job.Service(srv.ServiceName).Replica(i)
+				replica.State = models.ReplicaFailed
+				replica.Error = err.Error()
+			})
+			return fmt.Errorf("Cannot run replica %d of %s : %s", i, srv.ServiceName, err.Error())
+		}
+		srv.AddInstance(inst)
+
+		t.Logf("Replica %d of %s running as %s on %s", i, srv.ServiceName, inst.ContainerID, inst.NodeID)
+		t.Update(func(job *models.Job) {
+			replica := job.Service(srv.ServiceName).Replica(i)
+			replica.State = models.ReplicaRunning
+			replica.ContainerID = inst.ContainerID
+			replica.NodeID = inst.NodeID
+		})
+	}
+
+	if err := data.GetDB().AddService(srv); err != nil {
+		return errors.New("Cannot save service " + srv.ServiceName + " : " + err.Error())
+	}
+	ReleaseClaims(srv.Instances)
+
+	if err := RegisterInstances(srv, srv.Instances); err != nil {
+		return errors.New("Cannot register service " + srv.ServiceName + " in DNS : " + err.Error())
+	}
+
+	if err := PublishPorts(srv); err != nil {
+		return errors.New("Cannot publish ports of service " + srv.ServiceName + " : " + err.Error())
+	}
+
+	t.Update(func(job *models.Job) {
+		job.Service(srv.ServiceName).State = models.JobSucceeded
+	})
+
+	return nil
+}
+
+// queueReplicas leaves the replicas of the service from the first one for the
+// reconciler to start once a node has room for them
+func queueReplicas(t *jobs.Tracker, srv *models.Service, first int) {
+	missing := int(srv.DesiredReplicas()) - first
+	t.Logf("No node can host %s, %d replicas are queued", srv.ServiceName, missing)
+	t.Update(func(job *models.Job) {
+		for i := first; i < first+missing; i++ {
+			job.Service(srv.ServiceName).Replica(i).State = models.ReplicaQueued
+		}
+	})
+	SetPending(srv, missing)
+}
+
+// RemoveServices removes the services, in reverse order. Their progress ends
+// in the given state.
+func RemoveServices(t *jobs.Tracker, services []*models.Service, state models.JobState) error {
+	var lastErr error
+
+	for i := len(services) - 1; i >= 0; i-- {
+		srv := services[i]
+
+		t.Logf("Removing service %s", srv.ServiceName)
+		if err := RemoveService(srv); err != nil {
+			t.Logf("Cannot remove %s completely : %s", srv.ServiceName, err.Error())
+			lastErr = err
+		}
+
+		t.Update(func(job *models.Job) {
+			job.Service(srv.ServiceName).State = state
+		})
+	}
+
+	return lastErr
+}
+
+// RemoveService stops the instances of the service and removes every trace of
+// it : DNS entries, proxy routes, port links, revisions, scaling history and
+// its record
+func RemoveService(srv *models.Service) error {
+	unlock := LockService(srv.Identifier())
+	defer unlock()
+
+	// The given service may not have been saved yet
+	if stored := data.GetDB().GetService(srv.Identifier()); stored != nil {
+		srv = stored
+	}
+
+	var lastErr error
+	for _, inst := range srv.Instances {
+		if err := StopInstance(srv, inst); err != nil {
+			lastErr = err
+		}
+	}
+
+	if err := UnpublishPorts(srv); err != nil {
+		lastErr = err
+	}
+
+	if err := data.GetDB().DeleteRevisions(srv.Identifier()); err != nil {
+		lastErr = err
+	}
+
+	if err := data.GetDB().DeleteScalingDecisions(srv.Identifier()); err != nil {
+		lastErr = err
+	}
+
+	if err := data.GetDB().DeleteService(srv.Identifier()); err != nil {
+		lastErr = err
+	}
+	ClearPending(srv.Identifier())
+
+	return lastErr
+}
@@ -0,0 +1,462 @@
+package deploy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kinetik-server/control"
+	"kinetik-server/data"
+	"kinetik-server/docker"
+	"kinetik-server/jobs"
+	"kinetik-server/models"
+	"time"
+)
+
+const (
+	FailureActionPause    = "pause"
+	FailureActionContinue = "continue"
+	FailureActionRollback = "rollback"
+
+	OrderStopFirst  = "stop-first"
+	OrderStartFirst = "start-first"
+)
+
+// StackUpdate brings a deployed stack to the services of a new compose file:
+// new services are created, changed ones are replaced batch by batch and
+// services missing from the file are removed.
+type StackUpdate struct {
+	StackName string
+	Services  []*models.Service
+
+	created  []*models.Service
+	previous []*models.Service
+	replaced map[string]bool // Services whose instances were replaced, by name
+	rollback bool
+}
+
+func (u *StackUpdate) Run(t *jobs.Tracker) error {
+	stored := GetStackServices(u.StackName)
+	wanted := make(map[string]bool)
+
+	for _, next := range u.Services {
+		wanted[next.ServiceName] = true
+
+		current, ok := stored[next.ServiceName]
+		if !ok {
+			u.created = append(u.created, next)
+			if err := createService(t, next); err != nil {
+				u.rollback = true
+				return err
+			}
+			continue
+		}
+
+		u.previous = append(u.previous, current)
+		if SpecChanged(current, next) {
+			if u.replaced == nil {
+				u.replaced = make(map[string]bool)
+			}
+			u.replaced[next.ServiceName] = true
+		}
+		if err := updateService(t, next, false); err != nil {
+			_, unhealthy := err.(*HealthCheckError)
+			u.rollback = failureAction(next) == FailureActionRollback || unhealthy
+			return err
+		}
+	}
+
+	for name, current := range stored {
+		if wanted[name] {
+			continue
+		}
+		t.Logf("Removing service %s", name)
+		if err := RemoveServices(t, []*models.Service{current}, models.JobSucceeded); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Rollback puts back the services as they were before the update, when the
+// failure action asked for it or when new instances failed their health checks.
+// Only the services whose instances were replaced get their instances
+// replaced back, the others only get their replica count back.
+func (u *StackUpdate) Rollback(t *jobs.Tracker) error {
+	if !u.rollback {
+		return jobs.ErrNoRollback
+	}
+
+	var lastErr error
+	for i := len(u.previous) - 1; i >= 0; i-- {
+		if err := updateService(t, u.previous[i], u.replaced[u.previous[i].ServiceName]); err != nil {
+			t.Logf("Cannot roll back %s : %s", u.previous[i].ServiceName, err.Error())
+			lastErr = err
+		}
+	}
+
+	if err := RemoveServices(t, u.created, models.JobRolledBack); err != nil {
+		lastErr = err
+	}
+
+	return lastErr
+}
+
+// HealthCheckError reports a new instance that did not become healthy
+type HealthCheckError struct {
+	ServiceName string
+	ContainerID string
+	Err         error
+}
+
+func (e *HealthCheckError) Error() string {
+	return "Instance " + e.ContainerID + " of " + e.ServiceName + " failed its health check : " + e.Err.Error()
+}
+
+func failureAction(srv *models.Service) string {
+	if srv.UpdateConfig == nil || srv.UpdateConfig.FailureAction == "" {
+		return FailureActionPause
+	}
+	return srv.UpdateConfig.FailureAction
+}
+
+// SpecChanged tells if the instances of current must be replaced to match next
+func SpecChanged(current, next *models.Service) bool {
+	return !sameJSON(current.ContainerConfig, next.ContainerConfig) ||
+		!sameJSON(current.Constraints, next.Constraints) ||
+		!sameJSON(current.Limits, next.Limits) ||
+		!sameJSON(current.Ports, next.Ports) ||
+		!sameJSON(current.Placement, next.Placement) ||
+		current.Strategy != next.Strategy ||
+		current.AntiAffinity != next.AntiAffinity ||
+		!sameJSON(current.Affinity, next.Affinity) ||
+		current.Priority != next.Priority ||
+		!sameJSON(current.DisruptionBudget, next.DisruptionBudget)
+}
+
+func sameJSON(a, b interface{}) bool {
+	bufA, errA := json.Marshal(a)
+	bufB, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(bufA) == string(bufB)
+}
+
+// updateService replaces the stored service by next, swapping its instances
+// batch by batch as described by the update config of next. Unless forced,
+// instances are only replaced when the spec changed.
+func updateService(t *jobs.Tracker, next *models.Service, force bool) error {
+	unlock := LockService(next.Identifier())
+	defer unlock()
+
+	current := data.GetDB().GetService(next.Identifier())
+	if current == nil {
+		return errors.New("Service " + next.Identifier() + " does not exist")
+	}
+	// A stopped service stays stopped, only its spec changes
+	next.Stopped = current.Stopped
+	// Autoscaled services keep the replica count the autoscaler chose
+	next.Autoscale = current.Autoscale
+	if next.Autoscale != nil {
+		next.Replicas = current.Replicas
+	}
+
+	t.Update(func(job *models.Job) {
+		job.Service(next.ServiceName).State = models.JobRunning
+	})
+
+	if !force && !SpecChanged(current, next) {
+		if current.Replicas != next.Replicas {
+			t.Logf("Scaling %s from %d to %d replicas", next.ServiceName, current.Replicas, next.Replicas)
+		}
+		next.Instances = current.Instances
+		err := scaleTo(t, next)
+		t.Update(func(job *models.Job) {
+			if err != nil {
+				job.Service(next.ServiceName).State = models.JobFailed
+			} else {
+				job.Service(next.ServiceName).State = models.JobSucceeded
+			}
+		})
+		return err
+	}
+
+	if next.Revision == 0 {
+		if err := data.GetDB().AddRevision(next); err != nil {
+			return errors.New("Cannot save revision of " + next.ServiceName + " : " + err.Error())
+		}
+	}
+
+	// One replica at a time unless asked otherwise, as Docker does
+	parallelism := 1
+	order := OrderStopFirst
+	var delay time.Duration
+	monitor := 5 * time.Second
+	if next.UpdateConfig != nil {
+		if next.UpdateConfig.Parallelism != nil {
+			parallelism = int(*next.UpdateConfig.Parallelism)
+			if parallelism == 0 {
+				// All at once
+				parallelism = len(current.Instances) + int(next.DesiredReplicas())
+			}
+		}
+		if next.UpdateConfig.Order != "" {
+			order = next.UpdateConfig.Order
+		}
+		delay = time.Duration(next.UpdateConfig.Delay)
+		if next.UpdateConfig.Monitor > 0 {
+			monitor = time.Duration(next.UpdateConfig.Monitor)
+		}
+	}
+
+	t.Logf("Updating %s to revision %d : %d replicas, %d at a time, %s", next.ServiceName, next.Revision, next.Replicas, parallelism, order)
+
+	remaining := current.Instances
+	updated := make([]*models.Instance, 0, next.DesiredReplicas())
+	replica := 0
+
+	for len(remaining) > 0 || replica < int(next.DesiredReplicas()) {
+		toStop := remaining
+		if len(toStop) > parallelism {
+			toStop = toStop[:parallelism]
+		}
+		toStart := int(next.DesiredReplicas()) - replica
+		if toStart > parallelism {
+			toStart = parallelism
+		}
+
+		if order != OrderStartFirst {
+			stopBatch(t, current, toStop)
+			// The stopped instances must not count when placing the new ones
+			current.Instances = append(append([]*models.Instance{}, remaining[len(toStop):]...), updated...)
+			data.GetDB().AddService(current)
+		}
+
+		started := make([]*models.Instance, 0, toStart)
+		var startErr error
+		for i := 0; i < toStart; i++ {
+			inst, err := startReplica(t, next, replica)
+			if err == nil {
+				err = checkHealth(t, next, inst, replica, monitor)
+			}
+			replica++
+			if err != nil {
+				if failureAction(next) != FailureActionContinue {
+					startErr = err
+					break
+				}
+				t.Logf("Continuing despite the failure")
+				continue
+			}
+			started = append(started, inst)
+		}
+
+		if len(started) > 0 {
+			if err := RegisterInstances(next, started); err != nil {
+				t.Logf("Cannot register %s in DNS : %s", next.ServiceName, err.Error())
+			}
+		}
+		updated = append(updated, started...)
+
+		if startErr != nil {
+			if order == OrderStartFirst {
+				stopBatch(t, current, started)
+				updated = updated[:len(updated)-len(started)]
+			} else {
+				remaining = remaining[len(toStop):]
+			}
+			current.Instances = append(append([]*models.Instance{}, remaining...), updated...)
+			data.GetDB().AddService(current)
+			ReleaseClaims(updated)
+			t.Update(func(job *models.Job) {
+				job.Service(next.ServiceName).State = models.JobFailed
+			})
+			if _, unhealthy := startErr.(*HealthCheckError); unhealthy {
+				return startErr
+			}
+			return fmt.Errorf("Update of %s failed : %s", next.ServiceName, startErr.Error())
+		}
+
+		if order == OrderStartFirst {
+			stopBatch(t, current, toStop)
+		}
+		remaining = remaining[len(toStop):]
+
+		// Keep track of the swapped instances in case the server stops mid-update
+		current.Instances = append(append([]*models.Instance{}, remaining...), updated...)
+		data.GetDB().AddService(current)
+		ReleaseClaims(updated)
+
+		if delay > 0 && (len(remaining) > 0 || replica < int(next.DesiredReplicas())) {
+			time.Sleep(delay)
+		}
+	}
+
+	next.Instances = updated
+	if err := data.GetDB().AddService(next); err != nil {
+		return errors.New("Cannot save service " + next.ServiceName + " : " + err.Error())
+	}
+
+	if !sameJSON(current.Ports, next.Ports) && len(current.Ports) != 0 {
+		control.RemoveFromProxy(current.ServiceName, current.StackName)
+	}
+	if !next.Stopped {
+		if err := PublishPorts(next); err != nil {
+			return errors.New("Cannot publish ports of service " + next.ServiceName + " : " + err.Error())
+		}
+	}
+
+	t.Update(func(job *models.Job) {
+		job.Service(next.ServiceName).State = models.JobSucceeded
+	})
+
+	return nil
+}
+
+func startReplica(t *jobs.Tracker, srv *models.Service, replica int) (*models.Instance, error) {
+	inst, err := StartInstance(srv)
+	if err != nil {
+		t.Logf("Cannot start replica %d of %s : %s", replica, srv.ServiceName, err.Error())
+		t.Update(func(job *models.Job) {
+			progress := job.Service(srv.ServiceName).Replica(replica)
+			progress.State = models.ReplicaFailed
+			progress.Error = err.Error()
+		})
+		return nil, err
+	}
+
+	t.Logf("Replica %d of %s running as %s on %s", replica, srv.ServiceName, inst.ContainerID, inst.NodeID)
+	t.Update(func(job *models.Job) {
+		progress := job.Service(srv.ServiceName).Replica(replica)
+		progress.State = models.ReplicaRunning
+		progress.ContainerID = inst.ContainerID
+		progress.NodeID = inst.NodeID
+	})
+
+	return inst, nil
+}
+
+// checkHealth waits for a new instance to become healthy, removing it when
+// it does not
+func checkHealth(t *jobs.Tracker, srv *models.Service, inst *models.Instance, replica int, monitor time.Duration) error {
+	client, err := docker.GetRemoteClient(inst.NodeID)
+	if err == nil {
+		err = docker.WaitHealthy(client, inst.ContainerID, monitor)
+		client.Close()
+	}
+	if err == nil {
+		return nil
+	}
+
+	healthErr := &HealthCheckError{
+		ServiceName: srv.ServiceName,
+		ContainerID: inst.ContainerID,
+		Err:         err,
+	}
+	t.Logf("%s", healthErr.Error())
+	t.Update(func(job *models.Job) {
+		progress := job.Service(srv.ServiceName).Replica(replica)
+		progress.State = models.ReplicaFailed
+		progress.Error = healthErr.Error()
+	})
+	stopBatch(t, srv, []*models.Instance{inst})
+
+	return healthErr
+}
+
+func stopBatch(t *jobs.Tracker, srv *models.Service, instances []*models.Instance) {
+	for _, inst := range instances {
+		if err := StopInstance(srv, inst); err != nil {
+			t.Logf("Cannot remove container %s of %s : %s", inst.ContainerID, srv.ServiceName, err.Error())
+			continue
+		}
+		t.Logf("Removed container %s of %s", inst.ContainerID, srv.ServiceName)
+	}
+}
+
+// removeReplicas stops the instances of the service from the replica first
+func removeReplicas(t *jobs.Tracker, srv *models.Service, first int) {
+	for i := first; i < len(srv.Instances); i++ {
+		inst := srv.Instances[i]
+		if err := StopInstance(srv, inst); err != nil {
+			t.Logf("Cannot remove container %s of %s : %s", inst.ContainerID, srv.ServiceName, err.Error())
+			continue
+		}
+		t.Logf("Removed replica %d of %s, container %s", i, srv.ServiceName, inst.ContainerID)
+		replica := i
+		t.Update(func(job *models.Job) {
+			progress := job.Service(srv.ServiceName).Replica(replica)
+			progress.State = models.ReplicaRemoved
+			progress.ContainerID = inst.ContainerID
+			progress.NodeID = inst.NodeID
+		})
+	}
+}
+
+// scaleTo starts or stops instances of the service, which must be locked,
+// until it runs its desired replicas, then saves it
+func scaleTo(t *jobs.Tracker, srv *models.Service) error {
+	started := make([]*models.Instance, 0)
+	for uint64(len(srv.Instances)) < srv.DesiredReplicas() {
+		inst, err := startReplica(t, srv, len(srv.Instances))
+		if IsUnschedulable(err) {
+			queueReplicas(t, srv, len(srv.Instances))
+			break
+		}
+		if err != nil {
+			data.GetDB().AddService(srv)
+			ReleaseClaims(started)
+			RegisterInstances(srv, started)
+			return err
+		}
+		srv.AddInstance(inst)
+		started = append(started, inst)
+	}
+
+	if len(started) > 0 {
+		if err := RegisterInstances(srv, started); err != nil {
+			t.Logf("Cannot register %s in DNS : %s", srv.ServiceName, err.Error())
+		}
+	}
+
+	if uint64(len(srv.Instances)) > srv.DesiredReplicas() {
+		removeReplicas(t, srv, int(srv.DesiredReplicas()))
+		srv.Instances = srv.Instances[:srv.DesiredReplicas()]
+	}
+
+	err := data.GetDB().AddService(srv)
+	ReleaseClaims(started)
+	return err
+}
+
+// ServiceRollback puts a service back to one of its previous revisions
+type ServiceRollback struct {
+	Identifier string
+	Revision   int
+}
+
+func (r *ServiceRollback) Run(t *jobs.Tracker) error {
+	current := data.GetDB().GetService(r.Identifier)
+	if current == nil {
+		return errors.New("Service " + r.Identifier + " does not exist")
+	}
+
+	rev := data.GetDB().GetRevision(r.Identifier, r.Revision)
+	if rev == nil {
+		return fmt.Errorf("Service %s has no revision %d", r.Identifier, r.Revision)
+	}
+
+	t.Logf("Rolling back %s from revision %d to revision %d", r.Identifier, current.Revision, rev.Revision)
+
+	return updateService(t, rev.Apply(current), true)
+}
+
+// PreviousRevision returns the revision that came before the current one of
+// the service, 0 if there is none
+func PreviousRevision(srv *models.Service) int {
+	previous := 0
+	for _, rev := range data.GetDB().GetRevisions(srv.Identifier()) {
+		if rev.Revision < srv.Revision && rev.Revision > previous {
+			previous = rev.Revision
+		}
+	}
+	return previous
+}
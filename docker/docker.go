@@ -2,6 +2,9 @@ package docker
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -14,6 +17,7 @@ import (
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
 )
@@ -30,6 +34,66 @@ func Loggers(out *log.Logger, err *log.Logger) {
 	errlog = err
 }
 
+// TLS material used to reach the Docker daemons of the nodes. The material in
+// /etc/docker predates the CA of kinetik, and is kept for the nodes which were
+// not rotated to it yet.
+var legacyTLSFiles = tlsconfig.Options{
+	CAFile:   filepath.Join("/etc/docker", "ca.cert"),
+	CertFile: filepath.Join("/etc/docker", "cert.pem"),
+	KeyFile:  filepath.Join("/etc/docker", "key.pem"),
+}
+var caTLSFiles *tlsconfig.Options
+var verifyPeer func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error
+
+// UseCA makes remote clients trust the given CA and authenticate with the
+// given certificate. verify, when not nil, can reject a verified certificate.
+// The material in /etc/docker, if any, stays trusted and used for the daemons
+// which still expect it.
+func UseCA(caFile, certFile, keyFile string, verify func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error) {
+	caTLSFiles = &tlsconfig.Options{
+		CAFile:   caFile,
+		CertFile: certFile,
+		KeyFile:  keyFile,
+	}
+	verifyPeer = verify
+}
+
+// remoteTLSConfig trusts both the CA and the legacy CA, and authenticates with
+// the client certificate the daemon accepts
+func remoteTLSConfig() (*tls.Config, error) {
+	if caTLSFiles == nil {
+		return tlsconfig.Client(legacyTLSFiles)
+	}
+	tlsc, err := tlsconfig.Client(*caTLSFiles)
+	if err != nil {
+		return nil, err
+	}
+	tlsc.VerifyPeerCertificate = verifyPeer
+
+	legacyCA, err := ioutil.ReadFile(legacyTLSFiles.CAFile)
+	if err != nil {
+		// No node predates the CA
+		return tlsc, nil
+	}
+	legacyCert, err := tls.LoadX509KeyPair(legacyTLSFiles.CertFile, legacyTLSFiles.KeyFile)
+	if err != nil {
+		return tlsc, nil
+	}
+	tlsc.RootCAs.AppendCertsFromPEM(legacyCA)
+
+	certs := append(tlsc.Certificates, legacyCert)
+	tlsc.Certificates = nil
+	tlsc.GetClientCertificate = func(info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		for i := range certs {
+			if info.SupportsCertificate(&certs[i]) == nil {
+				return &certs[i], nil
+			}
+		}
+		return &certs[0], nil
+	}
+	return tlsc, nil
+}
+
 func getClient() *client.Client {
 	cli, err := client.NewClient("unix:///var/run/docker.sock", "v1.26", nil, nil)
 	if err != nil {
@@ -165,13 +229,7 @@ func RunContainerFromConfig(client *client.Client, config *types.ContainerCreate
 }
 
 func GetRemoteClient(nodeIP string) (*client.Client, error) {
-	options := tlsconfig.Options{
-		CAFile:             filepath.Join("/etc/docker", "ca.cert"),
-		CertFile:           filepath.Join("/etc/docker", "cert.pem"),
-		KeyFile:            filepath.Join("/etc/docker", "key.pem"),
-		InsecureSkipVerify: false,
-	}
-	tlsc, err := tlsconfig.Client(options)
+	tlsc, err := remoteTLSConfig()
 	if err != nil {
 		return nil, err
 	}
@@ -211,10 +269,10 @@ func WaitForMikroverlayNetwork() {
 
 func GetContainersCount(remoteIP string) int {
 	cli, err := GetRemoteClient(remoteIP)
-	defer cli.Close()
 	if err != nil {
 		return -1
 	}
+	defer cli.Close()
 	cnts, err := cli.ContainerList(context.Background(), types.ContainerListOptions{})
 	if err != nil {
 		return -1
@@ -222,3 +280,158 @@ func GetContainersCount(remoteIP string) int {
 	return len(cnts)
 
 }
+
+// WatchContainers streams the container events of the node, calling onEvent
+// with whether the container now runs, until ctx is done or the stream fails.
+// synced is called once the stream is open, so that a listing made then
+// misses no event.
+func WatchContainers(ctx context.Context, remoteIP string, synced func(), onEvent func(id string, running bool)) error {
+	cli, err := GetRemoteClient(remoteIP)
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+
+	args := filters.NewArgs()
+	args.Add("type", "container")
+	messages, errs := cli.Events(ctx, types.EventsOptions{Filters: args})
+	synced()
+
+	for {
+		select {
+		case msg := <-messages:
+			switch msg.Action {
+			case "start":
+				onEvent(msg.Actor.ID, true)
+			case "die", "destroy":
+				onEvent(msg.Actor.ID, false)
+			}
+		case err := <-errs:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func StopAndRemoveContainer(client *client.Client, id string) error {
+	if client == nil {
+		client = getClient()
+	}
+	ctx := context.Background()
+	timeout := 5 * time.Second
+	client.ContainerStop(ctx, id, &timeout)
+	return client.ContainerRemove(ctx, id, types.ContainerRemoveOptions{
+		Force: true,
+	})
+}
+
+// GetRunningContainers returns the IDs of the containers running on the node
+func GetRunningContainers(remoteIP string) (map[string]bool, error) {
+	cli, err := GetRemoteClient(remoteIP)
+	if err != nil {
+		return nil, err
+	}
+	defer cli.Close()
+	cnts, err := cli.ContainerList(context.Background(), types.ContainerListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	running := make(map[string]bool, len(cnts))
+	for _, cnt := range cnts {
+		running[cnt.ID] = true
+	}
+	return running, nil
+}
+
+// ListContainers returns the containers, running or not, which have all the
+// given labels. An empty value matches any value of the label.
+func ListContainers(client *client.Client, labels map[string]string) ([]types.Container, error) {
+	if client == nil {
+		client = getClient()
+	}
+	args := filters.NewArgs()
+	for key, value := range labels {
+		if value == "" {
+			args.Add("label", key)
+		} else {
+			args.Add("label", key+"="+value)
+		}
+	}
+	return client.ContainerList(context.Background(), types.ContainerListOptions{
+		All:     true,
+		Filters: args,
+	})
+}
+
+// GetContainerStatus returns the status of the container : created, running,
+// exited...
+func GetContainerStatus(client *client.Client, id string) (string, error) {
+	if client == nil {
+		client = getClient()
+	}
+	json, err := client.ContainerInspect(context.Background(), id)
+	if err != nil {
+		return "", err
+	}
+	return json.State.Status, nil
+}
+
+// WaitHealthy waits for the container to report healthy. Containers without
+// healthcheck only have to keep running during the monitor period. A container
+// still starting once the monitor period is over is given until its
+// healthcheck could have settled, its start period plus its retries.
+func WaitHealthy(client *client.Client, id string, monitor time.Duration) error {
+	if client == nil {
+		client = getClient()
+	}
+	ctx := context.Background()
+	started := time.Now()
+	deadline := started.Add(monitor)
+	for {
+		json, err := client.ContainerInspect(ctx, id)
+		if err != nil {
+			return err
+		}
+		if !json.State.Running {
+			return errors.New("Container " + id + " is " + json.State.Status)
+		}
+		if json.State.Health != nil {
+			switch json.State.Health.Status {
+			case "healthy":
+				return nil
+			case "unhealthy":
+				return errors.New("Container " + id + " is unhealthy")
+			}
+		}
+		if time.Now().After(deadline) {
+			if json.State.Health == nil {
+				return nil
+			}
+			if settled := started.Add(healthcheckPeriod(json.Config)); json.State.Health.Status != "starting" || time.Now().After(settled) {
+				return errors.New("Container " + id + " is still " + json.State.Health.Status)
+			}
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// healthcheckPeriod is the longest a healthcheck of the container can report
+// starting, with the defaults of Docker
+func healthcheckPeriod(config *container.Config) time.Duration {
+	interval, timeout, retries := 30*time.Second, 30*time.Second, 3
+	var startPeriod time.Duration
+	if config != nil && config.Healthcheck != nil {
+		if config.Healthcheck.Interval > 0 {
+			interval = config.Healthcheck.Interval
+		}
+		if config.Healthcheck.Timeout > 0 {
+			timeout = config.Healthcheck.Timeout
+		}
+		if config.Healthcheck.Retries > 0 {
+			retries = config.Healthcheck.Retries
+		}
+		startPeriod = config.Healthcheck.StartPeriod
+	}
+	return startPeriod + time.Duration(retries)*(interval+timeout)
+}
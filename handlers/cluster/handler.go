@@ -0,0 +1,27 @@
+package cluster
+
+import (
+	"encoding/json"
+	"kinetik-server/autoscaler"
+	"kinetik-server/nodestate"
+	"kinetik-server/rebalancer"
+	"net/http"
+)
+
+// GetAutoscaler returns the policy of the cluster autoscaler, the number of
+// nodes and the replicas waiting for a node
+func GetAutoscaler(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(autoscaler.GetClusterStatus())
+}
+
+// GetNodeStates returns the cached state of every node : its running
+// containers and how fresh their count is
+func GetNodeStates(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(nodestate.States())
+}
+
+// GetRebalancer returns the policy of the rebalancer and the moves of its
+// last pass
+func GetRebalancer(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(rebalancer.GetStatus())
+}
@@ -2,10 +2,12 @@ package instances
 
 import (
 	"encoding/json"
+	"kinetik-server/autoscaler"
 	"kinetik-server/data"
+	"kinetik-server/deploy"
+	"kinetik-server/models"
 	"kinetik-server/models/internals"
 	"net/http"
-	"strconv"
 
 	"github.com/gorilla/mux"
 )
@@ -14,21 +16,97 @@ func GetInstances(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(data.GetDB().GetInstances())
 }
 
+// DeleteInstance stops the container with the given ID and removes it from its
+// service, which runs one replica less
 func DeleteInstance(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	id := params["id"]
-	idInt, err := strconv.Atoi(id)
-	err = data.GetDB().DeleteNode(idInt)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(internals.ErrorMessage{
-			Message: err.Error(),
-		})
-	} else {
-		w.WriteHeader(http.StatusOK)
+
+	for _, srv := range data.GetDB().GetServices() {
+		for _, inst := range srv.Instances {
+			if inst.ContainerID == id {
+				removeInstance(w, srv.Identifier(), id)
+				return
+			}
+		}
+	}
+
+	w.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(w).Encode(internals.ErrorMessage{
+		Message: "Instance not found " + id,
+	})
+}
+
+func removeInstance(w http.ResponseWriter, identifier string, containerID string) {
+	unlock := deploy.LockService(identifier)
+	defer unlock()
+
+	srv := data.GetDB().GetService(identifier)
+	if srv != nil {
+		for idx, inst := range srv.Instances {
+			if inst.ContainerID != containerID {
+				continue
+			}
+			err := deploy.RemoveInstance(srv, idx)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(internals.ErrorMessage{
+					Message: err.Error(),
+				})
+			} else {
+				w.WriteHeader(http.StatusOK)
+			}
+			return
+		}
 	}
+
+	// Removed while we were waiting for the lock
+	w.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(w).Encode(internals.ErrorMessage{
+		Message: "Instance not found " + containerID,
+	})
 }
 
+// UpdateMetrics receives the metric values of the container with the given ID
 func UpdateMetrics(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	found := false
+	for _, srv := range data.GetDB().GetServices() {
+		for _, inst := range srv.Instances {
+			if inst.ContainerID == id {
+				found = true
+			}
+		}
+	}
+	if !found {
+		http.Error(w, "Instance not found "+id, 404)
+		return
+	}
+
+	var values []*models.MetricValue
+	err := json.NewDecoder(r.Body).Decode(&values)
+	if err != nil {
+		http.Error(w, "Cannot decode body : "+err.Error(), 400)
+		return
+	}
+
+	autoscaler.Report(id, values)
+	w.WriteHeader(http.StatusOK)
+}
+
+// GetPlacement explains why the container with the given ID runs on its node
+func GetPlacement(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	decision := data.GetDB().GetPlacement(id)
+	if decision == nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(internals.ErrorMessage{
+			Message: "No placement recorded for " + id,
+		})
+		return
+	}
 
+	json.NewEncoder(w).Encode(decision)
 }
@@ -0,0 +1,50 @@
+package jobs
+
+import (
+	"encoding/json"
+	"kinetik-server/data"
+	"kinetik-server/models"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+func GetJobs(w http.ResponseWriter, r *http.Request) {
+	stack := r.URL.Query().Get("stack")
+	state := r.URL.Query().Get("state")
+	node := r.URL.Query().Get("node")
+
+	jobs := make([]*models.Job, 0)
+	for _, job := range data.GetDB().GetJobs() {
+		if stack != "" && job.StackName != stack {
+			continue
+		}
+		if state != "" && string(job.State) != state {
+			continue
+		}
+		if node != "" && job.NodeID != node {
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+
+	json.NewEncoder(w).Encode(jobs)
+}
+
+func GetJob(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		http.Error(w, "Invalid job id "+params["id"], 400)
+		return
+	}
+
+	job := data.GetDB().GetJob(id)
+	if job == nil {
+		http.Error(w, "Job not found "+params["id"], 404)
+		return
+	}
+
+	json.NewEncoder(w).Encode(job)
+}
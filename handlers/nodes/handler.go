@@ -2,22 +2,133 @@ package nodes
 
 import (
 	"encoding/json"
+	"io"
 	"io/ioutil"
 	"kinetik-server/control"
 	"kinetik-server/data"
+	"kinetik-server/deploy"
+	"kinetik-server/jobs"
 	"kinetik-server/logger"
 	"kinetik-server/models"
+	"kinetik-server/models/v2"
+	"kinetik-server/nodestate"
+	"kinetik-server/provider"
 	"kinetik-server/rand"
+	"kinetik-server/reconciler"
+	"kinetik-server/scheduler"
 	"net/http"
+	"net/url"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
-
-	"github.com/docker/cli/cli/compose/types"
 )
 
+// GetNodes lists the inventory with the last report of each node. It can be
+// filtered by ?phase=, ?provider=, ?state= (ready, suspect or down),
+// ?cordoned= and any number of ?label=key=value.
 func GetNodes(w http.ResponseWriter, r *http.Request) {
-	json.NewEncoder(w).Encode(data.GetDB().GetNodes())
+	query := r.URL.Query()
+
+	entries := make([]*models.NodeEntry, 0)
+	for _, entry := range listEntries() {
+		if matches(entry, query) {
+			entries = append(entries, entry)
+		}
+	}
+
+	json.NewEncoder(w).Encode(entries)
+}
+
+func GetNode(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	for _, entry := range listEntries() {
+		if entry.Name == id || entry.PublicIP == id {
+			json.NewEncoder(w).Encode(entry)
+			return
+		}
+	}
+
+	http.Error(w, "Node not found "+id, 404)
+}
+
+// listEntries returns the inventory entries with the last report of their
+// node and its reservations. Nodes which report without an entry get a bare
+// one named after their IP.
+func listEntries() []*models.NodeEntry {
+	nodes := data.GetDB().GetNodes()
+	reservations := scheduler.Reservations()
+	for ip, node := range nodes {
+		node.Reservations = models.AddResources(reservations[ip], nil)
+	}
+
+	entries := data.GetDB().GetNodeEntries()
+	for _, entry := range entries {
+		if node, ok := nodes[entry.PublicIP]; ok && entry.PublicIP != "" {
+			entry.Node = node
+			delete(nodes, entry.PublicIP)
+		}
+	}
+	for ip, node := range nodes {
+		entry := models.NewNodeEntry(ip, "")
+		entry.PublicIP = ip
+		entry.Phase = models.PhaseReady
+		entry.Node = node
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+	return entries
+}
+
+func matches(entry *models.NodeEntry, query url.Values) bool {
+	if phase := query.Get("phase"); phase != "" && entry.Phase != phase {
+		return false
+	}
+	if prov := query.Get("provider"); prov != "" && entry.Provider != prov {
+		return false
+	}
+	if state := query.Get("state"); state != "" && nodeState(entry.Node) != state {
+		return false
+	}
+	if cordoned := query.Get("cordoned"); cordoned != "" && (entry.Node != nil && entry.Node.Cordoned) != (cordoned == "true") {
+		return false
+	}
+	for _, label := range query["label"] {
+		parts := strings.SplitN(label, "=", 2)
+		value, ok := entry.Labels[parts[0]]
+		if !ok || (len(parts) == 2 && value != parts[1]) {
+			return false
+		}
+	}
+	return true
+}
+
+func nodeState(node *models.Node) string {
+	if node == nil {
+		return ""
+	}
+	if node.IsReady() {
+		return "ready"
+	}
+	if *node.State == models.NodeSuspect {
+		return "suspect"
+	}
+	return "down"
+}
+
+// resolveIP returns the IP of the node with the given name or IP
+func resolveIP(id string) string {
+	if entry := data.FindNodeEntry(id); entry != nil && entry.PublicIP != "" {
+		return entry.PublicIP
+	}
+	return id
 }
 
 func UpdateNode(w http.ResponseWriter, r *http.Request) {
@@ -32,14 +143,34 @@ func UpdateNode(w http.ResponseWriter, r *http.Request) {
 
 	if err == nil {
 
-		previousState := data.GetDB().GetNode(nodeIP)
-		if previousState != nil {
-			nodeReport.Reservations = previousState.Reservations
-		} else {
-			nodeReport.Reservations = &types.Resource{}
+		wasDown := false
+		err = data.GetDB().UpdateNode(nodeIP, func(node *models.Node) *models.Node {
+			if node == nil {
+				node = &models.Node{}
+			} else if !node.IsReady() {
+				logger.StdLog.Println("Node " + nodeIP + " is ready again")
+				wasDown = node.State != nil && *node.State == models.NodeDown
+			}
+			node.UpdateStats(&nodeReport)
+			node.LastSeen = time.Now()
+			node.SetState(models.NodeReady)
+			return node
+		})
+		if err != nil {
+			logger.ErrLog.Println("Cannot save node " + nodeIP + " : " + err.Error())
+			return
+		}
+		nodestate.Report(nodeIP, &nodeReport)
+		if wasDown {
+			// Its instances were replaced while it was down
+			go reconciler.RemoveStrayContainers(nodeIP, time.Now())
+		}
+		if nodeReport.OverlayIP != "" {
+			if entry := data.FindNodeEntry(nodeIP); entry != nil && entry.OverlayIP != nodeReport.OverlayIP {
+				entry.OverlayIP = nodeReport.OverlayIP
+				data.GetDB().SaveNodeEntry(entry)
+			}
 		}
-
-		data.GetDB().AddNode(nodeIP, &nodeReport)
 		logger.StdLog.Println("Added node " + nodeIP)
 	} else {
 		logger.ErrLog.Println("Error while getting node : " + err.Error())
@@ -58,18 +189,299 @@ func StartDocker(w http.ResponseWriter, r *http.Request) {
 
 func CreateNode(w http.ResponseWriter, r *http.Request) {
 
-	cfg, err := control.CreateKlerk(&control.KlerkCreationOption{
-		Name:              "klerk-" + rand.String(4),
-		Region:            "ams3",
-		Size:              "s-1vcpu-1gb",
-		Token:             os.Getenv("DO_TOKEN"),
-		SSHKeyFingerprint: control.ComputePublicFingerprint("/root/.ssh/id_rsa"),
+	var nodeReq v2.NodeCreationRequest
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&nodeReq)
+		if err != nil {
+			http.Error(w, "Cannot decode body : "+err.Error(), 400)
+			return
+		}
+	}
+	if nodeReq.Name == "" {
+		nodeReq.Name = "klerk-" + rand.String(4)
+	}
+	if data.GetDB().GetNodeEntry(nodeReq.Name) != nil {
+		http.Error(w, "Node "+nodeReq.Name+" already exists", 409)
+		return
+	}
+
+	p := provider.GetProvider()
+
+	entry := models.NewNodeEntry(nodeReq.Name, p.Name())
+	entry.Size = nodeReq.Size
+	entry.Region = nodeReq.Region
+	if nodeReq.Labels != nil {
+		entry.Labels = nodeReq.Labels
+	}
+	if err := data.GetDB().SaveNodeEntry(entry); err != nil {
+		http.Error(w, "Cannot save node : "+err.Error(), 500)
+		return
+	}
+
+	tracker, err := control.StartProvisioning(p, entry)
+	if err != nil {
+		http.Error(w, "Cannot create job : "+err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Location", "/jobs/"+strconv.Itoa(tracker.ID()))
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(data.GetDB().GetJob(tracker.ID()))
+}
+
+// GetNodeLog sends the provisioning log of the node. With ?follow=true, the
+// response goes on with new lines until the provisioning ends.
+func GetNodeLog(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	entry := data.FindNodeEntry(id)
+	if entry == nil {
+		http.Error(w, "Node not found "+id, 404)
+		return
+	}
+
+	logFile, err := os.Open(logger.LogPath(entry.Name + ".log"))
+	if err != nil {
+		http.Error(w, "Cannot open log of "+entry.Name+" : "+err.Error(), 404)
+		return
+	}
+	defer logFile.Close()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.Copy(w, logFile)
+
+	flusher, ok := w.(http.Flusher)
+	if r.URL.Query().Get("follow") != "true" || !ok {
+		return
+	}
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(time.Second):
+		}
+
+		n, _ := io.Copy(w, logFile)
+		if n > 0 {
+			flusher.Flush()
+			continue
+		}
+
+		entry = data.GetDB().GetNodeEntry(entry.Name)
+		if entry == nil || !entry.IsProvisioning() {
+			return
+		}
+	}
+}
+
+// SetLabels replaces the labels of the node
+func SetLabels(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	var labels map[string]string
+	err := json.NewDecoder(r.Body).Decode(&labels)
+	if err != nil {
+		http.Error(w, "Cannot decode body : "+err.Error(), 400)
+		return
+	}
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+
+	entry := data.FindNodeEntry(id)
+	if entry == nil {
+		if _, ok := data.GetDB().GetNodes()[id]; !ok {
+			http.Error(w, "Node not found "+id, 404)
+			return
+		}
+		// Node which joined by itself
+		entry = models.NewNodeEntry(id, "")
+		entry.PublicIP = id
+		entry.Phase = models.PhaseReady
+	}
+
+	entry.Labels = labels
+	if err := data.GetDB().SaveNodeEntry(entry); err != nil {
+		http.Error(w, "Cannot save node "+id+" : "+err.Error(), 500)
+		return
+	}
+
+	json.NewEncoder(w).Encode(entry.Labels)
+}
+
+// setCordoned marks the node schedulable or not and tells whether it exists
+func setCordoned(nodeIP string, cordoned bool) (bool, error) {
+	found := false
+	err := data.GetDB().UpdateNode(nodeIP, func(node *models.Node) *models.Node {
+		if node == nil {
+			return nil
+		}
+		found = true
+		node.Cordoned = cordoned
+		return node
 	})
+	return found, err
+}
 
+func CordonNode(w http.ResponseWriter, r *http.Request) {
+	nodeIP := resolveIP(mux.Vars(r)["id"])
+
+	found, err := setCordoned(nodeIP, true)
 	if err != nil {
-		http.Error(w, err.Error(), 500)
-	} else {
-		w.WriteHeader(201)
-		json.NewEncoder(w).Encode(cfg)
+		http.Error(w, "Cannot cordon node "+nodeIP+" : "+err.Error(), 500)
+		return
+	}
+	if !found {
+		http.Error(w, "Node not found "+nodeIP, 404)
+		return
+	}
+
+	logger.StdLog.Println("Cordoned node " + nodeIP)
+	w.WriteHeader(200)
+}
+
+func UncordonNode(w http.ResponseWriter, r *http.Request) {
+	nodeIP := resolveIP(mux.Vars(r)["id"])
+
+	found, err := setCordoned(nodeIP, false)
+	if err != nil {
+		http.Error(w, "Cannot uncordon node "+nodeIP+" : "+err.Error(), 500)
+		return
+	}
+	if !found {
+		http.Error(w, "Node not found "+nodeIP, 404)
+		return
+	}
+
+	logger.StdLog.Println("Uncordoned node " + nodeIP)
+	w.WriteHeader(200)
+}
+
+// DrainNode cordons the node then moves its instances away in a job
+func DrainNode(w http.ResponseWriter, r *http.Request) {
+	nodeIP := resolveIP(mux.Vars(r)["id"])
+
+	found, err := setCordoned(nodeIP, true)
+	if err != nil {
+		http.Error(w, "Cannot cordon node "+nodeIP+" : "+err.Error(), 500)
+		return
+	}
+	if !found {
+		http.Error(w, "Node not found "+nodeIP, 404)
+		return
+	}
+
+	tracker, err := jobs.New(models.JobDrainNode, "")
+	if err != nil {
+		http.Error(w, "Cannot create job : "+err.Error(), 500)
+		return
 	}
+	tracker.Update(func(job *models.Job) {
+		job.NodeID = nodeIP
+	})
+
+	drain := &deploy.NodeDrain{
+		NodeIP: nodeIP,
+	}
+	tracker.Run(drain.Run, nil)
+
+	w.Header().Set("Location", "/jobs/"+strconv.Itoa(tracker.ID()))
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(data.GetDB().GetJob(tracker.ID()))
+}
+
+// DeleteNode drains the node, destroys its machine and forgets it, in a job.
+// With ?force=true, the instances that cannot be moved are dropped instead of
+// stopping the deletion.
+func DeleteNode(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	deletion := &deploy.NodeDeletion{
+		NodeIP: resolveIP(id),
+		Force:  r.URL.Query().Get("force") == "true",
+	}
+	if entry := data.FindNodeEntry(id); entry != nil {
+		deletion.Name = entry.Name
+		deletion.NodeIP = entry.PublicIP
+	}
+
+	found := false
+	if deletion.NodeIP != "" {
+		var err error
+		found, err = setCordoned(deletion.NodeIP, true)
+		if err != nil {
+			http.Error(w, "Cannot cordon node "+id+" : "+err.Error(), 500)
+			return
+		}
+		if !found {
+			// No report yet
+			deletion.NodeIP = ""
+		}
+	}
+	if !found && deletion.Name == "" {
+		http.Error(w, "Node not found "+id, 404)
+		return
+	}
+
+	tracker, err := jobs.New(models.JobDeleteNode, "")
+	if err != nil {
+		http.Error(w, "Cannot create job : "+err.Error(), 500)
+		return
+	}
+	tracker.Update(func(job *models.Job) {
+		job.NodeID = id
+	})
+	tracker.Run(deletion.Run, nil)
+
+	w.Header().Set("Location", "/jobs/"+strconv.Itoa(tracker.ID()))
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(data.GetDB().GetJob(tracker.ID()))
+}
+
+// RotateCerts pushes a new certificate to the Docker daemon of the node and
+// revokes the previous one, in a job. The node is drained while its Docker
+// daemon restarts.
+func RotateCerts(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	entry := data.FindNodeEntry(id)
+	if entry == nil {
+		http.Error(w, "Node not found "+id, 404)
+		return
+	}
+	if entry.PublicIP == "" || entry.IsProvisioning() {
+		http.Error(w, "Node "+entry.Name+" is not provisioned yet", 409)
+		return
+	}
+
+	tracker, err := deploy.RotateCert(entry.Name)
+	if err != nil {
+		http.Error(w, "Cannot create job : "+err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Location", "/jobs/"+strconv.Itoa(tracker.ID()))
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(data.GetDB().GetJob(tracker.ID()))
+}
+
+// RevokeCerts revokes the certificate of the node. kinetik stops talking to
+// its Docker daemon until the certificate is rotated.
+func RevokeCerts(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	entry := data.FindNodeEntry(id)
+	if entry == nil {
+		http.Error(w, "Node not found "+id, 404)
+		return
+	}
+
+	if err := control.RevokeNodeCert(entry); err != nil {
+		http.Error(w, "Cannot revoke certificate of "+entry.Name+" : "+err.Error(), 500)
+		return
+	}
+
+	json.NewEncoder(w).Encode(entry)
 }
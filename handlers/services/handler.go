@@ -1,32 +1,18 @@
 package services
 
 import (
-	"context"
 	"encoding/json"
-	"kinetik-server/compose"
-	"kinetik-server/control"
 	"kinetik-server/data"
-	"kinetik-server/docker"
-	"kinetik-server/iptables"
-	"kinetik-server/logger"
+	"kinetik-server/deploy"
+	"kinetik-server/jobs"
 	"kinetik-server/models"
 	"kinetik-server/models/v2"
-	"kinetik-server/scheduler"
-	"math/rand"
 	"net/http"
-	"strings"
-	"sync"
-	"time"
-
-	composeTypes "github.com/docker/cli/cli/compose/types"
-	dockerTypes "github.com/docker/docker/api/types"
-	"github.com/docker/docker/api/types/network"
+	"strconv"
 
 	"github.com/gorilla/mux"
 )
 
-var mu sync.Mutex
-
 func GetServices(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(data.GetDB().GetServices())
 }
@@ -35,133 +21,222 @@ func AddService(w http.ResponseWriter, r *http.Request) {
 
 	var srvCreateReq v2.ServiceCreationRequest
 
-	sch := scheduler.GetScheduler()
-
 	err := json.NewDecoder(r.Body).Decode(&srvCreateReq)
 
 	if err != nil {
-		http.Error(w, "Cannot decode body : "+err.Error(), 500)
+		http.Error(w, "Cannot decode body : "+err.Error(), 400)
 		return
 	}
 
-	config, err := compose.LoadYAMLWithEnv([]byte(srvCreateReq.DockerComposeContent), nil)
+	services, err := deploy.BuildStack(srvCreateReq.StackName, srvCreateReq.DockerComposeContent)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
 
+	for _, srv := range services {
+		if data.GetDB().GetService(srv.Identifier()) != nil {
+			http.Error(w, "Service "+srv.Identifier()+" already exists", 409)
+			return
+		}
+	}
+
+	tracker, err := jobs.New(models.JobCreateStack, srvCreateReq.StackName)
 	if err != nil {
-		http.Error(w, "Cannot decode YAML : "+err.Error(), 500)
+		http.Error(w, "Cannot create job : "+err.Error(), 500)
+		return
+	}
+
+	creation := &deploy.StackCreation{
+		Services: services,
 	}
+	tracker.Run(creation.Run, creation.Rollback)
 
-	labels := make(map[string]string)
-	srvContainerConfig := make(map[string]*dockerTypes.ContainerCreateConfig)
-	srvReplica := make(map[string]uint64)
-	srvPorts := make(map[string][]composeTypes.ServicePortConfig)
-	srvConstraints := make(map[string]*composeTypes.Resource)
+	w.Header().Set("Location", "/jobs/"+strconv.Itoa(tracker.ID()))
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(data.GetDB().GetJob(tracker.ID()))
+}
+
+func PlanStack(w http.ResponseWriter, r *http.Request) {
+	var srvCreateReq v2.ServiceCreationRequest
 
-	workGraph := make(models.Graph, len(config.Services))
+	err := json.NewDecoder(r.Body).Decode(&srvCreateReq)
 
-	debugMap := make(map[string]interface{})
+	if err != nil {
+		http.Error(w, "Cannot decode body : "+err.Error(), 400)
+		return
+	}
 
-	mikroverlayConfig := &network.EndpointSettings{
-		IPAMConfig: nil,
-		Links:      nil,
+	plan, err := deploy.PlanStack(srvCreateReq.StackName, srvCreateReq.DockerComposeContent)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
 	}
 
-	endsConfig := make(map[string]*network.EndpointSettings)
-	endsConfig["mikroverlay"] = mikroverlayConfig
+	json.NewEncoder(w).Encode(plan)
+}
 
-	for i, srv := range config.Services {
+func UpdateStack(w http.ResponseWriter, r *http.Request) {
+	stack := mux.Vars(r)["stack"]
 
-		workGraph[i] = models.NewDepNode(srv.Name, srv.DependsOn...)
+	var srvCreateReq v2.ServiceCreationRequest
 
-		contConfig, _ := compose.ConvertServiceToContainer(&srv)
-		contConfig.HostConfig.DNS = []string{data.GetDB().GetConfig().DNSIP}
-		labels["be.mikrodock.stack"] = srvCreateReq.StackName
-		labels["be.mikrodock.service"] = srv.Name
-		contConfig.Config.Labels = labels
-		contConfig.HostConfig.DNSSearch = []string{srvCreateReq.StackName + ".mikrodock"}
-		contConfig.NetworkingConfig = &network.NetworkingConfig{
-			EndpointsConfig: endsConfig,
-		}
-		srvContainerConfig[srv.Name] = contConfig
-		srvConstraints[srv.Name] = srv.Deploy.Resources.Reservations
+	err := json.NewDecoder(r.Body).Decode(&srvCreateReq)
 
-		srvPorts[srv.Name] = srv.Ports
+	if err != nil {
+		http.Error(w, "Cannot decode body : "+err.Error(), 400)
+		return
+	}
 
-		if srv.Deploy.Replicas == nil {
-			srvReplica[srv.Name] = 1
-		} else {
-			srvReplica[srv.Name] = *srv.Deploy.Replicas
-		}
+	if len(deploy.GetStackServices(stack)) == 0 {
+		http.Error(w, "Stack not found "+stack, 404)
+		return
+	}
 
+	services, err := deploy.BuildStack(stack, srvCreateReq.DockerComposeContent)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
 	}
 
-	depGraph, err := workGraph.Resolve()
+	tracker, err := jobs.New(models.JobUpdateStack, stack)
+	if err != nil {
+		http.Error(w, "Cannot create job : "+err.Error(), 500)
+		return
+	}
 
-	for _, node := range depGraph {
-		srvName := node.Name
-		config := srvContainerConfig[srvName]
-		serviceModel := models.NewService(srvCreateReq.StackName, srvName, config)
-		serviceModel.Constraints = srvConstraints[srvName]
-		serviceModel.Ports = srvPorts[srvName]
+	update := &deploy.StackUpdate{
+		StackName: stack,
+		Services:  services,
+	}
+	tracker.Run(update.Run, update.Rollback)
 
-		srvIPs := make([]string, srvReplica[srvName])
-		srvIPWeights := make([]control.IPWithWeight, 0)
-		for i := 0; i < int(srvReplica[srvName]); i++ {
+	w.Header().Set("Location", "/jobs/"+strconv.Itoa(tracker.ID()))
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(data.GetDB().GetJob(tracker.ID()))
+}
 
-			nodeIP, _ := sch.SelectWithConstraints(srvConstraints[srvName])
+func GetRevisions(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	id := params["stack"] + "/" + params["service"]
 
-			// TODO : handle error
+	if data.GetDB().GetService(id) == nil {
+		http.Error(w, "Service not found "+id, 404)
+		return
+	}
 
-			client, err := docker.GetRemoteClient(nodeIP)
-			if err != nil {
-				http.Error(w, "Cannot get remote client"+err.Error(), 500)
-			}
+	json.NewEncoder(w).Encode(data.GetDB().GetRevisions(id))
+}
 
-			id, err := docker.RunContainerFromConfig(client, config)
-			if err != nil {
-				http.Error(w, "Cannot run service "+srvName+"   "+err.Error(), 500)
-			}
+func RollbackService(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	id := params["stack"] + "/" + params["service"]
 
-			serviceModel.AddInstance(&models.Instance{
-				ContainerID: id,
-				NodeID:      nodeIP,
-			})
+	srv := data.GetDB().GetService(id)
+	if srv == nil {
+		http.Error(w, "Service not found "+id, 404)
+		return
+	}
 
-			ip, err := docker.GetContainerIP(client, id, "mikroverlay")
-			if err != nil {
-				http.Error(w, "Cannot run service "+srvName+"   "+err.Error(), 500)
-			}
-			srvIPs = append(srvIPs, ip)
-			srvIPWeights = append(srvIPWeights, control.IPWithWeight{
-				IP:     ip,
-				Weight: 10,
-			})
+	var rollbackReq v2.RollbackRequest
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&rollbackReq)
+		if err != nil {
+			http.Error(w, "Cannot decode body : "+err.Error(), 400)
+			return
 		}
+	}
 
-		data.GetDB().AddService(serviceModel)
+	if rollbackReq.Revision == 0 {
+		rollbackReq.Revision = deploy.PreviousRevision(srv)
+	}
+	if data.GetDB().GetRevision(id, rollbackReq.Revision) == nil {
+		http.Error(w, "No revision to roll back to", 400)
+		return
+	}
 
-		control.AddToDNS(srvName, srvCreateReq.StackName, srvIPWeights)
+	tracker, err := jobs.New(models.JobRollbackService, srv.StackName)
+	if err != nil {
+		http.Error(w, "Cannot create job : "+err.Error(), 500)
+		return
+	}
 
-		proxyIPParts := strings.Split(data.GetDB().GetConfig().ProxyIP, ".")
-		lastpart := proxyIPParts[len(proxyIPParts)-1]
-		proxyIP := "172.18.0." + lastpart
+	rollback := &deploy.ServiceRollback{
+		Identifier: id,
+		Revision:   rollbackReq.Revision,
+	}
+	tracker.Run(rollback.Run, nil)
 
-		for _, portConfig := range srvPorts[srvName] {
-			control.AddToProxy(srvName, srvCreateReq.StackName, int(portConfig.Target), int(portConfig.Published))
+	w.Header().Set("Location", "/jobs/"+strconv.Itoa(tracker.ID()))
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(data.GetDB().GetJob(tracker.ID()))
+}
 
-			iptables.NewLinkPort(proxyIP, int(portConfig.Published), int(portConfig.Target))
-		}
+func SetAutoscale(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	id := params["stack"] + "/" + params["service"]
+
+	var policy models.AutoscalePolicy
+	err := json.NewDecoder(r.Body).Decode(&policy)
+	if err != nil {
+		http.Error(w, "Cannot decode body : "+err.Error(), 400)
+		return
+	}
+	if err := policy.Validate(); err != nil {
+		http.Error(w, "Invalid autoscale policy : "+err.Error(), 400)
+		return
 	}
 
-	debugMap["services"] = srvContainerConfig
-	debugMap["ports"] = srvPorts
+	unlock := deploy.LockService(id)
+	defer unlock()
+
+	srv := data.GetDB().GetService(id)
+	if srv == nil {
+		http.Error(w, "Service not found "+id, 404)
+		return
+	}
+
+	srv.Autoscale = &policy
+	if err := data.GetDB().AddService(srv); err != nil {
+		http.Error(w, "Cannot save service "+id+" : "+err.Error(), 500)
+		return
+	}
+
+	json.NewEncoder(w).Encode(srv.Autoscale)
+}
+
+func DeleteAutoscale(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	id := params["stack"] + "/" + params["service"]
+
+	unlock := deploy.LockService(id)
+	defer unlock()
+
+	srv := data.GetDB().GetService(id)
+	if srv == nil {
+		http.Error(w, "Service not found "+id, 404)
+		return
+	}
 
-	json.NewEncoder(w).Encode(debugMap)
+	srv.Autoscale = nil
+	if err := data.GetDB().AddService(srv); err != nil {
+		http.Error(w, "Cannot save service "+id+" : "+err.Error(), 500)
+		return
+	}
 
+	w.WriteHeader(200)
 }
 
-func timeoutSeconds(n int) *time.Duration {
-	a := time.Duration(n) * time.Second
-	return &a
+func GetScalingHistory(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	id := params["stack"] + "/" + params["service"]
+
+	if data.GetDB().GetService(id) == nil {
+		http.Error(w, "Service not found "+id, 404)
+		return
+	}
+
+	json.NewEncoder(w).Encode(data.GetDB().GetScalingDecisions(id))
 }
 
 func DeleteService(w http.ResponseWriter, r *http.Request) {
@@ -170,6 +245,7 @@ func DeleteService(w http.ResponseWriter, r *http.Request) {
 	service := vars["service"]
 
 	id := stack + "/" + service
+
 	srv := data.GetDB().GetService(id)
 
 	if srv == nil {
@@ -177,15 +253,10 @@ func DeleteService(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ctx := context.Background()
-
-	for _, inst := range srv.Instances {
-		node := inst.NodeID
-		remoteClient, _ := docker.GetRemoteClient(node)
-		_ = remoteClient.ContainerStop(ctx, inst.ContainerID, timeoutSeconds(5))
-		_ = remoteClient.ContainerRemove(ctx, inst.ContainerID, dockerTypes.ContainerRemoveOptions{
-			Force: true,
-		})
+	err := deploy.RemoveService(srv)
+	if err != nil {
+		http.Error(w, "Cannot remove service "+id+" : "+err.Error(), 500)
+		return
 	}
 
 	w.WriteHeader(200)
@@ -196,86 +267,55 @@ func ScaleUp(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	stack := params["stack"]
 	service := params["service"]
+
+	unlock := deploy.LockService(stack + "/" + service)
+	defer unlock()
+
 	srv := data.GetDB().GetService(stack + "/" + service)
 	if srv == nil {
 		http.Error(w, "Service not found "+stack+"/"+service, 404)
 		return
 	}
-	nodeIP, err := scheduler.GetScheduler().SelectWithConstraints(srv.Constraints)
-	if err != nil {
-		http.Error(w, "Cannot get Node", 500)
-	}
-	dockerClient, err := docker.GetRemoteClient(nodeIP)
-	if err != nil {
-		http.Error(w, "Cannot get remote client", 500)
-	}
-
-	id, err := docker.RunContainerFromConfig(dockerClient, srv.ContainerConfig)
-	if err != nil {
-		http.Error(w, "Cannot run service "+srv.ServiceName+" : "+err.Error(), 500)
-	}
 
-	ip, err := docker.GetContainerIP(dockerClient, id, "mikroverlay")
+	inst, err := deploy.ScaleUp(srv)
 	if err != nil {
-		http.Error(w, "Cannot run service "+srv.ServiceName+" : "+err.Error(), 500)
+		http.Error(w, err.Error(), 500)
+		return
 	}
-
-	mu.Lock()
-	srv = data.GetDB().GetService(stack + "/" + service)
-	srv.AddInstance(&models.Instance{
-		ContainerID: id,
-		NodeID:      nodeIP,
-	})
-	data.GetDB().AddService(srv)
-	mu.Unlock()
-
-	control.AddToDNS(srv.ServiceName, srv.StackName, []control.IPWithWeight{control.IPWithWeight{
-		IP:     ip,
-		Weight: 10,
-	}})
-
-	proxyIPParts := strings.Split(data.GetDB().GetConfig().ProxyIP, ".")
-	lastpart := proxyIPParts[len(proxyIPParts)-1]
-	proxyIP := "172.18.0." + lastpart
-
-	for _, portConfig := range srv.Ports {
-		control.AddToProxy(srv.ServiceName, srv.StackName, int(portConfig.Target), int(portConfig.Published))
-
-		iptables.NewLinkPort(proxyIP, int(portConfig.Published), int(portConfig.Target))
+	if inst == nil {
+		// Queued until a node has room
+		w.WriteHeader(http.StatusAccepted)
+		return
 	}
 
-	w.Write([]byte(id))
+	w.Write([]byte(inst.ContainerID))
 }
 
 func ScaleDown(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	stack := params["stack"]
 	service := params["service"]
+
+	unlock := deploy.LockService(stack + "/" + service)
+	defer unlock()
+
 	srv := data.GetDB().GetService(stack + "/" + service)
 	if srv == nil {
 		http.Error(w, "Service not found "+stack+"/"+service, 404)
 		return
 	}
 
-	idx := rand.Intn(len(srv.Instances))
-	inst := srv.Instances[idx]
-
-	ctx := context.Background()
-
-	node := inst.NodeID
-	remoteClient, _ := docker.GetRemoteClient(node)
-	ip, _ := docker.GetContainerIP(remoteClient, inst.ContainerID, "mikroverlay")
-	logger.StdLog.Printf("Scaling down %s/%s : Container %s down with IP %s\n", stack, service, node, ip)
-	control.RemoveFromDNS(service, stack, ip)
-	_ = remoteClient.ContainerStop(ctx, inst.ContainerID, timeoutSeconds(5))
-	_ = remoteClient.ContainerRemove(ctx, inst.ContainerID, dockerTypes.ContainerRemoveOptions{
-		Force: true,
-	})
-
-	srv.Instances = append(srv.Instances[:idx], srv.Instances[idx+1:]...)
+	if len(srv.Instances) == 0 {
+		http.Error(w, "Service "+stack+"/"+service+" has no instance", 400)
+		return
+	}
 
-	data.GetDB().AddService(srv)
+	inst, err := deploy.ScaleDown(srv)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
 
-	w.Write([]byte(node))
+	w.Write([]byte(inst.NodeID))
 
 }
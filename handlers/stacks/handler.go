@@ -0,0 +1,117 @@
+package stacks
+
+import (
+	"encoding/json"
+	"kinetik-server/data"
+	"kinetik-server/deploy"
+	"kinetik-server/jobs"
+	"kinetik-server/models"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+func buildStacks() map[string]*models.Stack {
+	stacks := make(map[string]*models.Stack)
+	for _, srv := range data.GetDB().GetServices() {
+		stack, ok := stacks[srv.StackName]
+		if !ok {
+			stack = &models.Stack{
+				Name:     srv.StackName,
+				Stopped:  true,
+				Services: make([]*models.Service, 0),
+				Policy:   data.GetDB().GetStackPolicy(srv.StackName),
+			}
+			stacks[srv.StackName] = stack
+		}
+		stack.Services = append(stack.Services, srv)
+		stack.Instances += len(srv.Instances)
+		stack.Stopped = stack.Stopped && srv.Stopped
+	}
+	return stacks
+}
+
+func GetStacks(w http.ResponseWriter, r *http.Request) {
+	stacks := make([]*models.Stack, 0)
+	for _, stack := range buildStacks() {
+		stacks = append(stacks, stack)
+	}
+	sort.Slice(stacks, func(i, j int) bool {
+		return stacks[i].Name < stacks[j].Name
+	})
+
+	json.NewEncoder(w).Encode(stacks)
+}
+
+func GetStack(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["stack"]
+
+	stack, ok := buildStacks()[name]
+	if !ok {
+		http.Error(w, "Stack not found "+name, 404)
+		return
+	}
+
+	json.NewEncoder(w).Encode(stack)
+}
+
+// SetStackPolicy replaces the policy of the stack, such as whether its
+// instances may be preempted
+func SetStackPolicy(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["stack"]
+	if len(deploy.GetStackServices(name)) == 0 {
+		http.Error(w, "Stack not found "+name, 404)
+		return
+	}
+
+	policy := models.DefaultStackPolicy()
+	if err := json.NewDecoder(r.Body).Decode(policy); err != nil {
+		http.Error(w, "Cannot decode body : "+err.Error(), 400)
+		return
+	}
+
+	if err := data.GetDB().SetStackPolicy(name, policy); err != nil {
+		http.Error(w, "Cannot save policy : "+err.Error(), 500)
+		return
+	}
+
+	json.NewEncoder(w).Encode(policy)
+}
+
+func DeleteStack(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["stack"]
+	deletion := &deploy.StackDeletion{StackName: name}
+	runStackJob(w, name, models.JobDeleteStack, deletion.Run)
+}
+
+func StopStack(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["stack"]
+	stop := &deploy.StackStop{StackName: name}
+	runStackJob(w, name, models.JobStopStack, stop.Run)
+}
+
+func StartStack(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["stack"]
+	start := &deploy.StackStart{StackName: name}
+	runStackJob(w, name, models.JobStartStack, start.Run)
+}
+
+func runStackJob(w http.ResponseWriter, name string, jobType string, run func(*jobs.Tracker) error) {
+	if len(deploy.GetStackServices(name)) == 0 {
+		http.Error(w, "Stack not found "+name, 404)
+		return
+	}
+
+	tracker, err := jobs.New(jobType, name)
+	if err != nil {
+		http.Error(w, "Cannot create job : "+err.Error(), 500)
+		return
+	}
+	tracker.Run(run, nil)
+
+	w.Header().Set("Location", "/jobs/"+strconv.Itoa(tracker.ID()))
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(data.GetDB().GetJob(tracker.ID()))
+}
@@ -17,13 +17,30 @@ const (
 // iptables -t nat -A DOCKER -p tcp -m tcp --dport 8080 -j DNAT --to-destination 172.18.0.5:8080
 // iptables -A DOCKER -d 172.18.0.5/32 ! -i docker_gwbridge -o docker_gwbridge -p tcp -m tcp --dport 8080 -j ACCEPT
 
+// LinkPortRules returns the rules NewLinkPort adds
+func LinkPortRules(proxyIP string, publishedPort, targetPort int) []string {
+	return linkPortRules(APPEND, proxyIP, publishedPort, targetPort)
+}
+
+func linkPortRules(action IPTableAction, proxyIP string, publishedPort, targetPort int) []string {
+	rules := make([]string, 3)
+	rules[0] = createRule("nat", "POSTROUTING", "", action, "tcp", proxyIP+"/32", proxyIP+"/32", publishedPort, "", "MASQUERADE")
+	rules[1] = createRule("nat", "DOCKER", "", action, "tcp", "", "", publishedPort, proxyIP+":"+strconv.Itoa(publishedPort), "DNAT")
+	rules[2] = createRule("", "DOCKER", "docker_gwbridge", action, "tcp", "", proxyIP+"/32", publishedPort, "", "ACCEPT")
+	return rules
+}
+
 // TODO: Differ internal port and external port
 func NewLinkPort(proxyIP string, publishedPort, targetPort int) error {
-	rules := make([]string, 3)
-	rules[0] = createRule("nat", "POSTROUTING", "", APPEND, "tcp", proxyIP+"/32", proxyIP+"/32", publishedPort, "", "MASQUERADE")
-	rules[1] = createRule("nat", "DOCKER", "", APPEND, "tcp", "", "", publishedPort, proxyIP+":"+strconv.Itoa(publishedPort), "DNAT")
-	rules[2] = createRule("", "DOCKER", "docker_gwbridge", APPEND, "tcp", "", proxyIP+"/32", publishedPort, "", "ACCEPT")
+	return applyRules(linkPortRules(APPEND, proxyIP, publishedPort, targetPort))
+}
 
+// RemoveLinkPort deletes the rules added by NewLinkPort
+func RemoveLinkPort(proxyIP string, publishedPort, targetPort int) error {
+	return applyRules(linkPortRules(DELETE, proxyIP, publishedPort, targetPort))
+}
+
+func applyRules(rules []string) error {
 	for _, rule := range rules {
 		parts := strings.Fields(rule)
 		head := parts[0]
@@ -36,7 +53,6 @@ func NewLinkPort(proxyIP string, publishedPort, targetPort int) error {
 	}
 
 	return nil
-
 }
 
 func createRule(tableName, chainName, mustOutputInterface string, action IPTableAction, protocol, source, destination string, destinationPort int, natDestination, jump string) string {
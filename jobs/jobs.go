@@ -0,0 +1,118 @@
+package jobs
+
+import (
+	"errors"
+	"kinetik-server/data"
+	"kinetik-server/logger"
+	"kinetik-server/models"
+	"sync"
+	"time"
+)
+
+// ErrNoRollback is returned by a rollback func when there is nothing to roll
+// back, the job then simply fails
+var ErrNoRollback = errors.New("Nothing to roll back")
+
+// Tracker owns a running job and persists every change made to it
+type Tracker struct {
+	mu  sync.Mutex
+	job *models.Job
+}
+
+func New(jobType, stackName string) (*Tracker, error) {
+	job := models.NewJob(jobType, stackName)
+	if err := data.GetDB().SaveJob(job); err != nil {
+		return nil, err
+	}
+	return &Tracker{job: job}, nil
+}
+
+func (t *Tracker) ID() int {
+	return t.job.ID
+}
+
+// Update applies fn to the job then saves it
+func (t *Tracker) Update(fn func(job *models.Job)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	fn(t.job)
+	t.job.UpdatedAt = time.Now()
+
+	if err := data.GetDB().SaveJob(t.job); err != nil {
+		logger.ErrLog.Printf("Cannot save job %d : %s\n", t.job.ID, err.Error())
+	}
+}
+
+func (t *Tracker) Logf(format string, args ...interface{}) {
+	logger.StdLog.Printf("Job %d : "+format+"\n", append([]interface{}{t.job.ID}, args...)...)
+	t.Update(func(job *models.Job) {
+		job.Logf(format, args...)
+	})
+}
+
+// Run executes the job in the background. When run fails, rollback is called
+// if given and the job ends rolled back, or failed if the rollback fails too.
+func (t *Tracker) Run(run func(t *Tracker) error, rollback func(t *Tracker) error) {
+	go func() {
+		t.Update(func(job *models.Job) {
+			job.State = models.JobRunning
+		})
+
+		err := run(t)
+		if err == nil {
+			t.Logf("Done")
+			t.Update(func(job *models.Job) {
+				job.State = models.JobSucceeded
+			})
+			return
+		}
+
+		t.Logf("Failed : %s", err.Error())
+
+		if rollback == nil {
+			t.fail(err)
+			return
+		}
+
+		rbErr := rollback(t)
+		if rbErr == ErrNoRollback {
+			t.fail(err)
+			return
+		}
+		if rbErr != nil {
+			t.Logf("Rollback failed : %s", rbErr.Error())
+			t.fail(errors.New(err.Error() + " (rollback failed : " + rbErr.Error() + ")"))
+			return
+		}
+
+		t.Logf("Rolled back")
+		t.Update(func(job *models.Job) {
+			job.State = models.JobRolledBack
+			job.Error = err.Error()
+		})
+	}()
+}
+
+func (t *Tracker) fail(err error) {
+	t.Update(func(job *models.Job) {
+		job.State = models.JobFailed
+		job.Error = err.Error()
+	})
+}
+
+// FailInterrupted marks the jobs left unfinished by a previous run as failed
+func FailInterrupted() {
+	for _, job := range data.GetDB().GetJobs() {
+		if job.State.IsTerminal() {
+			continue
+		}
+		job.Logf("Interrupted by a server restart")
+		job.State = models.JobFailed
+		job.Error = "interrupted by a server restart"
+		job.UpdatedAt = time.Now()
+		if err := data.GetDB().SaveJob(job); err != nil {
+			logger.ErrLog.Printf("Cannot save job %d : %s\n", job.ID, err.Error())
+		}
+	}
+}
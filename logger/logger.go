@@ -8,8 +8,13 @@ import (
 var StdLog *log.Logger
 var ErrLog *log.Logger
 
+// LogPath returns the path of the file written by NewLogger(fileName)
+func LogPath(fileName string) string {
+	return "/var/log/" + fileName
+}
+
 func NewLogger(fileName string) *log.Logger {
-	logFile, _ := os.OpenFile("/var/log/"+fileName, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	logFile, _ := os.OpenFile(LogPath(fileName), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 	l := log.New(logFile, "", log.Ldate|log.Ltime)
 	return l
 }
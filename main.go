@@ -2,15 +2,27 @@ package main
 
 import (
 	"fmt"
+	"kinetik-server/autoscaler"
 	"kinetik-server/boltdb"
+	"kinetik-server/control"
 	"kinetik-server/data"
+	"kinetik-server/deploy"
 	"kinetik-server/docker"
+	"kinetik-server/handlers/cluster"
 	"kinetik-server/handlers/instances"
+	jobsHandlers "kinetik-server/handlers/jobs"
 	"kinetik-server/handlers/nodes"
 	"kinetik-server/handlers/services"
+	"kinetik-server/handlers/stacks"
+	"kinetik-server/jobs"
 	"kinetik-server/logger"
 	"kinetik-server/models"
 	"kinetik-server/models/internals"
+	"kinetik-server/nodestate"
+	"kinetik-server/pki"
+	"kinetik-server/rebalancer"
+	"kinetik-server/reconciler"
+	"kinetik-server/simulation"
 	"log"
 	"math/rand"
 	"net/http"
@@ -49,7 +61,14 @@ func main() {
 	}
 	service := &Service{srv}
 
-	service.Run()
+	status, err := service.Run()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, status, "\nError: ", err)
+		os.Exit(1)
+	}
+	if status != "" {
+		fmt.Println(status)
+	}
 
 }
 
@@ -90,7 +109,7 @@ func retry(attempts int, sleep time.Duration, fn func() (interface{}, error)) (r
 
 func (service *Service) Run() (string, error) {
 
-	usage := "Usage: kinetik-server install | remove | start | stop | status"
+	usage := "Usage: kinetik-server install | remove | start | stop | status | simulate"
 
 	// if received any kind of command, do it
 	if len(os.Args) > 1 {
@@ -106,6 +125,8 @@ func (service *Service) Run() (string, error) {
 			return service.Stop()
 		case "status":
 			return service.Status()
+		case "simulate":
+			return simulation.Run(os.Args[2:])
 		default:
 			return usage, nil
 		}
@@ -182,6 +203,22 @@ func (service *Service) Run() (string, error) {
 		stdlog.Printf("%#v\n", data.GetDB().GetConfig())
 	}
 
+	if err := pki.EnsureCA(); err != nil {
+		errlog.Println("Cannot set up the CA, nodes need their certificates from elsewhere : " + err.Error())
+	} else {
+		docker.UseCA(pki.CAFile, pki.ClientCertFile, pki.ClientKeyFile, pki.VerifyNotRevoked)
+	}
+
+	jobs.FailInterrupted()
+	control.ResumeProvisioning()
+	reconciler.Start(30 * time.Second)
+	reconciler.StartNodeMonitor(10 * time.Second)
+	nodestate.Start(10 * time.Second)
+	autoscaler.Start(15 * time.Second)
+	autoscaler.StartCluster(30 * time.Second)
+	rebalancer.Start(5 * time.Minute)
+	deploy.StartCertRotation(time.Hour)
+
 	router := mux.NewRouter()
 	ConfigureRouter(router)
 
@@ -213,16 +250,47 @@ func ConfigureRouter(router *mux.Router) {
 	router.HandleFunc("/services", services.GetServices).Methods("GET")
 	router.HandleFunc("/services", services.AddService).Methods("POST")
 
+	router.HandleFunc("/services/plan", services.PlanStack).Methods("POST")
+	router.HandleFunc("/services/{stack}", services.UpdateStack).Methods("PUT")
 	router.HandleFunc("/services/{stack}/{service}", services.DeleteService).Methods("DELETE")
+	router.HandleFunc("/services/{stack}/{service}/revisions", services.GetRevisions).Methods("GET")
+	router.HandleFunc("/services/{stack}/{service}/rollback", services.RollbackService).Methods("POST")
+	router.HandleFunc("/services/{stack}/{service}/autoscale", services.SetAutoscale).Methods("PUT")
+	router.HandleFunc("/services/{stack}/{service}/autoscale", services.DeleteAutoscale).Methods("DELETE")
+	router.HandleFunc("/services/{stack}/{service}/autoscale/history", services.GetScalingHistory).Methods("GET")
 	router.HandleFunc("/services/{stack}/{service}/scale/up", services.ScaleUp).Methods("POST")
 	router.HandleFunc("/services/{stack}/{service}/scale/down", services.ScaleDown).Methods("POST")
 
+	router.HandleFunc("/stacks", stacks.GetStacks).Methods("GET")
+	router.HandleFunc("/stacks/{stack}", stacks.GetStack).Methods("GET")
+	router.HandleFunc("/stacks/{stack}", stacks.DeleteStack).Methods("DELETE")
+	router.HandleFunc("/stacks/{stack}/stop", stacks.StopStack).Methods("POST")
+	router.HandleFunc("/stacks/{stack}/start", stacks.StartStack).Methods("POST")
+	router.HandleFunc("/stacks/{stack}/policy", stacks.SetStackPolicy).Methods("PUT")
+
 	router.HandleFunc("/nodes", nodes.GetNodes).Methods("GET")
 	router.HandleFunc("/nodes", nodes.CreateNode).Methods("POST")
 	router.HandleFunc("/nodes/docker", nodes.StartDocker).Methods("POST")
 	router.HandleFunc("/nodes/{id}", nodes.UpdateNode).Methods("POST")
+	router.HandleFunc("/nodes/{id}", nodes.GetNode).Methods("GET")
+	router.HandleFunc("/nodes/{id}", nodes.DeleteNode).Methods("DELETE")
+	router.HandleFunc("/nodes/{id}/labels", nodes.SetLabels).Methods("PUT")
+	router.HandleFunc("/nodes/{id}/log", nodes.GetNodeLog).Methods("GET")
+	router.HandleFunc("/nodes/{id}/cordon", nodes.CordonNode).Methods("POST")
+	router.HandleFunc("/nodes/{id}/uncordon", nodes.UncordonNode).Methods("POST")
+	router.HandleFunc("/nodes/{id}/drain", nodes.DrainNode).Methods("POST")
+	router.HandleFunc("/nodes/{id}/certs/rotate", nodes.RotateCerts).Methods("POST")
+	router.HandleFunc("/nodes/{id}/certs/revoke", nodes.RevokeCerts).Methods("POST")
+
+	router.HandleFunc("/cluster/autoscaler", cluster.GetAutoscaler).Methods("GET")
+	router.HandleFunc("/cluster/nodes", cluster.GetNodeStates).Methods("GET")
+	router.HandleFunc("/cluster/rebalancer", cluster.GetRebalancer).Methods("GET")
+
+	router.HandleFunc("/jobs", jobsHandlers.GetJobs).Methods("GET")
+	router.HandleFunc("/jobs/{id}", jobsHandlers.GetJob).Methods("GET")
 
 	router.HandleFunc("/instances", instances.GetInstances).Methods("GET")
 	router.HandleFunc("/instances/{id}", instances.DeleteInstance).Methods("DELETE")
 	router.HandleFunc("/instances/{id}", instances.UpdateMetrics).Methods("PUT")
+	router.HandleFunc("/instances/{id}/placement", instances.GetPlacement).Methods("GET")
 }
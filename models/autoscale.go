@@ -0,0 +1,84 @@
+package models
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	ScaleUp   = "scale_up"
+	ScaleDown = "scale_down"
+)
+
+// AutoscalePolicy scales a service between MinReplicas and MaxReplicas from
+// the metrics its instances report. The worst state among the descriptors
+// decides : CRITICAL scales up, WARN holds and OK scales down.
+type AutoscalePolicy struct {
+	MinReplicas uint64              `json:"min_replicas"`
+	MaxReplicas uint64              `json:"max_replicas"`
+	Cooldown    int                 `json:"cooldown"` // Seconds to wait after a scaling
+	Metrics     []*MetricDescriptor `json:"metrics"`
+}
+
+func (p *AutoscalePolicy) Validate() error {
+	if p.MaxReplicas == 0 || p.MinReplicas > p.MaxReplicas {
+		return errors.New("min_replicas must not exceed max_replicas, which must be positive")
+	}
+	if p.Cooldown < 0 {
+		return errors.New("cooldown must not be negative")
+	}
+	if len(p.Metrics) == 0 {
+		return errors.New("At least one metric is needed")
+	}
+	for _, metric := range p.Metrics {
+		if metric == nil || metric.Name == "" {
+			return errors.New("Every metric needs a name")
+		}
+		for _, bp := range metric.Breakpoints {
+			if bp == nil || bp.Value == nil || bp.State == nil {
+				return errors.New("Breakpoints of " + metric.Name + " need a value and a state")
+			}
+			if *bp.State != Ok && *bp.State != Warn && *bp.State != Critical {
+				return errors.New("Breakpoints of " + metric.Name + " must be OK, WARN or CRITICAL")
+			}
+		}
+	}
+	return nil
+}
+
+type ScalingDecision struct {
+	ID        int                `json:"id"`
+	Action    string             `json:"action"`
+	State     *StateValue        `json:"state"`
+	From      uint64             `json:"from"`
+	To        uint64             `json:"to"`
+	Metrics   map[string]float32 `json:"metrics"` // Average value of each metric
+	Error     string             `json:"error,omitempty"`
+	CreatedAt time.Time          `json:"created_at"`
+}
+
+// ClusterPolicy keeps between MinNodes and MaxNodes nodes. A node of NodeSize
+// is added when replicas which could run on it stay pending ScaleUpAfter
+// seconds, and a node the autoscaler added is drained and removed once its
+// usage stays below ScaleDownUtilization ScaleDownAfter seconds. NodeCPUs and
+// NodeMemoryBytes, the capacity of a node of NodeSize, are taken from a node
+// of that size when not given.
+type ClusterPolicy struct {
+	MinNodes             int     `json:"min_nodes"`
+	MaxNodes             int     `json:"max_nodes"` // 0 disables the cluster autoscaler
+	NodeSize             string  `json:"node_size,omitempty"`
+	NodeRegion           string  `json:"node_region,omitempty"`
+	NodeCPUs             int     `json:"node_cpus,omitempty"`
+	NodeMemoryBytes      int     `json:"node_memory_bytes,omitempty"`
+	ScaleUpAfter         int     `json:"scale_up_after"`
+	ScaleDownAfter       int     `json:"scale_down_after"`
+	ScaleDownUtilization float64 `json:"scale_down_utilization"` // Between 0 and 1
+}
+
+// ClusterStatus is what the cluster autoscaler sees
+type ClusterStatus struct {
+	Policy  *ClusterPolicy     `json:"policy"`
+	Nodes   int                `json:"nodes"`
+	Failed  int                `json:"failed"` // Added nodes which failed to provision
+	Pending []*PendingReplicas `json:"pending"`
+}
@@ -3,4 +3,8 @@ package models
 type Instance struct {
 	ContainerID string
 	NodeID      string // This is the IP
+	IP          string // IP on the mikroverlay network
+	Revision    int    // Revision of the service the container runs
+
+	Release func() `json:"-"` // Ends the claim of its placement, see deploy.ReleaseClaims
 }
@@ -0,0 +1,128 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	JobCreateStack     = "create_stack"
+	JobUpdateStack     = "update_stack"
+	JobRollbackService = "rollback_service"
+	JobDeleteStack     = "delete_stack"
+	JobStopStack       = "stop_stack"
+	JobStartStack      = "start_stack"
+	JobDrainNode       = "drain_node"
+	JobDeleteNode      = "delete_node"
+	JobProvisionNode   = "provision_node"
+	JobRotateCert      = "rotate_cert"
+	JobRebalance       = "rebalance"
+)
+
+type JobState string
+
+const (
+	JobPending    JobState = "pending"
+	JobRunning    JobState = "running"
+	JobSucceeded  JobState = "succeeded"
+	JobFailed     JobState = "failed"
+	JobRolledBack JobState = "rolled_back"
+)
+
+func (s JobState) IsTerminal() bool {
+	return s == JobSucceeded || s == JobFailed || s == JobRolledBack
+}
+
+type ReplicaState string
+
+const (
+	ReplicaPending  ReplicaState = "pending"
+	ReplicaRunning  ReplicaState = "running"
+	ReplicaFailed   ReplicaState = "failed"
+	ReplicaRemoved  ReplicaState = "removed"
+	ReplicaMigrated ReplicaState = "migrated"
+	ReplicaQueued   ReplicaState = "queued" // Waiting for a node with room
+)
+
+type ReplicaProgress struct {
+	Index       int          `json:"index"`
+	State       ReplicaState `json:"state"`
+	ContainerID string       `json:"container_id,omitempty"`
+	NodeID      string       `json:"node_id,omitempty"`
+	Error       string       `json:"error,omitempty"`
+	ReplacedBy  string       `json:"replaced_by,omitempty"` // Container started in place of this one
+	MovedTo     string       `json:"moved_to,omitempty"`    // Node of that container
+}
+
+type ServiceProgress struct {
+	ServiceName string             `json:"service_name"`
+	State       JobState           `json:"state"`
+	Replicas    []*ReplicaProgress `json:"replicas"`
+}
+
+type JobLog struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+type Job struct {
+	ID        int                `json:"id"`
+	Type      string             `json:"type"`
+	StackName string             `json:"stack_name"`
+	NodeID    string             `json:"node_id,omitempty"`
+	State     JobState           `json:"state"`
+	Error     string             `json:"error,omitempty"`
+	Services  []*ServiceProgress `json:"services"`
+	Logs      []*JobLog          `json:"logs"`
+	CreatedAt time.Time          `json:"created_at"`
+	UpdatedAt time.Time          `json:"updated_at"`
+}
+
+func NewJob(jobType, stackName string) *Job {
+	now := time.Now()
+	return &Job{
+		Type:      jobType,
+		StackName: stackName,
+		State:     JobPending,
+		Services:  make([]*ServiceProgress, 0),
+		Logs:      make([]*JobLog, 0),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+}
+
+func (j *Job) Logf(format string, args ...interface{}) {
+	j.Logs = append(j.Logs, &JobLog{
+		Time:    time.Now(),
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func (j *Job) Service(serviceName string) *ServiceProgress {
+	for _, srv := range j.Services {
+		if srv.ServiceName == serviceName {
+			return srv
+		}
+	}
+	srv := &ServiceProgress{
+		ServiceName: serviceName,
+		State:       JobPending,
+		Replicas:    make([]*ReplicaProgress, 0),
+	}
+	j.Services = append(j.Services, srv)
+	return srv
+}
+
+func (s *ServiceProgress) Replica(index int) *ReplicaProgress {
+	for _, rep := range s.Replicas {
+		if rep.Index == index {
+			return rep
+		}
+	}
+	rep := &ReplicaProgress{
+		Index: index,
+		State: ReplicaPending,
+	}
+	s.Replicas = append(s.Replicas, rep)
+	return rep
+}
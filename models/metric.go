@@ -14,3 +14,20 @@ type MetricValue struct {
 	Name  string   `json:"name,omitempty"`
 	Value *float32 `json:"value,omitempty"`
 }
+
+// Evaluate returns the state of the highest breakpoint reached by the value,
+// OK when none is reached
+func (d *MetricDescriptor) Evaluate(value float32) StateValue {
+	state := Ok
+	var reached *float32
+	for _, bp := range d.Breakpoints {
+		if bp.Value == nil || bp.State == nil || value < *bp.Value {
+			continue
+		}
+		if reached == nil || *bp.Value > *reached {
+			reached = bp.Value
+			state = *bp.State
+		}
+	}
+	return state
+}
@@ -0,0 +1,42 @@
+package models
+
+import "testing"
+
+func breakpoint(state StateValue, value float32) *MetricBreakpoint {
+	return &MetricBreakpoint{State: &state, Value: &value}
+}
+
+func TestMetricDescriptorEvaluate(t *testing.T) {
+	cpu := &MetricDescriptor{
+		Name: "cpu",
+		Breakpoints: []*MetricBreakpoint{
+			breakpoint(Critical, 90),
+			breakpoint(Warn, 70),
+			{State: nil}, // Incomplete, ignored
+		},
+	}
+
+	tests := []struct {
+		name       string
+		descriptor *MetricDescriptor
+		value      float32
+		want       StateValue
+	}{
+		{"below every breakpoint", cpu, 50, Ok},
+		{"on a breakpoint", cpu, 70, Warn},
+		{"between breakpoints", cpu, 80, Warn},
+		{"highest breakpoint wins whatever the order", cpu, 95, Critical},
+		{"no breakpoint", &MetricDescriptor{Name: "empty"}, 100, Ok},
+		{"breakpoint back to OK", &MetricDescriptor{
+			Breakpoints: []*MetricBreakpoint{breakpoint(Warn, 10), breakpoint(Ok, 20)},
+		}, 30, Ok},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.descriptor.Evaluate(test.value); got != test.want {
+				t.Errorf("Evaluate(%v) = %s, want %s", test.value, got.String(), test.want.String())
+			}
+		})
+	}
+}
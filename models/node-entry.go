@@ -0,0 +1,53 @@
+package models
+
+import "time"
+
+// Provisioning phases of a node
+const (
+	PhaseCreating      = "creating"
+	PhaseConfiguring   = "configuring"
+	PhaseAwaitingCerts = "awaiting-certs"
+	PhaseReady         = "ready"
+	PhaseFailed        = "failed"
+)
+
+// NodeEntry is the inventory record of a node, kept from the creation of its
+// machine until the node is deleted. The usage figures reported by the node
+// live in Node, keyed by PublicIP.
+type NodeEntry struct {
+	Name      string            `json:"name"`
+	Provider  string            `json:"provider,omitempty"`
+	MachineID string            `json:"machine_id,omitempty"`
+	PublicIP  string            `json:"public_ip,omitempty"`
+	OverlayIP string            `json:"overlay_ip,omitempty"`
+	SSHUser   string            `json:"ssh_user,omitempty"`
+	SSHPort   int               `json:"ssh_port,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+	Phase     string            `json:"phase"`
+	Step      string            `json:"step,omitempty"` // Provisioning step in progress
+	Error     string            `json:"error,omitempty"`
+	Size      string            `json:"size,omitempty"`
+	Region    string            `json:"region,omitempty"`
+	Labels    map[string]string `json:"labels"`
+
+	CertSerial    string    `json:"cert_serial,omitempty"` // Certificate served by its Docker daemon
+	CertExpiresAt time.Time `json:"cert_expires_at,omitempty"`
+
+	Node *Node `json:"node,omitempty"` // Last report, filled when listing
+}
+
+func NewNodeEntry(name, provider string) *NodeEntry {
+	return &NodeEntry{
+		Name:      name,
+		Provider:  provider,
+		CreatedAt: time.Now(),
+		Phase:     PhaseCreating,
+		Labels:    make(map[string]string),
+	}
+}
+
+// IsProvisioning tells whether the machine of the node is still being set up.
+// Nodes awaiting certificates without a step wait for POST /nodes/docker.
+func (e *NodeEntry) IsProvisioning() bool {
+	return e.Phase == PhaseCreating || e.Phase == PhaseConfiguring || (e.Phase == PhaseAwaitingCerts && e.Step != "")
+}
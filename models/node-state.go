@@ -0,0 +1,15 @@
+package models
+
+import "time"
+
+// NodeState is the running containers of a node, as known without asking it,
+// kept up to date by its reports and its Docker events. Its health and
+// reservations are those of Node and the scheduler.
+type NodeState struct {
+	NodeIP     string    `json:"node_ip"`
+	Containers int       `json:"containers"` // Running containers
+	LastSeen   time.Time `json:"last_seen"`  // Last report of the node
+	SyncedAt   time.Time `json:"synced_at"`  // Last time its containers were listed or reported
+	Watching   bool      `json:"watching"`   // Its Docker events are being streamed
+	Fresh      bool      `json:"fresh"`      // Containers is known to be accurate enough
+}
@@ -1,6 +1,8 @@
 package models
 
 import (
+	"time"
+
 	"github.com/docker/cli/cli/compose/types"
 	"github.com/shirou/gopsutil/disk"
 	"github.com/shirou/gopsutil/load"
@@ -8,11 +10,53 @@ import (
 
 type Node struct {
 	*load.AvgStat
-	MemUsedPercent float64         `json:"mem_used_percent,omitempty"`
+	MemUsedPercent float64         `json:"mem_used_percent,omitempty"` // Between 0 and 1
 	MemUsedBytes   uint64          `json:"mem_used_bytes,omitempty"`
 	CPUUsedPercent float64         `json:"cpu_used_percent,omitempty"`
 	CPUCount       int             `json:"cpu_count,omitempty"`
 	DiskUsage      *disk.UsageStat `json:"disk_usage,omitempty"`
 
 	Reservations *types.Resource
+
+	LastSeen time.Time   `json:"last_seen"`
+	State    *StateValue `json:"state,omitempty"`
+	Cordoned bool        `json:"cordoned"` // Cordoned nodes get no new instance
+
+	OverlayIP string `json:"overlay_ip,omitempty"` // Reported by the node, copied to its NodeEntry
+
+	Containers *int `json:"containers,omitempty"` // Running containers, when the node reports them
+}
+
+// UpdateStats copies the usage figures of a report sent by the node
+func (n *Node) UpdateStats(report *Node) {
+	n.AvgStat = report.AvgStat
+	n.MemUsedPercent = report.MemUsedPercent
+	n.MemUsedBytes = report.MemUsedBytes
+	n.CPUUsedPercent = report.CPUUsedPercent
+	n.CPUCount = report.CPUCount
+	n.DiskUsage = report.DiskUsage
+	n.OverlayIP = report.OverlayIP
+	n.Containers = report.Containers
+}
+
+// States of a node, driven by its heartbeat
+const (
+	NodeReady   = Ok
+	NodeSuspect = Warn
+	NodeDown    = Down
+)
+
+// IsReady tells whether new instances may be scheduled on the node. Nodes
+// that never reported a state are considered ready.
+func (n *Node) IsReady() bool {
+	return n.State == nil || *n.State == NodeReady
+}
+
+// IsSchedulable tells whether the scheduler may place new instances on the node
+func (n *Node) IsSchedulable() bool {
+	return n.IsReady() && !n.Cordoned
+}
+
+func (n *Node) SetState(state StateValue) {
+	n.State = &state
 }
@@ -0,0 +1,16 @@
+package models
+
+import (
+	"time"
+
+	"github.com/docker/cli/cli/compose/types"
+)
+
+// PendingReplicas are replicas of a service no node can host yet. They are
+// started as soon as a node has room for them.
+type PendingReplicas struct {
+	Service   string          `json:"service"`
+	Count     int             `json:"count"`
+	Resources *types.Resource `json:"resources,omitempty"` // Reservations of each replica
+	Since     time.Time       `json:"since"`
+}
@@ -0,0 +1,72 @@
+package models
+
+import "time"
+
+// Filters that can reject a node when placing a replica
+const (
+	RejectNotReady     = "not_ready"
+	RejectCordoned     = "cordoned"
+	RejectConstraints  = "constraints"
+	RejectAntiAffinity = "anti_affinity"
+	RejectAffinity     = "affinity"
+	RejectCPU          = "cpu"
+	RejectMemory       = "memory"
+	RejectExcluded     = "excluded" // Not among the nodes the replica was restricted to
+)
+
+// PlacementCandidate is a node considered for a replica. Nodes that passed
+// every filter have a score.
+type PlacementCandidate struct {
+	NodeIP   string   `json:"node_ip"`
+	Rejected string   `json:"rejected,omitempty"` // Filter that rejected the node
+	Detail   string   `json:"detail,omitempty"`
+	Spread   []int    `json:"spread,omitempty"` // Instances in its domain for each spread preference
+	Score    *float64 `json:"score,omitempty"`
+}
+
+// PlacementDecision records why the scheduler placed a replica where it did
+type PlacementDecision struct {
+	Service     string                `json:"service"`
+	ContainerID string                `json:"container_id,omitempty"`
+	Scheduler   string                `json:"scheduler"`
+	Strategy    string                `json:"strategy,omitempty"`
+	NodeIP      string                `json:"node_ip"` // Empty when no node has room
+	Candidates  []*PlacementCandidate `json:"candidates"`
+	Preempted   []string              `json:"preempted,omitempty"` // Containers evicted to make room
+	Error       string                `json:"error,omitempty"`
+	CreatedAt   time.Time             `json:"created_at"`
+
+	Release func() `json:"-"` // Ends the claim on the reservations of the node, if any
+}
+
+func NewPlacementDecision(service, scheduler string) *PlacementDecision {
+	return &PlacementDecision{
+		Service:    service,
+		Scheduler:  scheduler,
+		Candidates: make([]*PlacementCandidate, 0),
+		CreatedAt:  time.Now(),
+	}
+}
+
+// Candidate returns the record of the node, added if needed
+func (d *PlacementDecision) Candidate(nodeIP string) *PlacementCandidate {
+	for _, c := range d.Candidates {
+		if c.NodeIP == nodeIP {
+			return c
+		}
+	}
+	c := &PlacementCandidate{NodeIP: nodeIP}
+	d.Candidates = append(d.Candidates, c)
+	return c
+}
+
+// Reject records the filter that rejected the node. A nil decision records
+// nothing.
+func (d *PlacementDecision) Reject(nodeIP, filter, detail string) {
+	if d == nil {
+		return
+	}
+	c := d.Candidate(nodeIP)
+	c.Rejected = filter
+	c.Detail = detail
+}
@@ -0,0 +1,34 @@
+package models
+
+const (
+	PlanCreate    = "create"
+	PlanUpdate    = "update"
+	PlanScale     = "scale"
+	PlanUnchanged = "unchanged"
+	PlanRemove    = "remove"
+)
+
+type PortPlan struct {
+	Published     uint32   `json:"published"`
+	Target        uint32   `json:"target"`
+	AlreadyLinked bool     `json:"already_linked"`
+	Rules         []string `json:"iptables_rules,omitempty"`
+}
+
+type ServicePlan struct {
+	ServiceName     string      `json:"service_name"`
+	Action          string      `json:"action"`
+	Replicas        uint64      `json:"replicas"`
+	CurrentReplicas uint64      `json:"current_replicas"`
+	Placements      []string    `json:"placements"`
+	Unschedulable   int         `json:"unschedulable"`
+	Ports           []*PortPlan `json:"ports"`
+	IgnoredKeys     []string    `json:"ignored_keys"`
+}
+
+// DeployPlan describes what deploying a compose file would do
+type DeployPlan struct {
+	StackName string         `json:"stack_name"`
+	Order     []string       `json:"order"`
+	Services  []*ServicePlan `json:"services"`
+}
@@ -0,0 +1,33 @@
+package models
+
+import "time"
+
+// RebalancePolicy moves instances from the most loaded node to the least
+// loaded one while their gap exceeds Threshold, at most MaxMoves per pass and
+// only within Window
+type RebalancePolicy struct {
+	Enabled          bool    `json:"enabled"`
+	Threshold        float64 `json:"threshold"`         // Between 0 and 1
+	DisruptionBudget int     `json:"disruption_budget"` // Instances moved per service and pass, unless the service sets its own
+	MaxMoves         int     `json:"max_moves"`
+	Window           string  `json:"window,omitempty"` // HH:MM-HH:MM in the local time of the server, any time if empty
+}
+
+// RebalanceMove moves an instance from a node to another
+type RebalanceMove struct {
+	Service     string `json:"service"`
+	ContainerID string `json:"container_id"`
+	From        string `json:"from"`
+	To          string `json:"to"`
+}
+
+// RebalanceStatus is what the rebalancer saw on its last pass
+type RebalanceStatus struct {
+	Policy    *RebalancePolicy `json:"policy"`
+	Metric    string           `json:"metric,omitempty"` // reservations or containers, the one out of balance
+	Gap       float64          `json:"gap"`
+	InWindow  bool             `json:"in_window"`
+	Moves     []*RebalanceMove `json:"moves"`
+	JobID     int              `json:"job_id,omitempty"`
+	CheckedAt time.Time        `json:"checked_at"`
+}
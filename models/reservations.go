@@ -0,0 +1,63 @@
+package models
+
+import (
+	"strconv"
+
+	"github.com/docker/cli/cli/compose/types"
+)
+
+// AddResources returns the sum of both reservations. nil counts as nothing.
+func AddResources(a, b *types.Resource) *types.Resource {
+	sum := &types.Resource{}
+	for _, res := range []*types.Resource{a, b} {
+		if res == nil {
+			continue
+		}
+		sumCPU, _ := strconv.ParseFloat(sum.NanoCPUs, 64)
+		resCPU, _ := strconv.ParseFloat(res.NanoCPUs, 64)
+		sum.NanoCPUs = strconv.FormatFloat(sumCPU+resCPU, 'f', -1, 64)
+		sum.MemoryBytes += res.MemoryBytes
+	}
+	return sum
+}
+
+// ComputeReservations sums, by node IP, the reservations of the instances of
+// the services. Every instance reserves the constraints of its service.
+func ComputeReservations(services []*Service) map[string]*types.Resource {
+	reservations := make(map[string]*types.Resource)
+	for _, srv := range services {
+		for _, inst := range srv.Instances {
+			reservations[inst.NodeID] = AddResources(reservations[inst.NodeID], srv.Constraints)
+		}
+	}
+	return reservations
+}
+
+// SubtractResources returns a minus b, never below nothing. nil counts as
+// nothing.
+func SubtractResources(a, b *types.Resource) *types.Resource {
+	diff := AddResources(a, nil)
+	if b == nil {
+		return diff
+	}
+	diffCPU, _ := strconv.ParseFloat(diff.NanoCPUs, 64)
+	resCPU, _ := strconv.ParseFloat(b.NanoCPUs, 64)
+	if diffCPU -= resCPU; diffCPU < 0 {
+		diffCPU = 0
+	}
+	diff.NanoCPUs = strconv.FormatFloat(diffCPU, 'f', -1, 64)
+	if diff.MemoryBytes > b.MemoryBytes {
+		diff.MemoryBytes -= b.MemoryBytes
+	} else {
+		diff.MemoryBytes = 0
+	}
+	return diff
+}
+
+// ResourceLimits caps what each container of a service may use. Zero values
+// mean no limit.
+type ResourceLimits struct {
+	NanoCPUs    string `json:"cpus,omitempty"`
+	MemoryBytes int64  `json:"memory,omitempty"`
+	Pids        int64  `json:"pids,omitempty"`
+}
@@ -0,0 +1,65 @@
+package models
+
+import (
+	"time"
+
+	composeTypes "github.com/docker/cli/cli/compose/types"
+	"github.com/docker/docker/api/types"
+)
+
+// ServiceRevision is a snapshot of the spec of a service, taken every time
+// its instances have to be replaced
+type ServiceRevision struct {
+	Revision         int
+	CreatedAt        time.Time
+	ContainerConfig  *types.ContainerCreateConfig
+	Constraints      *composeTypes.Resource
+	Limits           *ResourceLimits `json:",omitempty"`
+	Ports            []composeTypes.ServicePortConfig
+	Replicas         uint64
+	UpdateConfig     *composeTypes.UpdateConfig
+	Placement        *composeTypes.Placement `json:",omitempty"`
+	Strategy         string                  `json:",omitempty"`
+	AntiAffinity     string                  `json:",omitempty"`
+	Affinity         []string                `json:",omitempty"`
+	Priority         int                     `json:",omitempty"`
+	DisruptionBudget *int                    `json:",omitempty"`
+}
+
+func NewServiceRevision(srv *Service) *ServiceRevision {
+	return &ServiceRevision{
+		Revision:         srv.Revision,
+		CreatedAt:        time.Now(),
+		ContainerConfig:  srv.ContainerConfig,
+		Constraints:      srv.Constraints,
+		Limits:           srv.Limits,
+		Ports:            srv.Ports,
+		Replicas:         srv.Replicas,
+		UpdateConfig:     srv.UpdateConfig,
+		Placement:        srv.Placement,
+		Strategy:         srv.Strategy,
+		AntiAffinity:     srv.AntiAffinity,
+		Affinity:         srv.Affinity,
+		Priority:         srv.Priority,
+		DisruptionBudget: srv.DisruptionBudget,
+	}
+}
+
+// Apply returns a copy of the service running this revision
+func (r *ServiceRevision) Apply(srv *Service) *Service {
+	applied := *srv
+	applied.Revision = r.Revision
+	applied.ContainerConfig = r.ContainerConfig
+	applied.Constraints = r.Constraints
+	applied.Limits = r.Limits
+	applied.Ports = r.Ports
+	applied.Replicas = r.Replicas
+	applied.UpdateConfig = r.UpdateConfig
+	applied.Placement = r.Placement
+	applied.Strategy = r.Strategy
+	applied.AntiAffinity = r.AntiAffinity
+	applied.Affinity = r.Affinity
+	applied.Priority = r.Priority
+	applied.DisruptionBudget = r.DisruptionBudget
+	return &applied
+}
@@ -6,12 +6,25 @@ import (
 )
 
 type Service struct {
-	StackName       string
-	ServiceName     string
-	ContainerConfig *types.ContainerCreateConfig
-	Instances       []*Instance
-	Constraints     *composeTypes.Resource
-	Ports           []composeTypes.ServicePortConfig
+	StackName        string
+	ServiceName      string
+	ContainerConfig  *types.ContainerCreateConfig
+	Instances        []*Instance
+	Constraints      *composeTypes.Resource
+	Limits           *ResourceLimits `json:",omitempty"`
+	Ports            []composeTypes.ServicePortConfig
+	Replicas         uint64 // Desired number of running instances
+	UpdateConfig     *composeTypes.UpdateConfig
+	Revision         int // Revision of the spec above, see ServiceRevision
+	DependsOn        []string
+	Stopped          bool // Stopped services keep their config but run no instance
+	Autoscale        *AutoscalePolicy
+	Strategy         string                  `json:",omitempty"` // Scheduling strategy, empty for the default one
+	Placement        *composeTypes.Placement `json:",omitempty"`
+	AntiAffinity     string                  `json:",omitempty"` // Topology key replicas must not share
+	Affinity         []string                `json:",omitempty"` // Services of the stack replicas must run next to
+	Priority         int                     `json:",omitempty"` // Higher priorities may evict lower ones to get room
+	DisruptionBudget *int                    `json:",omitempty"` // Instances the rebalancer may move per pass, its default if nil
 }
 
 func NewService(stackName, serviceName string, cntConfig *types.ContainerCreateConfig) *Service {
@@ -30,3 +43,14 @@ func (s *Service) AddInstance(instance *Instance) {
 func (s *Service) GetInstances() []*Instance {
 	return s.Instances
 }
+
+func (s *Service) DesiredReplicas() uint64 {
+	if s.Stopped {
+		return 0
+	}
+	return s.Replicas
+}
+
+func (s *Service) Identifier() string {
+	return s.StackName + "/" + s.ServiceName
+}
@@ -0,0 +1,20 @@
+package models
+
+type Stack struct {
+	Name      string
+	Stopped   bool
+	Instances int
+	Services  []*Service
+	Policy    *StackPolicy
+}
+
+// StackPolicy holds the settings of a stack which are not in its compose file
+type StackPolicy struct {
+	Preemptible bool `json:"preemptible"` // Instances may be evicted for services of higher priority
+}
+
+func DefaultStackPolicy() *StackPolicy {
+	return &StackPolicy{
+		Preemptible: true,
+	}
+}
@@ -3,7 +3,6 @@ package models
 import (
 	"bytes"
 	"encoding/json"
-	"fmt"
 )
 
 type StateValue int
@@ -41,12 +40,10 @@ func (s StateValue) String() string {
 		"DOWN",
 		"UNKNOWN",
 	}
-	fmt.Printf("%d, %s\n", int(s), names[int(s)])
 	return names[int(s)]
 }
 
 func (s *StateValue) MarshalJSON() ([]byte, error) {
-	fmt.Println("Calling MarshalJSON")
 	buffer := bytes.NewBufferString(`"`)
 	buffer.WriteString(s.String())
 	buffer.WriteString(`"`)
@@ -0,0 +1,8 @@
+package v2
+
+type NodeCreationRequest struct {
+	Name   string // Random when omitted
+	Size   string // Provider default when omitted
+	Region string // Provider default when omitted
+	Labels map[string]string
+}
@@ -4,3 +4,7 @@ type ServiceCreationRequest struct {
 	StackName            string
 	DockerComposeContent string
 }
+
+type RollbackRequest struct {
+	Revision int // Previous revision when omitted
+}
@@ -0,0 +1,234 @@
+package nodestate
+
+import (
+	"context"
+	"kinetik-server/data"
+	"kinetik-server/docker"
+	"kinetik-server/logger"
+	"kinetik-server/models"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MaxStaleness bounds the age of the container count of a node whose Docker
+// events are not streamed. Older counts are not fresh anymore until the node
+// is listed again. Set by NODE_STATE_MAX_STALENESS.
+var MaxStaleness = 30 * time.Second
+
+// A lost event stream is opened again after retryAfter
+var retryAfter = 5 * time.Second
+
+type entry struct {
+	state   models.NodeState
+	running map[string]bool // Nil while the count comes from a report
+	cancel  context.CancelFunc
+}
+
+var mu sync.Mutex
+var entries = make(map[string]*entry) // By node IP
+
+func durationFromEnv(name string, def time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(name))
+	if err != nil || value <= 0 {
+		return def
+	}
+	return value
+}
+
+// Start refreshes the cache every interval, forever. The interval should be
+// shorter than MaxStaleness.
+func Start(interval time.Duration) {
+	// The environment is complete only now
+	MaxStaleness = durationFromEnv("NODE_STATE_MAX_STALENESS", MaxStaleness)
+	go func() {
+		for {
+			Refresh()
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// Refresh streams the Docker events of the new nodes, lists the containers of
+// the nodes whose count is not fresh anymore and forgets the deleted ones
+func Refresh() {
+	nodes := data.GetDB().GetNodes()
+
+	stale := make([]string, 0)
+	mu.Lock()
+	for ip, node := range nodes {
+		e := get(ip)
+		e.state.LastSeen = node.LastSeen
+		if e.cancel == nil {
+			ctx, cancel := context.WithCancel(context.Background())
+			e.cancel = cancel
+			go watch(ctx, ip)
+		}
+		if !e.fresh() && !e.state.Watching {
+			stale = append(stale, ip)
+		}
+	}
+	for ip, e := range entries {
+		if _, ok := nodes[ip]; !ok {
+			// Entries created by a report have no watcher yet
+			if e.cancel != nil {
+				e.cancel()
+			}
+			delete(entries, ip)
+		}
+	}
+	mu.Unlock()
+
+	for _, ip := range stale {
+		if err := resync(ip); err != nil {
+			logger.ErrLog.Printf("Node state : cannot list containers of %s : %s\n", ip, err.Error())
+		}
+	}
+}
+
+// Report records a report sent by the node
+func Report(ip string, report *models.Node) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	e := get(ip)
+	e.state.LastSeen = time.Now()
+	// Events are more accurate than a report sent some time ago
+	if report.Containers != nil && !e.state.Watching {
+		e.running = nil
+		e.state.Containers = *report.Containers
+		e.state.SyncedAt = time.Now()
+	}
+}
+
+// Containers returns the running containers of the node, and whether the
+// count is fresh
+func Containers(ip string) (int, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	e, ok := entries[ip]
+	if !ok {
+		return 0, false
+	}
+	return e.state.Containers, e.fresh()
+}
+
+// Get returns the state of the node, nil if it is unknown
+func Get(ip string) *models.NodeState {
+	mu.Lock()
+	defer mu.Unlock()
+
+	e, ok := entries[ip]
+	if !ok {
+		return nil
+	}
+	return e.snapshot()
+}
+
+// States returns the state of every known node, by IP
+func States() []*models.NodeState {
+	mu.Lock()
+	defer mu.Unlock()
+
+	states := make([]*models.NodeState, 0, len(entries))
+	for _, e := range entries {
+		states = append(states, e.snapshot())
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].NodeIP < states[j].NodeIP
+	})
+	return states
+}
+
+// get returns the entry of the node, created if needed. mu must be held.
+func get(ip string) *entry {
+	e, ok := entries[ip]
+	if !ok {
+		e = &entry{state: models.NodeState{NodeIP: ip}}
+		entries[ip] = e
+	}
+	return e
+}
+
+func (e *entry) fresh() bool {
+	return e.state.Watching || (!e.state.SyncedAt.IsZero() && time.Since(e.state.SyncedAt) <= MaxStaleness)
+}
+
+func (e *entry) snapshot() *models.NodeState {
+	state := e.state
+	state.Fresh = e.fresh()
+	return &state
+}
+
+// watch streams the Docker events of the node until ctx is done, opening the
+// stream again when it fails
+func watch(ctx context.Context, ip string) {
+	for {
+		err := docker.WatchContainers(ctx, ip, func() {
+			if err := resync(ip); err != nil {
+				logger.ErrLog.Printf("Node state : cannot list containers of %s : %s\n", ip, err.Error())
+				return
+			}
+			setWatching(ip, true)
+		}, func(id string, running bool) {
+			event(ip, id, running)
+		})
+		setWatching(ip, false)
+		if ctx.Err() != nil {
+			return
+		}
+		logger.ErrLog.Printf("Node state : lost the Docker events of %s : %s\n", ip, err.Error())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryAfter):
+		}
+	}
+}
+
+// resync lists the running containers of the node
+func resync(ip string) error {
+	running, err := docker.GetRunningContainers(ip)
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if e, ok := entries[ip]; ok {
+		e.running = running
+		e.state.Containers = len(running)
+		e.state.SyncedAt = time.Now()
+	}
+	return nil
+}
+
+func setWatching(ip string, watching bool) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if e, ok := entries[ip]; ok {
+		e.state.Watching = watching && e.running != nil
+	}
+}
+
+func event(ip string, id string, running bool) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	e, ok := entries[ip]
+	if !ok || e.running == nil {
+		return
+	}
+	if running {
+		e.running[id] = true
+	} else {
+		delete(e.running, id)
+	}
+	e.state.Containers = len(e.running)
+	e.state.SyncedAt = time.Now()
+}
@@ -0,0 +1,197 @@
+package pki
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"kinetik-server/data"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Directory holding the CA of the cluster and the client certificate
+// kinetik-server uses to reach the Docker daemons of the nodes
+const Directory = "/etc/kinetik/ca"
+
+var (
+	CAFile         = filepath.Join(Directory, "ca.pem")
+	caKeyFile      = filepath.Join(Directory, "ca-key.pem")
+	ClientCertFile = filepath.Join(Directory, "client-cert.pem")
+	ClientKeyFile  = filepath.Join(Directory, "client-key.pem")
+)
+
+// NodeCertValidity is how long a node certificate is valid. It is rotated
+// deploy.RotateBefore, 30 days, before it expires.
+const NodeCertValidity = 365 * 24 * time.Hour
+
+var mu sync.Mutex
+
+// Issued is a certificate and its private key, PEM encoded
+type Issued struct {
+	CertPEM  []byte
+	KeyPEM   []byte
+	Serial   string
+	NotAfter time.Time
+}
+
+// EnsureCA generates the CA and the client certificate on first run
+func EnsureCA() error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, err := os.Stat(CAFile); os.IsNotExist(err) {
+		if err := os.MkdirAll(Directory, 0700); err != nil {
+			return err
+		}
+		if err := generateCA(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := os.Stat(ClientCertFile); os.IsNotExist(err) {
+		issued, err := issue(&x509.Certificate{
+			Subject:     pkix.Name{CommonName: "kinetik-server"},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, 10*NodeCertValidity)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(ClientKeyFile, issued.KeyPEM, 0600); err != nil {
+			return err
+		}
+		return ioutil.WriteFile(ClientCertFile, issued.CertPEM, 0644)
+	}
+
+	return nil
+}
+
+// HasCA tells whether the client certificate issued by our CA can be used
+func HasCA() bool {
+	_, err := os.Stat(ClientCertFile)
+	return err == nil
+}
+
+func CACertPEM() ([]byte, error) {
+	return ioutil.ReadFile(CAFile)
+}
+
+// IssueNodeCert issues the certificate the Docker daemon of a node serves,
+// valid for its name and IPs
+func IssueNodeCert(name string, ips []string) (*Issued, error) {
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		DNSNames:    []string{name, "localhost"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, ip := range ips {
+		if parsed := net.ParseIP(ip); parsed != nil {
+			template.IPAddresses = append(template.IPAddresses, parsed)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	return issue(template, NodeCertValidity)
+}
+
+// VerifyNotRevoked rejects a peer certificate we revoked. It is meant for
+// tls.Config.VerifyPeerCertificate, after the chain has been verified.
+func VerifyNotRevoked(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return nil
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+	if data.GetDB().IsCertRevoked(cert.SerialNumber.Text(16)) {
+		return errors.New("Certificate " + cert.SerialNumber.Text(16) + " of " + cert.Subject.CommonName + " is revoked")
+	}
+	return nil
+}
+
+func generateCA() error {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "kinetik CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(20 * NodeCertValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := ioutil.WriteFile(caKeyFile, keyPEM, 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(CAFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// issue signs the template with the CA, with a new key. mu must be held.
+func issue(template *x509.Certificate, validity time.Duration) (*Issued, error) {
+	ca, err := tls.LoadX509KeyPair(CAFile, caKeyFile)
+	if err != nil {
+		return nil, errors.New("Cannot load CA : " + err.Error())
+	}
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template.SerialNumber = serial
+	template.NotBefore = now.Add(-time.Hour)
+	template.NotAfter = now.Add(validity)
+	template.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, ca.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Issued{
+		CertPEM:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		KeyPEM:   pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}),
+		Serial:   serial.Text(16),
+		NotAfter: template.NotAfter,
+	}, nil
+}
+
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
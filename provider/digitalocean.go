@@ -0,0 +1,151 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"strconv"
+
+	"github.com/digitalocean/godo"
+	"golang.org/x/oauth2"
+)
+
+// DigitalOceanProvider runs machines as droplets of the docker image. It is
+// configured by DO_TOKEN, DO_REGION and DO_SIZE.
+type DigitalOceanProvider struct {
+	client *godo.Client
+	region string
+	size   string
+}
+
+func NewDigitalOceanProvider() *DigitalOceanProvider {
+	tSource := oauth2.StaticTokenSource(&oauth2.Token{
+		AccessToken: envOrDefault("DO_TOKEN", ""),
+	})
+	oauthClient := oauth2.NewClient(context.Background(), tSource)
+
+	return &DigitalOceanProvider{
+		client: godo.NewClient(oauthClient),
+		region: envOrDefault("DO_REGION", "ams3"),
+		size:   envOrDefault("DO_SIZE", "s-1vcpu-1gb"),
+	}
+}
+
+func (p *DigitalOceanProvider) Name() string {
+	return "digitalocean"
+}
+
+func (p *DigitalOceanProvider) CreateMachine(options *MachineOptions) (*Machine, error) {
+	fingerprint, err := sshFingerprint(SSHKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	createRequest := godo.DropletCreateRequest{
+		Name:   options.Name,
+		Size:   p.size,
+		Region: p.region,
+		Image: godo.DropletCreateImage{
+			Slug: "docker",
+		},
+		SSHKeys: []godo.DropletCreateSSHKey{godo.DropletCreateSSHKey{
+			Fingerprint: fingerprint,
+		}},
+	}
+	if options.Size != "" {
+		createRequest.Size = options.Size
+	}
+	if options.Region != "" {
+		createRequest.Region = options.Region
+	}
+
+	drop, raw, err := p.client.Droplets.Create(context.Background(), &createRequest)
+	if err != nil {
+		if raw != nil {
+			rawBody, _ := ioutil.ReadAll(raw.Body)
+			return nil, errors.New(err.Error() + " : " + string(rawBody))
+		}
+		return nil, err
+	}
+
+	return toMachine(drop), nil
+}
+
+func (p *DigitalOceanProvider) ListMachines() ([]*Machine, error) {
+	machines := make([]*Machine, 0)
+	opt := &godo.ListOptions{}
+	for {
+		drops, resp, err := p.client.Droplets.List(context.Background(), opt)
+		if err != nil {
+			return nil, err
+		}
+		for i := range drops {
+			machines = append(machines, toMachine(&drops[i]))
+		}
+		if resp.Links == nil || resp.Links.IsLastPage() {
+			return machines, nil
+		}
+		page, err := resp.Links.CurrentPage()
+		if err != nil {
+			return nil, err
+		}
+		opt.Page = page + 1
+	}
+}
+
+func (p *DigitalOceanProvider) DestroyMachine(id string) error {
+	dropID, err := strconv.Atoi(id)
+	if err != nil {
+		return errors.New("Invalid droplet ID " + id)
+	}
+	_, err = p.client.Droplets.Delete(context.Background(), dropID)
+	return err
+}
+
+func (p *DigitalOceanProvider) GetIP(id string) (string, error) {
+	drop, err := p.get(id)
+	if err != nil {
+		return "", err
+	}
+	return drop.PublicIPv4()
+}
+
+func (p *DigitalOceanProvider) Status(id string) (string, error) {
+	drop, err := p.get(id)
+	if err != nil {
+		return "", err
+	}
+	return dropletStatus(drop.Status), nil
+}
+
+func (p *DigitalOceanProvider) get(id string) (*godo.Droplet, error) {
+	dropID, err := strconv.Atoi(id)
+	if err != nil {
+		return nil, errors.New("Invalid droplet ID " + id)
+	}
+	drop, _, err := p.client.Droplets.Get(context.Background(), dropID)
+	return drop, err
+}
+
+func toMachine(drop *godo.Droplet) *Machine {
+	ip, _ := drop.PublicIPv4()
+	return &Machine{
+		ID:      strconv.Itoa(drop.ID),
+		Name:    drop.Name,
+		IP:      ip,
+		Status:  dropletStatus(drop.Status),
+		SSHUser: "root",
+		SSHPort: 22,
+	}
+}
+
+func dropletStatus(status string) string {
+	switch status {
+	case "active":
+		return StatusActive
+	case "new":
+		return StatusPending
+	default:
+		return StatusOff
+	}
+}
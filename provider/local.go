@@ -0,0 +1,160 @@
+package provider
+
+import (
+	"errors"
+	"kinetik-server/docker"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"golang.org/x/crypto/ssh"
+)
+
+const machineLabel = "be.mikrodock.machine"
+
+// machineScript turns a Docker-in-Docker container into a machine that can be
+// provisioned like a droplet : root SSH access with our key, and a service
+// command driving dockerd with the options of /etc/default/docker
+const machineScript = `set -e
+apk add --no-cache openssh-server openssh-client bash procps wget
+ssh-keygen -A
+sed -i 's/^root:!/root:*/' /etc/shadow
+mkdir -p /root/.ssh
+echo "$AUTHORIZED_KEY" > /root/.ssh/authorized_keys
+chmod 600 /root/.ssh/authorized_keys
+cat > /usr/local/bin/service <<'SERVICE'
+#!/bin/sh
+[ "$1" = "docker" ] || exit 1
+start() {
+	DOCKER_OPTS=""
+	[ -f /etc/default/docker ] && . /etc/default/docker
+	dockerd $DOCKER_OPTS > /var/log/docker.log 2>&1 &
+}
+stop() {
+	pkill dockerd || true
+	while pgrep dockerd > /dev/null; do sleep 1; done
+}
+case "$2" in
+start) start ;;
+stop) stop ;;
+restart) stop; start ;;
+esac
+SERVICE
+chmod +x /usr/local/bin/service
+exec /usr/sbin/sshd -D -e
+`
+
+// LocalProvider runs machines as privileged Docker-in-Docker containers on the
+// local Docker daemon, to try node provisioning without a cloud account. It is
+// configured by LOCAL_MACHINE_IMAGE and LOCAL_MACHINE_NETWORK.
+type LocalProvider struct {
+	image   string
+	network string
+}
+
+func NewLocalProvider() *LocalProvider {
+	return &LocalProvider{
+		image:   envOrDefault("LOCAL_MACHINE_IMAGE", "docker:17.05-dind"),
+		network: envOrDefault("LOCAL_MACHINE_NETWORK", "bridge"),
+	}
+}
+
+func (p *LocalProvider) Name() string {
+	return "local"
+}
+
+func (p *LocalProvider) CreateMachine(options *MachineOptions) (*Machine, error) {
+	if options.Name == "" {
+		return nil, errors.New("A local machine needs a name")
+	}
+
+	key, err := loadPublicKey(SSHKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &types.ContainerCreateConfig{
+		Name: options.Name,
+		Config: &container.Config{
+			Image:      p.image,
+			Hostname:   options.Name,
+			Entrypoint: []string{"sh", "-c", machineScript},
+			Env:        []string{"AUTHORIZED_KEY=" + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))},
+			Labels: map[string]string{
+				machineLabel: options.Name,
+			},
+		},
+		HostConfig: &container.HostConfig{
+			Privileged:  true,
+			NetworkMode: container.NetworkMode(p.network),
+		},
+	}
+
+	id, err := docker.RunContainerFromConfig(nil, config)
+	if err != nil {
+		return nil, err
+	}
+
+	ip, _ := p.GetIP(id)
+	return &Machine{
+		ID:      id,
+		Name:    options.Name,
+		IP:      ip,
+		Status:  StatusPending,
+		SSHUser: "root",
+		SSHPort: 22,
+	}, nil
+}
+
+func (p *LocalProvider) ListMachines() ([]*Machine, error) {
+	cnts, err := docker.ListContainers(nil, map[string]string{machineLabel: ""})
+	if err != nil {
+		return nil, err
+	}
+
+	machines := make([]*Machine, 0)
+	for _, cnt := range cnts {
+		machine := &Machine{
+			ID:      cnt.ID,
+			Name:    cnt.Labels[machineLabel],
+			Status:  containerStatus(cnt.State),
+			SSHUser: "root",
+			SSHPort: 22,
+		}
+		if cnt.NetworkSettings != nil {
+			if settings, ok := cnt.NetworkSettings.Networks[p.network]; ok {
+				machine.IP = settings.IPAddress
+			}
+		}
+		machines = append(machines, machine)
+	}
+
+	return machines, nil
+}
+
+func (p *LocalProvider) DestroyMachine(id string) error {
+	return docker.StopAndRemoveContainer(nil, id)
+}
+
+func (p *LocalProvider) GetIP(id string) (string, error) {
+	return docker.GetContainerIP(nil, id, p.network)
+}
+
+func (p *LocalProvider) Status(id string) (string, error) {
+	status, err := docker.GetContainerStatus(nil, id)
+	if err != nil {
+		return "", err
+	}
+	return containerStatus(status), nil
+}
+
+func containerStatus(status string) string {
+	switch status {
+	case "running":
+		return StatusActive
+	case "created", "restarting":
+		return StatusPending
+	default:
+		return StatusOff
+	}
+}
@@ -0,0 +1,90 @@
+package provider
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Normalized machine statuses
+const (
+	StatusPending = "pending"
+	StatusActive  = "active"
+	StatusOff     = "off"
+)
+
+// SSHKeyPath is the private key used to reach the machines
+const SSHKeyPath = "/root/.ssh/id_rsa"
+
+type Machine struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	IP      string `json:"ip"`
+	Status  string `json:"status"`
+	SSHUser string `json:"ssh_user"`
+	SSHPort int    `json:"ssh_port"`
+}
+
+// MachineOptions describes a machine to create. Empty fields take the
+// defaults of the provider.
+type MachineOptions struct {
+	Name   string `json:"name"`
+	Size   string `json:"size"`
+	Region string `json:"region"`
+}
+
+// Provider creates the machines nodes run on
+type Provider interface {
+	Name() string
+	CreateMachine(options *MachineOptions) (*Machine, error)
+	ListMachines() ([]*Machine, error)
+	DestroyMachine(id string) error
+	GetIP(id string) (string, error)
+	Status(id string) (string, error)
+}
+
+var providerInstance Provider
+var once sync.Once
+
+// GetProvider returns the provider named by KINETIK_PROVIDER, DigitalOcean by
+// default
+func GetProvider() Provider {
+	once.Do(func() {
+		switch os.Getenv("KINETIK_PROVIDER") {
+		case "local":
+			providerInstance = NewLocalProvider()
+		default:
+			providerInstance = NewDigitalOceanProvider()
+		}
+	})
+	return providerInstance
+}
+
+func envOrDefault(name, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return def
+}
+
+func loadPublicKey(keyPath string) (ssh.PublicKey, error) {
+	buf, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ssh.ParsePrivateKey(buf)
+	if err != nil {
+		return nil, err
+	}
+	return key.PublicKey(), nil
+}
+
+func sshFingerprint(keyPath string) (string, error) {
+	key, err := loadPublicKey(keyPath)
+	if err != nil {
+		return "", err
+	}
+	return ssh.FingerprintLegacyMD5(key), nil
+}
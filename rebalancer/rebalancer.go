@@ -0,0 +1,360 @@
+package rebalancer
+
+import (
+	"errors"
+	"kinetik-server/data"
+	"kinetik-server/deploy"
+	"kinetik-server/jobs"
+	"kinetik-server/logger"
+	"kinetik-server/models"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics the balance of the nodes is measured with
+const (
+	MetricReservations = "reservations" // Highest share of CPU or memory reserved
+	MetricContainers   = "containers"
+)
+
+var policy = &models.RebalancePolicy{}
+
+var statusMu sync.Mutex
+var status *models.RebalanceStatus
+var lastJob = 0
+
+func intFromEnv(name string, def int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || value < 0 {
+		return def
+	}
+	return value
+}
+
+// LoadPolicy reads the policy of the rebalancer from REBALANCE_ENABLED,
+// REBALANCE_THRESHOLD, REBALANCE_DISRUPTION_BUDGET, REBALANCE_MAX_MOVES and
+// REBALANCE_WINDOW
+func LoadPolicy() *models.RebalancePolicy {
+	p := &models.RebalancePolicy{
+		Enabled:          os.Getenv("REBALANCE_ENABLED") == "true",
+		Threshold:        0.2,
+		DisruptionBudget: intFromEnv("REBALANCE_DISRUPTION_BUDGET", 1),
+		MaxMoves:         intFromEnv("REBALANCE_MAX_MOVES", 5),
+		Window:           os.Getenv("REBALANCE_WINDOW"),
+	}
+	if value, err := strconv.ParseFloat(os.Getenv("REBALANCE_THRESHOLD"), 64); err == nil && value > 0 && value <= 1 {
+		p.Threshold = value
+	}
+	if _, _, err := parseWindow(p.Window); err != nil {
+		logger.ErrLog.Printf("Rebalancer disabled : %s\n", err.Error())
+		p.Enabled = false
+	}
+	return p
+}
+
+// Start rebalances the nodes every interval, forever. It does nothing unless
+// REBALANCE_ENABLED is true.
+func Start(interval time.Duration) {
+	// The environment is complete only now
+	policy = LoadPolicy()
+	if !policy.Enabled {
+		return
+	}
+	go func() {
+		for {
+			time.Sleep(interval)
+			Evaluate()
+		}
+	}()
+}
+
+// GetStatus returns the policy of the rebalancer and what it saw on its last
+// pass
+func GetStatus() *models.RebalanceStatus {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+
+	if status == nil {
+		return &models.RebalanceStatus{
+			Policy: policy,
+			Moves:  make([]*models.RebalanceMove, 0),
+		}
+	}
+	return status
+}
+
+// Evaluate measures the balance of the nodes and, within the maintenance
+// window, starts a job moving instances from the most loaded nodes to the
+// least loaded ones
+func Evaluate() {
+	now := time.Now()
+	current := &models.RebalanceStatus{
+		Policy:    policy,
+		InWindow:  inWindow(policy.Window, now),
+		Moves:     make([]*models.RebalanceMove, 0),
+		CheckedAt: now,
+	}
+	defer func() {
+		statusMu.Lock()
+		status = current
+		statusMu.Unlock()
+	}()
+
+	if running() {
+		current.JobID = lastJob
+		return
+	}
+
+	current.Metric, current.Gap, current.Moves = plan(policy, nodeLoads())
+	if !current.InWindow || len(current.Moves) == 0 {
+		return
+	}
+
+	tracker, err := jobs.New(models.JobRebalance, "")
+	if err != nil {
+		logger.ErrLog.Printf("Rebalancer : cannot start job : %s\n", err.Error())
+		return
+	}
+	rebalance := &deploy.Rebalance{
+		Moves: current.Moves,
+	}
+	tracker.Run(rebalance.Run, nil)
+
+	lastJob = tracker.ID()
+	current.JobID = lastJob
+	logger.StdLog.Printf("Rebalancer : moving %d instances, %s out of balance by %.2f\n", len(current.Moves), current.Metric, current.Gap)
+}
+
+// running tells whether the last rebalance job is still running
+func running() bool {
+	if lastJob == 0 {
+		return false
+	}
+	job := data.GetDB().GetJob(lastJob)
+	return job != nil && (job.State == models.JobPending || job.State == models.JobRunning)
+}
+
+// parseWindow returns the bounds of a HH:MM-HH:MM window in minutes since
+// midnight
+func parseWindow(window string) (int, int, error) {
+	if window == "" {
+		return 0, 0, nil
+	}
+	parts := strings.Split(window, "-")
+	if len(parts) != 2 {
+		return 0, 0, errors.New("invalid window " + window + ", expected HH:MM-HH:MM")
+	}
+	bounds := make([]int, 0, 2)
+	for _, part := range parts {
+		at, err := time.Parse("15:04", strings.TrimSpace(part))
+		if err != nil {
+			return 0, 0, errors.New("invalid window " + window + ", expected HH:MM-HH:MM")
+		}
+		bounds = append(bounds, at.Hour()*60+at.Minute())
+	}
+	return bounds[0], bounds[1], nil
+}
+
+// inWindow tells whether now is within the window, which may span midnight
+func inWindow(window string, now time.Time) bool {
+	if window == "" {
+		return true
+	}
+	start, end, err := parseWindow(window)
+	if err != nil {
+		return false
+	}
+	minute := now.Hour()*60 + now.Minute()
+	if start <= end {
+		return minute >= start && minute < end
+	}
+	return minute >= start || minute < end
+}
+
+type placed struct {
+	srv  *models.Service
+	inst *models.Instance
+}
+
+// nodeLoad is a schedulable node, its capacity and what its instances reserve
+type nodeLoad struct {
+	ip         string
+	cpus       float64
+	memory     float64
+	cpu        float64 // Reserved
+	mem        float64
+	containers int
+	instances  []placed
+}
+
+// nodeLoads returns the schedulable nodes whose capacity is known, with their
+// instances
+func nodeLoads() []*nodeLoad {
+	byIP := make(map[string]*nodeLoad)
+	loads := make([]*nodeLoad, 0)
+	for ip, node := range data.GetDB().GetNodes() {
+		if !node.IsSchedulable() || node.CPUCount <= 0 || node.MemUsedBytes == 0 || node.MemUsedPercent <= 0 {
+			continue
+		}
+		byIP[ip] = &nodeLoad{
+			ip:        ip,
+			cpus:      float64(node.CPUCount),
+			memory:    float64(node.MemUsedBytes) / node.MemUsedPercent,
+			instances: make([]placed, 0),
+		}
+		loads = append(loads, byIP[ip])
+	}
+
+	services := data.GetDB().GetServices()
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Identifier() < services[j].Identifier()
+	})
+	for _, srv := range services {
+		for _, inst := range srv.Instances {
+			if load, ok := byIP[inst.NodeID]; ok {
+				load.add(placed{srv, inst})
+			}
+		}
+	}
+	return loads
+}
+
+func reservation(srv *models.Service) (float64, float64) {
+	if srv.Constraints == nil {
+		return 0, 0
+	}
+	cpu, _ := strconv.ParseFloat(srv.Constraints.NanoCPUs, 64)
+	return cpu, float64(srv.Constraints.MemoryBytes)
+}
+
+func (n *nodeLoad) add(p placed) {
+	cpu, mem := reservation(p.srv)
+	n.cpu += cpu
+	n.mem += mem
+	n.containers++
+	n.instances = append(n.instances, p)
+}
+
+func (n *nodeLoad) remove(i int) placed {
+	p := n.instances[i]
+	cpu, mem := reservation(p.srv)
+	n.cpu -= cpu
+	n.mem -= mem
+	n.containers--
+	n.instances = append(n.instances[:i], n.instances[i+1:]...)
+	return p
+}
+
+// with returns the figures of the node once the instance is added, for sign
+// 1, or removed, for sign -1
+func (n *nodeLoad) with(p placed, sign int) *nodeLoad {
+	cpu, mem := reservation(p.srv)
+	shifted := *n
+	shifted.cpu += float64(sign) * cpu
+	shifted.mem += float64(sign) * mem
+	shifted.containers += sign
+	return &shifted
+}
+
+func (n *nodeLoad) value(metric string) float64 {
+	if metric == MetricContainers {
+		return float64(n.containers)
+	}
+	cpu, mem := n.cpu/n.cpus, n.mem/n.memory
+	if mem > cpu {
+		return mem
+	}
+	return cpu
+}
+
+// fits tells whether the reservations of the node stay within its capacity
+func (n *nodeLoad) fits() bool {
+	return n.cpu <= n.cpus && n.mem <= n.memory
+}
+
+// gap is how far apart the most and least loaded nodes are, between 0 and 1
+func gap(loads []*nodeLoad, metric string) float64 {
+	max, min := loads[0].value(metric), loads[0].value(metric)
+	for _, load := range loads {
+		if v := load.value(metric); v > max {
+			max = v
+		} else if v < min {
+			min = v
+		}
+	}
+	if metric == MetricContainers {
+		if max == 0 {
+			return 0
+		}
+		return (max - min) / max
+	}
+	return max - min
+}
+
+// plan chooses the moves restoring the balance of the nodes, measured with
+// their reservations or, when those are balanced, their containers. Every move
+// must lower the load of the most loaded node without overloading the least
+// loaded one.
+func plan(policy *models.RebalancePolicy, loads []*nodeLoad) (string, float64, []*models.RebalanceMove) {
+	moves := make([]*models.RebalanceMove, 0)
+	if len(loads) < 2 {
+		return "", 0, moves
+	}
+
+	metric := MetricReservations
+	measured := gap(loads, metric)
+	if measured <= policy.Threshold {
+		metric = MetricContainers
+		measured = gap(loads, metric)
+		if measured <= policy.Threshold {
+			return "", measured, moves
+		}
+	}
+
+	moved := make(map[string]int)
+	for len(moves) < policy.MaxMoves && gap(loads, metric) > policy.Threshold {
+		sort.Slice(loads, func(i, j int) bool {
+			if loads[i].value(metric) != loads[j].value(metric) {
+				return loads[i].value(metric) > loads[j].value(metric)
+			}
+			return loads[i].ip < loads[j].ip
+		})
+		hot, cool := loads[0], loads[len(loads)-1]
+
+		best, peak := -1, hot.value(metric)
+		for i, p := range hot.instances {
+			budget := policy.DisruptionBudget
+			if p.srv.DisruptionBudget != nil {
+				budget = *p.srv.DisruptionBudget
+			}
+			if moved[p.srv.Identifier()] >= budget {
+				continue
+			}
+
+			from, to := hot.with(p, -1), cool.with(p, 1)
+			after := math.Max(from.value(metric), to.value(metric))
+			if to.fits() && after < peak {
+				best, peak = i, after
+			}
+		}
+		if best < 0 {
+			break
+		}
+
+		p := hot.remove(best)
+		cool.add(p)
+		moved[p.srv.Identifier()]++
+		moves = append(moves, &models.RebalanceMove{
+			Service:     p.srv.Identifier(),
+			ContainerID: p.inst.ContainerID,
+			From:        hot.ip,
+			To:          cool.ip,
+		})
+	}
+	return metric, measured, moves
+}
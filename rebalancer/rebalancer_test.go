@@ -0,0 +1,179 @@
+package rebalancer
+
+import (
+	"kinetik-server/models"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/docker/cli/cli/compose/types"
+)
+
+// testLoad is a node with 4 CPUs and 4 GB of memory running the instances
+func testLoad(ip string, instances ...placed) *nodeLoad {
+	load := &nodeLoad{
+		ip:        ip,
+		cpus:      4,
+		memory:    4 << 30,
+		instances: make([]placed, 0),
+	}
+	for _, p := range instances {
+		load.add(p)
+	}
+	return load
+}
+
+// testInstances adds count instances to the service and returns them
+func testInstances(srv *models.Service, count int) []placed {
+	instances := make([]placed, 0, count)
+	for i := 0; i < count; i++ {
+		instances = append(instances, placed{srv, &models.Instance{ContainerID: srv.ServiceName + strconv.Itoa(len(srv.Instances))}})
+		srv.Instances = append(srv.Instances, instances[i].inst)
+	}
+	return instances
+}
+
+func testService(name string, cpus string, budget *int) *models.Service {
+	srv := &models.Service{
+		ServiceName:      name,
+		StackName:        "s",
+		DisruptionBudget: budget,
+	}
+	if cpus != "" {
+		srv.Constraints = &types.Resource{NanoCPUs: cpus}
+	}
+	return srv
+}
+
+func TestPlan(t *testing.T) {
+	policy := &models.RebalancePolicy{Threshold: 0.2, DisruptionBudget: 1, MaxMoves: 5}
+	zero := 0
+
+	tests := []struct {
+		name   string
+		policy *models.RebalancePolicy
+		loads  func() []*nodeLoad
+		metric string
+		moves  int
+	}{
+		{
+			name:   "a single node",
+			policy: policy,
+			loads: func() []*nodeLoad {
+				return []*nodeLoad{testLoad("10.0.0.1", testInstances(testService("web", "1", nil), 2)...)}
+			},
+			moves: 0,
+		},
+		{
+			name:   "balanced nodes",
+			policy: policy,
+			loads: func() []*nodeLoad {
+				srv := testService("web", "1", nil)
+				return []*nodeLoad{testLoad("10.0.0.1", testInstances(srv, 1)...), testLoad("10.0.0.2", testInstances(srv, 1)...)}
+			},
+			moves: 0,
+		},
+		{
+			name:   "reservations, within the default budget of each service",
+			policy: policy,
+			loads: func() []*nodeLoad {
+				web, api := testService("web", "1", nil), testService("api", "1", nil)
+				hot := append(testInstances(web, 2), testInstances(api, 2)...)
+				return []*nodeLoad{testLoad("10.0.0.1", hot...), testLoad("10.0.0.2")}
+			},
+			metric: MetricReservations,
+			moves:  2,
+		},
+		{
+			name:   "the budget of the service overrides the policy",
+			policy: policy,
+			loads: func() []*nodeLoad {
+				web := testService("web", "1", &zero)
+				return []*nodeLoad{testLoad("10.0.0.1", testInstances(web, 4)...), testLoad("10.0.0.2")}
+			},
+			metric: MetricReservations,
+			moves:  0,
+		},
+		{
+			name:   "containers once reservations are balanced",
+			policy: &models.RebalancePolicy{Threshold: 0.2, DisruptionBudget: 5, MaxMoves: 5},
+			loads: func() []*nodeLoad {
+				web := testService("web", "", nil)
+				return []*nodeLoad{testLoad("10.0.0.1", testInstances(web, 4)...), testLoad("10.0.0.2")}
+			},
+			metric: MetricContainers,
+			moves:  2,
+		},
+		{
+			name:   "max moves",
+			policy: &models.RebalancePolicy{Threshold: 0.2, DisruptionBudget: 5, MaxMoves: 1},
+			loads: func() []*nodeLoad {
+				web := testService("web", "", nil)
+				return []*nodeLoad{testLoad("10.0.0.1", testInstances(web, 4)...), testLoad("10.0.0.2")}
+			},
+			metric: MetricContainers,
+			moves:  1,
+		},
+		{
+			name:   "no move overloads the least loaded node",
+			policy: policy,
+			loads: func() []*nodeLoad {
+				big := testService("big", "3", nil)
+				small := testLoad("10.0.0.2", testInstances(testService("other", "2", nil), 1)...)
+				return []*nodeLoad{testLoad("10.0.0.1", testInstances(big, 1)...), small}
+			},
+			metric: MetricReservations,
+			moves:  0,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			loads := test.loads()
+			metric, _, moves := plan(test.policy, loads)
+			if len(moves) != test.moves {
+				t.Fatalf("%d moves, want %d", len(moves), test.moves)
+			}
+			if len(moves) > 0 && metric != test.metric {
+				t.Errorf("measured with %s, want %s", metric, test.metric)
+			}
+			for _, move := range moves {
+				if move.From == move.To {
+					t.Errorf("%s moved to its own node", move.ContainerID)
+				}
+			}
+			for _, load := range loads {
+				if !load.fits() {
+					t.Errorf("%s is overloaded", load.ip)
+				}
+			}
+		})
+	}
+}
+
+func TestInWindow(t *testing.T) {
+	at := func(clock string) time.Time {
+		now, _ := time.Parse("15:04", clock)
+		return now
+	}
+
+	tests := []struct {
+		window string
+		now    string
+		want   bool
+	}{
+		{"", "12:00", true},
+		{"01:00-05:00", "03:00", true},
+		{"01:00-05:00", "05:00", false},
+		{"22:00-02:00", "23:30", true},
+		{"22:00-02:00", "01:59", true},
+		{"22:00-02:00", "12:00", false},
+		{"invalid", "12:00", false},
+	}
+
+	for _, test := range tests {
+		if got := inWindow(test.window, at(test.now)); got != test.want {
+			t.Errorf("inWindow(%q, %s) = %v, want %v", test.window, test.now, got, test.want)
+		}
+	}
+}
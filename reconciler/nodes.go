@@ -0,0 +1,167 @@
+package reconciler
+
+import (
+	"kinetik-server/data"
+	"kinetik-server/deploy"
+	"kinetik-server/docker"
+	"kinetik-server/logger"
+	"kinetik-server/models"
+	"os"
+	"time"
+)
+
+// A node that did not report for suspectAfter is suspect and gets no new
+// instance. After downAfter it is down and its instances are rescheduled.
+var suspectAfter = durationFromEnv("NODE_SUSPECT_AFTER", 30*time.Second)
+var downAfter = durationFromEnv("NODE_DOWN_AFTER", 90*time.Second)
+
+func durationFromEnv(name string, def time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(name))
+	if err != nil || value <= 0 {
+		return def
+	}
+	return value
+}
+
+// StartNodeMonitor checks the heartbeat of every node every interval, forever
+func StartNodeMonitor(interval time.Duration) {
+	// Nodes could not report while the server was down
+	startedAt := time.Now()
+	go func() {
+		for {
+			time.Sleep(interval)
+			CheckNodes(startedAt)
+		}
+	}()
+}
+
+// CheckNodes updates the state of the nodes from their last report, not
+// counting the time before since
+func CheckNodes(since time.Time) {
+	for ip := range data.GetDB().GetNodes() {
+		var previous, current models.StateValue
+
+		err := data.GetDB().UpdateNode(ip, func(node *models.Node) *models.Node {
+			if node == nil {
+				return nil
+			}
+			if node.State != nil {
+				previous = *node.State
+			}
+
+			lastSeen := node.LastSeen
+			if lastSeen.Before(since) {
+				lastSeen = since
+			}
+			silence := time.Since(lastSeen)
+
+			switch {
+			case silence >= downAfter:
+				current = models.NodeDown
+			case silence >= suspectAfter:
+				current = models.NodeSuspect
+			default:
+				current = models.NodeReady
+			}
+			// Only a report brings a node back
+			if node.State != nil && current < previous {
+				current = previous
+			}
+
+			if node.State != nil && previous == current {
+				return nil
+			}
+			node.SetState(current)
+			return node
+		})
+		if err != nil {
+			logger.ErrLog.Printf("Node monitor : cannot update %s : %s\n", ip, err.Error())
+			continue
+		}
+
+		if previous != current {
+			logger.StdLog.Printf("Node monitor : node %s is now %s\n", ip, current.String())
+		}
+
+		// Also catches instances left behind by an interrupted evacuation
+		if current == models.NodeDown {
+			EvacuateNode(ip)
+		}
+	}
+}
+
+// EvacuateNode forgets the instances running on the node then starts their
+// replacements on the other nodes
+func EvacuateNode(nodeIP string) {
+	for _, srv := range data.GetDB().GetServices() {
+		if forgetNodeInstances(srv.Identifier(), nodeIP) {
+			ReconcileService(srv.Identifier())
+		}
+	}
+}
+
+func forgetNodeInstances(identifier string, nodeIP string) bool {
+	unlock := deploy.LockService(identifier)
+	defer unlock()
+
+	srv := data.GetDB().GetService(identifier)
+	if srv == nil {
+		return false
+	}
+
+	kept := make([]*models.Instance, 0, len(srv.Instances))
+	for _, inst := range srv.Instances {
+		if inst.NodeID != nodeIP {
+			kept = append(kept, inst)
+			continue
+		}
+		logger.StdLog.Printf("Node monitor : rescheduling container %s of %s from %s\n", inst.ContainerID, identifier, nodeIP)
+		deploy.ForgetInstance(srv, inst)
+	}
+
+	if len(kept) == len(srv.Instances) {
+		return false
+	}
+
+	srv.Instances = kept
+	if err := data.GetDB().AddService(srv); err != nil {
+		logger.ErrLog.Printf("Node monitor : cannot save %s : %s\n", identifier, err.Error())
+	}
+	return true
+}
+
+// RemoveStrayContainers stops and removes the containers of services left on a
+// node which is back after being down : its instances were forgotten and
+// replaced elsewhere meanwhile. Only the containers created before back are
+// removed, newer ones may be instances being started.
+func RemoveStrayContainers(nodeIP string, back time.Time) {
+	client, err := docker.GetRemoteClient(nodeIP)
+	if err != nil {
+		logger.ErrLog.Printf("Node monitor : cannot reach %s : %s\n", nodeIP, err.Error())
+		return
+	}
+	defer client.Close()
+
+	cnts, err := docker.ListContainers(client, map[string]string{"be.mikrodock.stack": ""})
+	if err != nil {
+		logger.ErrLog.Printf("Node monitor : cannot list containers of %s : %s\n", nodeIP, err.Error())
+		return
+	}
+
+	tracked := make(map[string]bool)
+	for _, srv := range data.GetDB().GetServices() {
+		for _, inst := range srv.Instances {
+			tracked[inst.ContainerID] = true
+		}
+	}
+
+	for _, cnt := range cnts {
+		if tracked[cnt.ID] || !time.Unix(cnt.Created, 0).Before(back) {
+			continue
+		}
+		logger.StdLog.Printf("Node monitor : removing container %s of %s/%s left on %s\n", cnt.ID, cnt.Labels["be.mikrodock.stack"], cnt.Labels["be.mikrodock.service"], nodeIP)
+		if err := docker.StopAndRemoveContainer(client, cnt.ID); err != nil {
+			logger.ErrLog.Printf("Node monitor : cannot remove container %s : %s\n", cnt.ID, err.Error())
+		}
+	}
+}
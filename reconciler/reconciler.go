@@ -0,0 +1,144 @@
+package reconciler
+
+import (
+	"kinetik-server/data"
+	"kinetik-server/deploy"
+	"kinetik-server/docker"
+	"kinetik-server/logger"
+	"kinetik-server/models"
+	"time"
+)
+
+// Start runs a reconciliation pass every interval, forever
+func Start(interval time.Duration) {
+	go func() {
+		for {
+			time.Sleep(interval)
+			ReconcileAll()
+		}
+	}()
+}
+
+// nodeContainers caches the running containers of each node for one pass.
+// A nil entry means the node could not be reached.
+type nodeContainers map[string]map[string]bool
+
+// isRunning tells whether the container of the instance runs, and whether its
+// node could be reached to know
+func (n nodeContainers) isRunning(inst *models.Instance) (bool, bool) {
+	running, ok := n[inst.NodeID]
+	if !ok {
+		var err error
+		running, err = docker.GetRunningContainers(inst.NodeID)
+		if err != nil {
+			logger.ErrLog.Printf("Reconciler : cannot list containers of %s : %s\n", inst.NodeID, err.Error())
+		}
+		n[inst.NodeID] = running
+	}
+	return running[inst.ContainerID], running != nil
+}
+
+func ReconcileAll() {
+	containers := make(nodeContainers)
+	for _, srv := range data.GetDB().GetServices() {
+		reconcile(srv.Identifier(), containers)
+	}
+}
+
+// ReconcileService converges the running instances of a service to its
+// desired replica count
+func ReconcileService(identifier string) {
+	reconcile(identifier, make(nodeContainers))
+}
+
+func reconcile(identifier string, containers nodeContainers) {
+	unlock := deploy.LockService(identifier)
+	defer unlock()
+
+	srv := data.GetDB().GetService(identifier)
+	if srv == nil {
+		deploy.ClearPending(identifier)
+		return
+	}
+
+	// Services stored before replicas were persisted
+	if srv.Replicas == 0 && len(srv.Instances) > 0 {
+		srv.Replicas = uint64(len(srv.Instances))
+	}
+
+	changed := false
+
+	alive := make([]*models.Instance, 0, len(srv.Instances))
+	for _, inst := range srv.Instances {
+		running, reachable := containers.isRunning(inst)
+		// The node monitor reschedules the instances of nodes that stay down
+		if running || !reachable {
+			alive = append(alive, inst)
+			continue
+		}
+		logger.StdLog.Printf("Reconciler : container %s of %s on %s is gone\n", inst.ContainerID, identifier, inst.NodeID)
+		if err := deploy.StopInstance(srv, inst); err != nil {
+			logger.ErrLog.Printf("Reconciler : cannot clean container %s : %s\n", inst.ContainerID, err.Error())
+		}
+		changed = true
+	}
+	// The instances gone must not count when placing their replacements
+	if changed {
+		srv.Instances = alive
+		if err := data.GetDB().AddService(srv); err != nil {
+			logger.ErrLog.Printf("Reconciler : cannot save %s : %s\n", identifier, err.Error())
+		}
+	}
+
+	started := make([]*models.Instance, 0)
+	var startErr error
+	for uint64(len(alive)+len(started)) < srv.DesiredReplicas() {
+		inst, err := deploy.StartInstance(srv)
+		if err != nil {
+			startErr = err
+			logger.ErrLog.Printf("Reconciler : cannot start instance of %s : %s\n", identifier, err.Error())
+			break
+		}
+		logger.StdLog.Printf("Reconciler : started container %s of %s on %s\n", inst.ContainerID, identifier, inst.NodeID)
+		started = append(started, inst)
+		if containers[inst.NodeID] != nil {
+			containers[inst.NodeID][inst.ContainerID] = true
+		}
+	}
+
+	if deploy.IsUnschedulable(startErr) {
+		deploy.SetPending(srv, int(srv.DesiredReplicas())-len(alive)-len(started))
+	} else if startErr == nil {
+		deploy.SetPending(srv, 0)
+	}
+
+	if len(started) > 0 {
+		changed = true
+		if err := deploy.RegisterInstances(srv, started); err != nil {
+			logger.ErrLog.Printf("Reconciler : cannot register %s in DNS : %s\n", identifier, err.Error())
+		}
+		if err := deploy.PublishPorts(srv); err != nil {
+			logger.ErrLog.Printf("Reconciler : cannot publish ports of %s : %s\n", identifier, err.Error())
+		}
+		alive = append(alive, started...)
+	}
+
+	for uint64(len(alive)) > srv.DesiredReplicas() {
+		inst := alive[len(alive)-1]
+		if err := deploy.StopInstance(srv, inst); err != nil {
+			logger.ErrLog.Printf("Reconciler : cannot stop container %s : %s\n", inst.ContainerID, err.Error())
+			break
+		}
+		logger.StdLog.Printf("Reconciler : removed container %s of %s\n", inst.ContainerID, identifier)
+		alive = alive[:len(alive)-1]
+		changed = true
+	}
+
+	if changed {
+		srv.Instances = alive
+		if err := data.GetDB().AddService(srv); err != nil {
+			logger.ErrLog.Printf("Reconciler : cannot save %s : %s\n", identifier, err.Error())
+		}
+		deploy.ReleaseClaims(started)
+	}
+}
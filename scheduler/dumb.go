@@ -1,23 +1,47 @@
 package scheduler
 
 import (
-	"kinetik-server/data"
+	"kinetik-server/models"
 	"math/rand"
-
-	"github.com/docker/cli/cli/compose/types"
 )
 
 type DumbScheduler struct{}
 
-func (ds *DumbScheduler) SelectWithConstraints(resources *types.Resource) (string, error) {
-	nodes := data.GetDB().GetNodes()
+func (ds *DumbScheduler) Select(req *Request) (*models.PlacementDecision, error) {
+	decision := models.NewPlacementDecision(req.Service, "dumb")
+
+	nodes, err := eligibleNodes(requestTargets(req, decision), newInstanceCounts(), req, decision)
+	if err != nil {
+		decision.Error = err.Error()
+		return finish(decision), err
+	}
+	if len(nodes) == 0 {
+		return finish(decision), nil
+	}
 	keys := make([]string, 0, len(nodes))
 	for k := range nodes {
 		keys = append(keys, k)
+		decision.Candidate(k)
 	}
 	index := rand.Int() % len(keys)
 
-	key := keys[index]
+	decision.NodeIP = keys[index]
+	decision.Release = claimPlacement(req.Service, decision.NodeIP, req.Resources)
 
-	return key, nil
+	return finish(decision), nil
+}
+
+func (ds *DumbScheduler) DryRun(reqs []*Request) []string {
+	placements := make([]string, len(reqs))
+	if len(schedulableNodes(nil)) == 0 {
+		return placements
+	}
+	for i, req := range reqs {
+		decision, _ := ds.Select(req)
+		if decision.Release != nil {
+			decision.Release()
+		}
+		placements[i] = decision.NodeIP
+	}
+	return placements
 }
@@ -1,67 +1,146 @@
 package scheduler
 
 import (
-	"kinetik-server/data"
-	"kinetik-server/docker"
+	"fmt"
 	"kinetik-server/logger"
 	"kinetik-server/models"
+	"kinetik-server/nodestate"
 	"sort"
 	"strconv"
+	"sync"
 
 	"github.com/docker/cli/cli/compose/types"
 )
 
-type NotSoSmartScheduler struct{}
+type NotSoSmartScheduler struct {
+	mu sync.Mutex // A placement sees the reservations of the previous ones
+}
 
-func (ds *NotSoSmartScheduler) SelectWithConstraints(resources *types.Resource) (string, error) {
+func (ds *NotSoSmartScheduler) Select(req *Request) (*models.PlacementDecision, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
 
-	var node *models.Node
-	var ipnode string
+	resources := req.Resources
+	decision := models.NewPlacementDecision(req.Service, "notsosmart")
 
-	nodes := data.GetDB().GetNodes()
-	ordList := orderByContainerCount(nodes)
-	for _, ip := range ordList {
-		nodeSpec := nodes[ip]
-		if resources == nil {
-			return ip, nil
+	nodes, err := eligibleNodes(requestTargets(req, decision), newInstanceCounts(), req, decision)
+	if err != nil {
+		decision.Error = err.Error()
+		return finish(decision), err
+	}
+	ipnode := place(nodes, orderByContainerCount(nodes), resources, decision)
+	decision.NodeIP = ipnode
+	if ipnode != "" {
+		decision.Release = claimPlacement(req.Service, ipnode, resources)
+	}
+
+	if ipnode != "" && resources != nil {
+		node := nodes[ipnode]
+
+		logger.StdLog.Printf("Node %s has now CPU res = %s and mem = %d\n", ipnode, node.Reservations.NanoCPUs, node.Reservations.MemoryBytes)
+	}
+
+	return finish(decision), nil
+}
+
+func (ds *NotSoSmartScheduler) DryRun(reqs []*Request) []string {
+	targets := schedulableTargets(nil)
+
+	// Count the known instances instead of asking Docker
+	counts := newInstanceCounts()
+
+	placements := make([]string, len(reqs))
+	for i, req := range reqs {
+		nodes, err := eligibleNodes(targets, counts, req, nil)
+		if err != nil {
+			continue
 		}
-		nodeCpuReservation, _ := strconv.ParseFloat(nodeSpec.Reservations.NanoCPUs, 64)
-		thisSpecCpuReservation, _ := strconv.ParseFloat(resources.NanoCPUs, 64)
-		freeCPUpercents := float64(100*nodeSpec.CPUCount) - nodeSpec.CPUUsedPercent
-		realFree := freeCPUpercents - nodeCpuReservation*100
-		if thisSpecCpuReservation*100 < realFree {
-			memBytesFree := int64((float64(nodeSpec.MemUsedBytes) / nodeSpec.MemUsedPercent) * (1 - nodeSpec.MemUsedPercent))
-			if int64(resources.MemoryBytes) < memBytesFree-int64(nodeSpec.Reservations.MemoryBytes) {
-				nodeSpec.Reservations.NanoCPUs = strconv.FormatFloat(nodeCpuReservation+thisSpecCpuReservation, 'f', -1, 64)
-				nodeSpec.Reservations.MemoryBytes = nodeSpec.Reservations.MemoryBytes + resources.MemoryBytes
-				node = nodeSpec
-				ipnode = ip
-				break
-			}
+		ip := place(nodes, orderByCount(nodes, counts.total), req.Resources, nil)
+		placements[i] = ip
+		if ip != "" {
+			counts.add(req.Service, ip)
 		}
 	}
-	if node != nil {
-		data.GetDB().AddNode(ipnode, node)
 
-		logger.StdLog.Printf("Node %s has now CPU res = %s and mem = %d\n", ipnode, node.Reservations.NanoCPUs, node.Reservations.MemoryBytes)
+	return placements
+}
+
+// place returns the first node of ordList with enough free CPU and memory for
+// the resources, and adds them to its reservations. The nodes skipped are
+// rejected in the decision, which may be nil.
+func place(nodes map[string]*models.Node, ordList []string, resources *types.Resource, decision *models.PlacementDecision) string {
+	for _, ip := range ordList {
+		filter, detail := misfit(nodes[ip], resources)
+		if filter == "" {
+			reserve(nodes[ip], resources)
+			return ip
+		}
+		decision.Reject(ip, filter, detail)
+	}
+	return ""
+}
 
-		return ipnode, nil
+// misfit returns the filter rejecting the node when it has not enough free
+// CPU or memory for the resources, its reservations deducted
+func misfit(node *models.Node, resources *types.Resource) (string, string) {
+	if resources == nil {
+		return "", ""
+	}
+	if node.Reservations == nil {
+		node.Reservations = &types.Resource{}
+	}
+	nodeCpuReservation, _ := strconv.ParseFloat(node.Reservations.NanoCPUs, 64)
+	thisSpecCpuReservation, _ := strconv.ParseFloat(resources.NanoCPUs, 64)
+	freeCPUpercents := float64(100*node.CPUCount) - node.CPUUsedPercent
+	realFree := freeCPUpercents - nodeCpuReservation*100
+	if thisSpecCpuReservation*100 >= realFree {
+		return models.RejectCPU, fmt.Sprintf("%.2f CPU free, %s needed", realFree/100, resources.NanoCPUs)
 	}
+	memBytesFree := int64((float64(node.MemUsedBytes) / node.MemUsedPercent) * (1 - node.MemUsedPercent))
+	realFreeMem := memBytesFree - int64(node.Reservations.MemoryBytes)
+	if int64(resources.MemoryBytes) >= realFreeMem {
+		return models.RejectMemory, fmt.Sprintf("%d bytes free, %d needed", realFreeMem, resources.MemoryBytes)
+	}
+	return "", ""
+}
 
-	return "", nil
+// reserve adds the resources to the reservations of the node
+func reserve(node *models.Node, resources *types.Resource) {
+	if resources != nil {
+		node.Reservations = models.AddResources(node.Reservations, resources)
+	}
 }
 
+// orderByContainerCount orders the nodes by their running containers, as
+// cached. Nodes whose count is not fresh come last.
 func orderByContainerCount(nodes map[string]*models.Node) []string {
 	keys := make([]string, 0, len(nodes))
+	counts := make(map[string]int, len(nodes))
+	fresh := make(map[string]bool, len(nodes))
 	for k := range nodes {
 		keys = append(keys, k)
+		counts[k], fresh[k] = nodestate.Containers(k)
 	}
-	sort.Slice(keys, func(i, j int) bool {
-		cntI := docker.GetContainersCount(keys[i])
-		cntJ := docker.GetContainersCount(keys[j])
-		return cntI < cntJ
+	sort.Strings(keys)
+	sort.SliceStable(keys, func(i, j int) bool {
+		if fresh[keys[i]] != fresh[keys[j]] {
+			return fresh[keys[i]]
+		}
+		return counts[keys[i]] < counts[keys[j]]
 	})
 
 	return keys
+}
+
+func orderByCount(nodes map[string]*models.Node, counts map[string]int) []string {
+	keys := make([]string, 0, len(nodes))
+	for k := range nodes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	sort.SliceStable(keys, func(i, j int) bool {
+		return counts[keys[i]] < counts[keys[j]]
+	})
 
+	return keys
 }
@@ -0,0 +1,372 @@
+package scheduler
+
+import (
+	"errors"
+	"kinetik-server/data"
+	"kinetik-server/models"
+	"strings"
+
+	"github.com/docker/cli/cli/compose/types"
+)
+
+// Constraint is a placement constraint such as node.labels.zone==ams3
+type Constraint struct {
+	Key   string
+	Value string
+	Equal bool // == rather than !=
+}
+
+// ParseConstraint reads a constraint of the compose deploy.placement section
+func ParseConstraint(expr string) (*Constraint, error) {
+	for _, op := range []string{"==", "!="} {
+		parts := strings.SplitN(expr, op, 2)
+		if len(parts) != 2 {
+			continue
+		}
+		c := &Constraint{
+			Key:   strings.TrimSpace(parts[0]),
+			Value: strings.TrimSpace(parts[1]),
+			Equal: op == "==",
+		}
+		if err := validateKey(c.Key); err != nil {
+			return nil, errors.New("Invalid constraint " + expr + " : " + err.Error())
+		}
+		return c, nil
+	}
+	return nil, errors.New("Invalid constraint " + expr + " : expected key==value or key!=value")
+}
+
+func (c *Constraint) String() string {
+	if c.Equal {
+		return c.Key + "==" + c.Value
+	}
+	return c.Key + "!=" + c.Value
+}
+
+// Matches tells whether the node satisfies the constraint. A missing label
+// never equals a value.
+func (c *Constraint) Matches(target *Target) bool {
+	value, ok := target.Attribute(c.Key)
+	return (ok && value == c.Value) == c.Equal
+}
+
+// Node attributes constraints and preferences can refer to, besides
+// node.labels.<key>
+var nodeAttributes = map[string]bool{
+	"node.hostname": true,
+	"node.ip":       true,
+	"node.provider": true,
+	"node.region":   true,
+	"node.size":     true,
+}
+
+func validateKey(key string) error {
+	if nodeAttributes[key] {
+		return nil
+	}
+	if strings.HasPrefix(key, "node.labels.") && len(key) > len("node.labels.") {
+		return nil
+	}
+	return errors.New("unknown attribute " + key + ", expected node.hostname, node.ip, node.provider, node.region, node.size or node.labels.<key>")
+}
+
+// ValidatePlacement checks the constraints and preferences of the placement
+func ValidatePlacement(placement *types.Placement) error {
+	if placement == nil {
+		return nil
+	}
+	if _, err := parseConstraints(placement.Constraints); err != nil {
+		return err
+	}
+	for _, pref := range placement.Preferences {
+		if err := validateKey(pref.Spread); err != nil {
+			return errors.New("Invalid spread preference : " + err.Error())
+		}
+	}
+	return nil
+}
+
+func parseConstraints(exprs []string) ([]*Constraint, error) {
+	constraints := make([]*Constraint, 0, len(exprs))
+	for _, expr := range exprs {
+		c, err := ParseConstraint(expr)
+		if err != nil {
+			return nil, err
+		}
+		constraints = append(constraints, c)
+	}
+	return constraints, nil
+}
+
+// Target is a node as seen by placement constraints : its report and its
+// inventory entry
+type Target struct {
+	IP    string
+	Node  *models.Node
+	Entry *models.NodeEntry // Bare for nodes which joined by themselves
+}
+
+// Attribute returns the value of a node attribute or label
+func (t *Target) Attribute(key string) (string, bool) {
+	switch key {
+	case "node.hostname":
+		return t.Entry.Name, true
+	case "node.ip":
+		return t.IP, true
+	case "node.provider":
+		return t.Entry.Provider, t.Entry.Provider != ""
+	case "node.region":
+		return t.Entry.Region, t.Entry.Region != ""
+	case "node.size":
+		return t.Entry.Size, t.Entry.Size != ""
+	}
+	if strings.HasPrefix(key, "node.labels.") {
+		value, ok := t.Entry.Labels[strings.TrimPrefix(key, "node.labels.")]
+		return value, ok
+	}
+	return "", false
+}
+
+// ConstraintError reports that no node satisfies the placement constraints of
+// a service, whatever its free resources
+type ConstraintError struct {
+	Service     string
+	Constraints []string
+}
+
+func (e *ConstraintError) Error() string {
+	return "No node satisfies the placement constraints of " + e.Service + " : " + strings.Join(e.Constraints, ", ")
+}
+
+// schedulableTargets returns the nodes new instances may be scheduled on,
+// with their current reservations and inventory entry, by IP. The others are
+// rejected in the decision, which may be nil.
+func schedulableTargets(decision *models.PlacementDecision) map[string]*Target {
+	entries := make(map[string]*models.NodeEntry)
+	for _, entry := range data.GetDB().GetNodeEntries() {
+		if entry.PublicIP != "" {
+			entries[entry.PublicIP] = entry
+		}
+	}
+
+	targets := make(map[string]*Target)
+	for ip, node := range schedulableNodes(decision) {
+		entry, ok := entries[ip]
+		if !ok {
+			entry = &models.NodeEntry{Name: ip, PublicIP: ip}
+		}
+		targets[ip] = &Target{
+			IP:    ip,
+			Node:  node,
+			Entry: entry,
+		}
+	}
+	return targets
+}
+
+// requestTargets returns the schedulable targets, without the reservations of
+// the instances the request evicts
+func requestTargets(req *Request, decision *models.PlacementDecision) map[string]*Target {
+	targets := schedulableTargets(decision)
+	for _, victim := range req.Evicted {
+		if target, ok := targets[victim.NodeIP]; ok {
+			target.Node.Reservations = models.SubtractResources(target.Node.Reservations, victim.Resources)
+		}
+	}
+	return targets
+}
+
+// eligibleNodes keeps the nodes satisfying the placement constraints and the
+// affinity rules of the request, rejecting the others in the decision. It
+// fails with a *ConstraintError when no node satisfies the constraints.
+func eligibleNodes(targets map[string]*Target, counts *instanceCounts, req *Request, decision *models.PlacementDecision) (map[string]*models.Node, error) {
+	nodes := make(map[string]*models.Node, len(targets))
+	if req.Placement == nil || len(req.Placement.Constraints) == 0 || len(targets) == 0 {
+		for ip, target := range targets {
+			nodes[ip] = target.Node
+		}
+		return affineNodes(onlyNodes(nodes, req, decision), targets, counts, req, decision), nil
+	}
+
+	constraints, err := parseConstraints(req.Placement.Constraints)
+	if err != nil {
+		return nil, err
+	}
+
+	for ip, target := range targets {
+		matches := true
+		for _, c := range constraints {
+			if !c.Matches(target) {
+				decision.Reject(ip, models.RejectConstraints, c.String())
+				matches = false
+				break
+			}
+		}
+		if matches {
+			nodes[ip] = target.Node
+		}
+	}
+
+	if len(nodes) == 0 {
+		exprs := make([]string, 0, len(constraints))
+		for _, c := range constraints {
+			exprs = append(exprs, c.String())
+		}
+		return nil, &ConstraintError{
+			Service:     req.Service,
+			Constraints: exprs,
+		}
+	}
+	return affineNodes(onlyNodes(nodes, req, decision), targets, counts, req, decision), nil
+}
+
+// onlyNodes keeps the nodes the request is restricted to, if any
+func onlyNodes(nodes map[string]*models.Node, req *Request, decision *models.PlacementDecision) map[string]*models.Node {
+	if len(req.Nodes) == 0 {
+		return nodes
+	}
+	allowed := make(map[string]bool, len(req.Nodes))
+	for _, ip := range req.Nodes {
+		allowed[ip] = true
+	}
+	for ip := range nodes {
+		if !allowed[ip] {
+			decision.Reject(ip, models.RejectExcluded, "")
+			delete(nodes, ip)
+		}
+	}
+	return nodes
+}
+
+// spreadCounts returns, for each spread preference of the request, how many
+// instances of the service run on the nodes sharing the value of the node.
+// Nodes lacking the attribute share the empty value.
+func spreadCounts(targets map[string]*Target, serviceCounts map[string]int, req *Request, ip string) []int {
+	if req.Placement == nil {
+		return nil
+	}
+
+	counts := make([]int, 0, len(req.Placement.Preferences))
+	for _, pref := range req.Placement.Preferences {
+		value, _ := targets[ip].Attribute(pref.Spread)
+		count := 0
+		for otherIP, other := range targets {
+			if otherValue, _ := other.Attribute(pref.Spread); otherValue == value {
+				count += serviceCounts[otherIP]
+			}
+		}
+		counts = append(counts, count)
+	}
+	return counts
+}
+
+// lessSpread tells whether a is preferred to b by the spread preferences,
+// compared in order
+func lessSpread(a, b []int) (less bool, equal bool) {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i], false
+		}
+	}
+	return false, true
+}
+
+// Deploy labels of the affinity rules of a service
+const (
+	// AntiAffinityLabel spreads the replicas of the service one per node, with
+	// "node", or one per value of a node attribute such as node.labels.zone
+	AntiAffinityLabel = "be.mikrodock.anti-affinity"
+	// AffinityLabel runs the replicas of the service on nodes running the
+	// given services of the stack, separated by commas
+	AffinityLabel = "be.mikrodock.affinity"
+)
+
+// ValidateAntiAffinity checks the topology key of an anti-affinity rule
+func ValidateAntiAffinity(key string) error {
+	if key == "" || key == "node" {
+		return nil
+	}
+	if err := validateKey(key); err != nil {
+		return errors.New("Invalid anti-affinity : " + err.Error())
+	}
+	return nil
+}
+
+// domain returns the topology domain of the node for an anti-affinity key
+func (t *Target) domain(key string) string {
+	if key == "node" {
+		return t.IP
+	}
+	value, _ := t.Attribute(key)
+	return value
+}
+
+// affineNodes keeps the nodes allowed by the affinity rules of the request.
+// Instances on nodes which are not schedulable anymore are leaving and do not
+// count.
+func affineNodes(nodes map[string]*models.Node, targets map[string]*Target, counts *instanceCounts, req *Request, decision *models.PlacementDecision) map[string]*models.Node {
+	if req.AntiAffinity == "" && len(req.Affinity) == 0 {
+		return nodes
+	}
+
+	taken := make(map[string]bool)
+	if req.AntiAffinity != "" {
+		for ip := range counts.byService[req.Service] {
+			if target, ok := targets[ip]; ok {
+				taken[target.domain(req.AntiAffinity)] = true
+			}
+		}
+	}
+
+	kept := make(map[string]*models.Node, len(nodes))
+	for ip, node := range nodes {
+		if req.AntiAffinity != "" && taken[targets[ip].domain(req.AntiAffinity)] {
+			decision.Reject(ip, models.RejectAntiAffinity, "A replica already runs in "+req.AntiAffinity+" "+targets[ip].domain(req.AntiAffinity))
+			continue
+		}
+		nextTo := true
+		for _, other := range req.Affinity {
+			if counts.byService[other][ip] == 0 {
+				decision.Reject(ip, models.RejectAffinity, "No instance of "+other)
+				nextTo = false
+				break
+			}
+		}
+		if nextTo {
+			kept[ip] = node
+		}
+	}
+	return kept
+}
+
+// FitsNewNode tells whether a node which does not exist yet, described by its
+// inventory entry, could host the replica, and if not why. Its resources are
+// checked against its capacity, unless nil.
+func FitsNewNode(req *Request, entry *models.NodeEntry, capacity *models.Node) (bool, string) {
+	ip := entry.Name
+	node := &models.Node{}
+	if capacity != nil {
+		node = capacity
+	}
+
+	targets := schedulableTargets(nil)
+	targets[ip] = &Target{IP: ip, Node: node, Entry: entry}
+	only := *req
+	only.Nodes = []string{ip}
+
+	decision := models.NewPlacementDecision(req.Service, "")
+	nodes, err := eligibleNodes(targets, newInstanceCounts(), &only, decision)
+	if err != nil {
+		return false, err.Error()
+	}
+	if _, ok := nodes[ip]; !ok {
+		rejected := decision.Candidate(ip)
+		return false, strings.TrimSuffix(rejected.Rejected+" : "+rejected.Detail, " : ")
+	}
+	if capacity != nil {
+		if filter, detail := misfit(node, req.Resources); filter != "" {
+			return false, filter + " : " + detail
+		}
+	}
+	return true, ""
+}
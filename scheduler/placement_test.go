@@ -0,0 +1,152 @@
+package scheduler
+
+import (
+	"kinetik-server/models"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/docker/cli/cli/compose/types"
+)
+
+func TestAffineNodes(t *testing.T) {
+	zones := map[string]string{"10.0.0.1": "a", "10.0.0.2": "a", "10.0.0.3": "b"}
+
+	tests := []struct {
+		name      string
+		req       *Request
+		instances map[string][]string
+		want      []string
+		rejected  string
+	}{
+		{
+			name: "no rule keeps every node",
+			req:  &Request{Service: "s/web"},
+			want: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"},
+		},
+		{
+			name:      "node anti-affinity skips nodes running a replica",
+			req:       &Request{Service: "s/web", AntiAffinity: "node"},
+			instances: map[string][]string{"s/web": {"10.0.0.1"}, "s/db": {"10.0.0.2"}},
+			want:      []string{"10.0.0.2", "10.0.0.3"},
+			rejected:  models.RejectAntiAffinity,
+		},
+		{
+			name:      "zone anti-affinity skips the whole zone",
+			req:       &Request{Service: "s/web", AntiAffinity: "node.labels.zone"},
+			instances: map[string][]string{"s/web": {"10.0.0.1"}},
+			want:      []string{"10.0.0.3"},
+			rejected:  models.RejectAntiAffinity,
+		},
+		{
+			name:      "instances on nodes not schedulable anymore do not count",
+			req:       &Request{Service: "s/web", AntiAffinity: "node.labels.zone"},
+			instances: map[string][]string{"s/web": {"10.0.0.9"}},
+			want:      []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"},
+		},
+		{
+			name:      "affinity keeps the nodes running the other service",
+			req:       &Request{Service: "s/web", Affinity: []string{"s/cache"}},
+			instances: map[string][]string{"s/cache": {"10.0.0.2", "10.0.0.3"}},
+			want:      []string{"10.0.0.2", "10.0.0.3"},
+			rejected:  models.RejectAffinity,
+		},
+		{
+			name:      "both rules apply",
+			req:       &Request{Service: "s/web", AntiAffinity: "node", Affinity: []string{"s/cache"}},
+			instances: map[string][]string{"s/web": {"10.0.0.2"}, "s/cache": {"10.0.0.2", "10.0.0.3"}},
+			want:      []string{"10.0.0.3"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			targets := testTargets(zones)
+			nodes := make(map[string]*models.Node, len(targets))
+			for ip, target := range targets {
+				nodes[ip] = target.Node
+			}
+			decision := models.NewPlacementDecision(test.req.Service, "test")
+
+			kept := affineNodes(nodes, targets, testCounts(test.instances), test.req, decision)
+
+			ips := make([]string, 0, len(kept))
+			for ip := range kept {
+				ips = append(ips, ip)
+			}
+			sort.Strings(ips)
+			if !reflect.DeepEqual(ips, test.want) {
+				t.Errorf("kept %v, want %v", ips, test.want)
+			}
+			for _, c := range decision.Candidates {
+				if test.rejected != "" && c.Rejected != test.rejected {
+					t.Errorf("%s rejected by %q, want %q", c.NodeIP, c.Rejected, test.rejected)
+				}
+			}
+		})
+	}
+}
+
+func TestFitsNewNode(t *testing.T) {
+	entry := models.NewNodeEntry("new-node", "digitalocean")
+	entry.Region = "ams3"
+	entry.Labels["kinetik.autoscaled"] = "true"
+
+	tests := []struct {
+		name     string
+		req      *Request
+		capacity *models.Node
+		want     bool
+	}{
+		{
+			name: "no constraint",
+			req:  &Request{Service: "fits/web"},
+			want: true,
+		},
+		{
+			name: "constraints the new node satisfies",
+			req: &Request{Service: "fits/web", Placement: &types.Placement{
+				Constraints: []string{"node.region==ams3", "node.labels.kinetik.autoscaled==true"},
+			}},
+			want: true,
+		},
+		{
+			name: "label the new node lacks",
+			req:  &Request{Service: "fits/web", Placement: &types.Placement{Constraints: []string{"node.labels.zone==a"}}},
+			want: false,
+		},
+		{
+			name: "pinned to a hostname",
+			req:  &Request{Service: "fits/web", Placement: &types.Placement{Constraints: []string{"node.hostname==db-1"}}},
+			want: false,
+		},
+		{
+			name: "affinity to a service the new node does not run",
+			req:  &Request{Service: "fits/web", Affinity: []string{"fits/cache"}},
+			want: false,
+		},
+		{
+			name:     "bigger than the new node",
+			req:      &Request{Service: "fits/web", Resources: &types.Resource{NanoCPUs: "8"}},
+			capacity: testNode(),
+			want:     false,
+		},
+		{
+			name: "unknown capacity",
+			req:  &Request{Service: "fits/web", Resources: &types.Resource{NanoCPUs: "8"}},
+			want: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fits, why := FitsNewNode(test.req, entry, test.capacity)
+			if fits != test.want {
+				t.Errorf("fits = %v (%s), want %v", fits, why, test.want)
+			}
+			if !fits && why == "" {
+				t.Errorf("no reason given")
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package scheduler
+
+import (
+	"kinetik-server/models"
+	"sort"
+
+	"github.com/docker/cli/cli/compose/types"
+)
+
+// PriorityLabel is the deploy label giving the priority of a service. A
+// replica no node has room for may evict instances of services of lower
+// priority.
+const PriorityLabel = "be.mikrodock.priority"
+
+// Victim is an instance which may be evicted to make room for a replica of
+// higher priority
+type Victim struct {
+	Service     string
+	ContainerID string
+	NodeIP      string
+	Priority    int
+	Resources   *types.Resource
+}
+
+// Preempt chooses the node where evicting the fewest victims, of the lowest
+// priorities, gives the replica room, and returns the victims to evict. The
+// node is empty when no eviction helps. Only reservations are given back :
+// the usage the node reports is left as is.
+func Preempt(req *Request, victims []*Victim) (string, []*Victim) {
+	targets := schedulableTargets(nil)
+	nodes, err := eligibleNodes(targets, newInstanceCounts(), req, nil)
+	if err != nil {
+		return "", nil
+	}
+
+	byNode := make(map[string][]*Victim)
+	for _, victim := range victims {
+		byNode[victim.NodeIP] = append(byNode[victim.NodeIP], victim)
+	}
+
+	ips := make([]string, 0, len(nodes))
+	for ip := range nodes {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+
+	bestIP := ""
+	var best []*Victim
+	for _, ip := range ips {
+		evict, ok := evictions(nodes[ip], byNode[ip], req.Resources)
+		if !ok {
+			continue
+		}
+		if bestIP == "" || len(evict) < len(best) || (len(evict) == len(best) && maxPriority(evict) < maxPriority(best)) {
+			bestIP = ip
+			best = evict
+		}
+	}
+	return bestIP, best
+}
+
+// evictions returns the victims of the node to evict, lowest priority first,
+// until the resources fit
+func evictions(node *models.Node, victims []*Victim, resources *types.Resource) ([]*Victim, bool) {
+	sort.SliceStable(victims, func(i, j int) bool {
+		return victims[i].Priority < victims[j].Priority
+	})
+
+	freed := &models.Node{}
+	*freed = *node
+	evict := make([]*Victim, 0)
+	for {
+		if filter, _ := misfit(freed, resources); filter == "" {
+			return evict, len(evict) > 0
+		}
+		if len(evict) == len(victims) {
+			return nil, false
+		}
+		victim := victims[len(evict)]
+		freed.Reservations = models.SubtractResources(freed.Reservations, victim.Resources)
+		evict = append(evict, victim)
+	}
+}
+
+func maxPriority(victims []*Victim) int {
+	max := 0
+	for i, victim := range victims {
+		if i == 0 || victim.Priority > max {
+			max = victim.Priority
+		}
+	}
+	return max
+}
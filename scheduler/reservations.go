@@ -0,0 +1,82 @@
+package scheduler
+
+import (
+	"kinetik-server/data"
+	"kinetik-server/models"
+	"sync"
+	"time"
+
+	"github.com/docker/cli/cli/compose/types"
+)
+
+// An instance is placed before it is saved in its service. Its placement is
+// claimed until it is released, once its service holds it or its container
+// failed, so that the next placements count it and concurrent ones do not
+// overcommit the node. Claims never released expire after claimTTL.
+var claimTTL = 2 * time.Minute
+
+type claim struct {
+	id        int
+	service   string
+	nodeIP    string
+	resources *types.Resource
+	at        time.Time
+}
+
+var claimsMu sync.Mutex
+var claims = make([]claim, 0)
+var lastClaim = 0
+
+// claimPlacement records an instance of the service on the node, reserving
+// the resources, until the returned func is called
+func claimPlacement(service, nodeIP string, resources *types.Resource) func() {
+	claimsMu.Lock()
+	defer claimsMu.Unlock()
+
+	lastClaim++
+	id := lastClaim
+	claims = append(claims, claim{id, service, nodeIP, resources, time.Now()})
+	return func() {
+		releaseClaim(id)
+	}
+}
+
+func releaseClaim(id int) {
+	claimsMu.Lock()
+	defer claimsMu.Unlock()
+
+	for i, c := range claims {
+		if c.id == id {
+			claims = append(claims[:i], claims[i+1:]...)
+			return
+		}
+	}
+}
+
+// Reservations returns, by node IP, the resources reserved by the instances
+// of the stored services and by the placements in progress
+func Reservations() map[string]*types.Resource {
+	reservations := models.ComputeReservations(data.GetDB().GetServices())
+	for _, c := range liveClaims() {
+		if c.resources != nil {
+			reservations[c.nodeIP] = models.AddResources(reservations[c.nodeIP], c.resources)
+		}
+	}
+	return reservations
+}
+
+// liveClaims drops the expired claims and returns the others
+func liveClaims() []claim {
+	claimsMu.Lock()
+	defer claimsMu.Unlock()
+
+	kept := claims[:0]
+	for _, c := range claims {
+		if time.Since(c.at) <= claimTTL {
+			kept = append(kept, c)
+		}
+	}
+	claims = kept
+
+	return append([]claim{}, claims...)
+}
@@ -0,0 +1,143 @@
+package scheduler
+
+import (
+	"kinetik-server/data"
+	"kinetik-server/models"
+	"testing"
+	"time"
+
+	"github.com/docker/cli/cli/compose/types"
+)
+
+func TestReservations(t *testing.T) {
+	srv := &models.Service{
+		ServiceName: "web",
+		StackName:   "reservations",
+		Constraints: &types.Resource{NanoCPUs: "0.5", MemoryBytes: 100},
+		Instances: []*models.Instance{
+			{ContainerID: "c1", NodeID: "10.1.0.1"},
+			{ContainerID: "c2", NodeID: "10.1.0.1"},
+			{ContainerID: "c3", NodeID: "10.1.0.2"},
+		},
+	}
+	if err := data.GetDB().AddService(srv); err != nil {
+		t.Fatalf("Cannot save service : %s", err.Error())
+	}
+	defer data.GetDB().DeleteService(srv.Identifier())
+
+	release := claimPlacement(srv.Identifier(), "10.1.0.2", &types.Resource{NanoCPUs: "1", MemoryBytes: 50})
+	defer release()
+	releaseNone := claimPlacement(srv.Identifier(), "10.1.0.3", nil)
+	defer releaseNone()
+	expired := claimPlacement(srv.Identifier(), "10.1.0.4", &types.Resource{NanoCPUs: "1"})
+	defer expired()
+	claimsMu.Lock()
+	claims[len(claims)-1].at = time.Now().Add(-2 * claimTTL)
+	claimsMu.Unlock()
+
+	tests := []struct {
+		name    string
+		release func()
+		want    map[string]*types.Resource
+	}{
+		{
+			name: "instances and claims",
+			want: map[string]*types.Resource{
+				"10.1.0.1": {NanoCPUs: "1", MemoryBytes: 200},
+				"10.1.0.2": {NanoCPUs: "1.5", MemoryBytes: 150},
+				"10.1.0.3": nil,
+				"10.1.0.4": nil,
+			},
+		},
+		{
+			name:    "released claims",
+			release: release,
+			want: map[string]*types.Resource{
+				"10.1.0.1": {NanoCPUs: "1", MemoryBytes: 200},
+				"10.1.0.2": {NanoCPUs: "0.5", MemoryBytes: 50},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.release != nil {
+				test.release()
+			}
+			reservations := Reservations()
+			for ip, want := range test.want {
+				got := reservations[ip]
+				if want == nil {
+					if got != nil {
+						t.Errorf("%s reserves %+v, want nothing", ip, got)
+					}
+					continue
+				}
+				if got == nil || got.NanoCPUs != want.NanoCPUs || got.MemoryBytes != want.MemoryBytes {
+					t.Errorf("%s reserves %+v, want %+v", ip, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSelectCountsPlacementsInProgress(t *testing.T) {
+	ips := []string{"10.2.0.1", "10.2.0.2", "10.2.0.3"}
+	for ip, target := range testTargets(map[string]string{"10.2.0.1": "a", "10.2.0.2": "a", "10.2.0.3": "b"}) {
+		err := data.GetDB().UpdateNode(ip, func(*models.Node) *models.Node {
+			return target.Node
+		})
+		if err == nil {
+			err = data.GetDB().SaveNodeEntry(target.Entry)
+		}
+		if err != nil {
+			t.Fatalf("Cannot save node : %s", err.Error())
+		}
+		defer data.GetDB().DeleteNode(ip)
+		defer data.GetDB().DeleteNodeEntry(target.Entry.Name)
+	}
+
+	tests := []struct {
+		name string
+		req  *Request
+		want int // Distinct nodes
+	}{
+		{
+			name: "spread",
+			req:  &Request{Service: "select/spread", Strategy: StrategySpread},
+			want: 3,
+		},
+		{
+			name: "spread preference",
+			req: &Request{
+				Service:   "select/preference",
+				Strategy:  StrategyBinpack,
+				Placement: &types.Placement{Preferences: []types.PlacementPreferences{{Spread: "node.labels.zone"}}},
+			},
+			want: 2,
+		},
+		{
+			name: "anti-affinity",
+			req:  &Request{Service: "select/anti", Strategy: StrategyBinpack, AntiAffinity: "node"},
+			want: 3,
+		},
+	}
+
+	s := NewScoringScheduler(StrategySpread)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			placed := make(map[string]bool)
+			for range ips {
+				decision, err := s.Select(test.req)
+				if err != nil {
+					t.Fatalf("Select failed : %s", err.Error())
+				}
+				defer decision.Release()
+				placed[decision.NodeIP] = true
+			}
+			if len(placed) != test.want {
+				t.Errorf("placed on %v, want %d distinct nodes", placed, test.want)
+			}
+		})
+	}
+}
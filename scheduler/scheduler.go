@@ -1,21 +1,105 @@
 package scheduler
 
 import (
+	"kinetik-server/data"
+	"kinetik-server/models"
+	"os"
+	"sort"
 	"sync"
 
 	"github.com/docker/cli/cli/compose/types"
 )
 
+// Request describes a replica to place
+type Request struct {
+	Service   string          // Identifier of the service
+	Resources *types.Resource // Reservations of the replica
+	Strategy  string          // Empty for the default strategy
+	Placement *types.Placement
+
+	AntiAffinity string   // Topology key replicas must not share, see AntiAffinityLabel
+	Affinity     []string // Identifiers of the services replicas must run next to
+
+	Nodes []string // IPs of the nodes the replica is restricted to, any if empty
+
+	Evicted []*Victim // Instances evicted to make room, their reservations count as free
+}
+
+// NewRequest describes a new replica of the service
+func NewRequest(srv *models.Service) *Request {
+	affinity := make([]string, 0, len(srv.Affinity))
+	for _, name := range srv.Affinity {
+		affinity = append(affinity, srv.StackName+"/"+name)
+	}
+	return &Request{
+		Service:   srv.Identifier(),
+		Resources: srv.Constraints,
+		Strategy:  srv.Strategy,
+		Placement: srv.Placement,
+
+		AntiAffinity: srv.AntiAffinity,
+		Affinity:     affinity,
+	}
+}
+
 type Scheduler interface {
-	SelectWithConstraints(resources *types.Resource) (string, error)
+	// Select decides the node the replica should run on, none if no node has
+	// room for it, and records why. A *ConstraintError is returned when no
+	// node satisfies its placement constraints. The next placements count the
+	// replica on its node until the Release of the decision is called.
+	Select(req *Request) (*models.PlacementDecision, error)
+	// DryRun places the replicas one after the other the way Select would,
+	// without reserving anything. Replicas that cannot be placed get an empty
+	// node.
+	DryRun(reqs []*Request) []string
 }
 
 var schedulerInstance Scheduler
 var once sync.Once
 
+// GetScheduler returns the scheduler chosen by KINETIK_SCHEDULER : dumb,
+// notsosmart or, by default, the scoring scheduler with the strategy of
+// KINETIK_SCHEDULER_STRATEGY
 func GetScheduler() Scheduler {
 	once.Do(func() {
-		schedulerInstance = &NotSoSmartScheduler{}
+		switch os.Getenv("KINETIK_SCHEDULER") {
+		case "dumb":
+			schedulerInstance = &DumbScheduler{}
+		case "notsosmart":
+			schedulerInstance = &NotSoSmartScheduler{}
+		default:
+			schedulerInstance = NewScoringScheduler(os.Getenv("KINETIK_SCHEDULER_STRATEGY"))
+		}
 	})
 	return schedulerInstance
 }
+
+// schedulableNodes returns the nodes new instances may be scheduled on, with
+// their current reservations. The others are rejected in the decision, which
+// may be nil.
+func schedulableNodes(decision *models.PlacementDecision) map[string]*models.Node {
+	nodes := data.GetDB().GetNodes()
+	reservations := Reservations()
+	for ip, node := range nodes {
+		if !node.IsReady() {
+			decision.Reject(ip, models.RejectNotReady, "")
+			delete(nodes, ip)
+			continue
+		}
+		if node.Cordoned {
+			decision.Reject(ip, models.RejectCordoned, "")
+			delete(nodes, ip)
+			continue
+		}
+		node.Reservations = models.AddResources(reservations[ip], nil)
+	}
+	return nodes
+}
+
+// finish sorts the candidates of the decision by node
+func finish(decision *models.PlacementDecision) *models.PlacementDecision {
+	sort.Slice(decision.Candidates, func(i, j int) bool {
+		return decision.Candidates[i].NodeIP < decision.Candidates[j].NodeIP
+	})
+	return decision
+}
@@ -0,0 +1,76 @@
+package scheduler
+
+import (
+	"io/ioutil"
+	"kinetik-server/boltdb"
+	"kinetik-server/data"
+	"kinetik-server/logger"
+	"kinetik-server/models"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/cli/cli/compose/types"
+)
+
+func TestMain(m *testing.M) {
+	logger.StdLog = log.New(ioutil.Discard, "", 0)
+	logger.ErrLog = log.New(ioutil.Discard, "", 0)
+
+	dir, err := ioutil.TempDir("", "kinetik-scheduler")
+	if err != nil {
+		panic(err)
+	}
+	db, err := boltdb.OpenBoltDB(filepath.Join(dir, "kinetik.db"))
+	if err != nil {
+		panic(err)
+	}
+	data.UseDB(db)
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// testNode has 4 CPUs and 4 GB of memory, a quarter of it used
+func testNode() *models.Node {
+	return &models.Node{
+		CPUCount:       4,
+		MemUsedBytes:   1 << 30,
+		MemUsedPercent: 0.25,
+		Reservations:   &types.Resource{},
+	}
+}
+
+// testTargets returns a target for each IP, in the zone given with it
+func testTargets(zones map[string]string) map[string]*Target {
+	targets := make(map[string]*Target, len(zones))
+	for ip, zone := range zones {
+		entry := models.NewNodeEntry(ip, "")
+		entry.PublicIP = ip
+		if zone != "" {
+			entry.Labels["zone"] = zone
+		}
+		targets[ip] = &Target{
+			IP:    ip,
+			Node:  testNode(),
+			Entry: entry,
+		}
+	}
+	return targets
+}
+
+// testCounts counts the instances of the services on the nodes
+func testCounts(instances map[string][]string) *instanceCounts {
+	counts := &instanceCounts{
+		total:     make(map[string]int),
+		byService: make(map[string]map[string]int),
+	}
+	for service, ips := range instances {
+		for _, ip := range ips {
+			counts.add(service, ip)
+		}
+	}
+	return counts
+}
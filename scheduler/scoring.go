@@ -0,0 +1,244 @@
+package scheduler
+
+import (
+	"errors"
+	"hash/fnv"
+	"kinetik-server/data"
+	"kinetik-server/logger"
+	"kinetik-server/models"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/docker/cli/cli/compose/types"
+)
+
+// Placement strategies
+const (
+	StrategyBinpack = "binpack" // Fill the most allocated nodes first
+	StrategySpread  = "spread"  // Fill the least allocated nodes first
+	StrategyRandom  = "random"
+)
+
+// StrategyLabel sets the strategy of a service, in its deploy labels
+const StrategyLabel = "be.mikrodock.strategy"
+
+// A Strategy scores a node that can host the replica. The highest score wins,
+// ties go to the lowest IP.
+type Strategy func(c *candidate, req *Request, seed int64) float64
+
+var strategies = map[string]Strategy{
+	StrategyBinpack: binpack,
+	StrategySpread:  spread,
+	StrategyRandom:  random,
+}
+
+// ValidateStrategy checks that the strategy exists. An empty strategy is the
+// default one.
+func ValidateStrategy(name string) error {
+	if _, ok := strategies[name]; !ok && name != "" {
+		return errors.New("Unknown scheduling strategy " + name + ", expected binpack, spread or random")
+	}
+	return nil
+}
+
+// candidate is a node able to host the replica being placed
+type candidate struct {
+	ip        string
+	node      *models.Node
+	instances int   // Instances already on the node
+	spread    []int // See spreadCounts
+	score     float64
+}
+
+// ScoringScheduler places each replica on the node its strategy scores best
+// among those satisfying its placement constraints with room for it. Spread
+// preferences come before the score. Services may choose their strategy.
+// Placement only depends on the stored state, and on the seed for the random
+// strategy, so that it can be reproduced.
+type ScoringScheduler struct {
+	Strategy string
+	Seed     int64 // Seed of the random strategy
+
+	mu sync.Mutex // A placement sees the reservations of the previous ones
+}
+
+// NewScoringScheduler uses the given default strategy, spread when unknown.
+// The seed of the random strategy comes from KINETIK_SCHEDULER_SEED.
+func NewScoringScheduler(strategy string) *ScoringScheduler {
+	if _, ok := strategies[strategy]; !ok {
+		strategy = StrategySpread
+	}
+	seed, _ := strconv.ParseInt(os.Getenv("KINETIK_SCHEDULER_SEED"), 10, 64)
+	return &ScoringScheduler{
+		Strategy: strategy,
+		Seed:     seed,
+	}
+}
+
+func (s *ScoringScheduler) Select(req *Request) (*models.PlacementDecision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	decision := models.NewPlacementDecision(req.Service, "scoring")
+	decision.Strategy = s.strategy(req)
+
+	targets := requestTargets(req, decision)
+	ip, err := s.place(targets, newInstanceCounts(), req, decision)
+	if err != nil {
+		decision.Error = err.Error()
+		return finish(decision), err
+	}
+	decision.NodeIP = ip
+	if ip != "" {
+		decision.Release = claimPlacement(req.Service, ip, req.Resources)
+	}
+	if ip != "" && req.Resources != nil {
+		reservations := targets[ip].Node.Reservations
+		logger.StdLog.Printf("Node %s has now CPU res = %s and mem = %d\n", ip, reservations.NanoCPUs, reservations.MemoryBytes)
+	}
+
+	return finish(decision), nil
+}
+
+func (s *ScoringScheduler) DryRun(reqs []*Request) []string {
+	targets := schedulableTargets(nil)
+	counts := newInstanceCounts()
+
+	placements := make([]string, len(reqs))
+	for i, req := range reqs {
+		placements[i], _ = s.place(targets, counts, req, nil)
+	}
+	return placements
+}
+
+// strategy returns the name of the strategy used for the request
+func (s *ScoringScheduler) strategy(req *Request) string {
+	if _, ok := strategies[req.Strategy]; ok {
+		return req.Strategy
+	}
+	return s.Strategy
+}
+
+// place picks the node for the replica and accounts it in targets and counts.
+// The decision, which may be nil, gets the rejections and the scores.
+func (s *ScoringScheduler) place(targets map[string]*Target, counts *instanceCounts, req *Request, decision *models.PlacementDecision) (string, error) {
+	strategy := strategies[s.strategy(req)]
+
+	nodes, err := eligibleNodes(targets, counts, req, decision)
+	if err != nil {
+		return "", err
+	}
+
+	candidates := make([]*candidate, 0, len(nodes))
+	for ip, node := range nodes {
+		if filter, detail := misfit(node, req.Resources); filter != "" {
+			decision.Reject(ip, filter, detail)
+			continue
+		}
+		c := &candidate{
+			ip:        ip,
+			node:      node,
+			instances: counts.total[ip],
+			spread:    spreadCounts(targets, counts.byService[req.Service], req, ip),
+		}
+		c.score = strategy(c, req, s.Seed)
+		candidates = append(candidates, c)
+		if decision != nil {
+			record := decision.Candidate(ip)
+			record.Spread = c.spread
+			record.Score = &c.score
+		}
+	}
+	if len(candidates) == 0 {
+		return "", nil
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if less, equal := lessSpread(candidates[i].spread, candidates[j].spread); !equal {
+			return less
+		}
+		if candidates[i].score != candidates[j].score {
+			return candidates[i].score > candidates[j].score
+		}
+		return candidates[i].ip < candidates[j].ip
+	})
+
+	chosen := candidates[0]
+	reserve(chosen.node, req.Resources)
+	counts.add(req.Service, chosen.ip)
+	return chosen.ip, nil
+}
+
+// instanceCounts counts the instances of every node, in total and by service,
+// the stored ones and those placed but not saved yet
+type instanceCounts struct {
+	total     map[string]int
+	byService map[string]map[string]int
+}
+
+func newInstanceCounts() *instanceCounts {
+	counts := &instanceCounts{
+		total:     make(map[string]int),
+		byService: make(map[string]map[string]int),
+	}
+	for _, srv := range data.GetDB().GetServices() {
+		for _, inst := range srv.Instances {
+			counts.add(srv.Identifier(), inst.NodeID)
+		}
+	}
+	for _, c := range liveClaims() {
+		counts.add(c.service, c.nodeIP)
+	}
+	return counts
+}
+
+func (c *instanceCounts) add(service, nodeIP string) {
+	c.total[nodeIP]++
+	if c.byService[service] == nil {
+		c.byService[service] = make(map[string]int)
+	}
+	c.byService[service][nodeIP]++
+}
+
+// allocation is the average share of CPU and memory of the node used or
+// reserved once the replica is placed, between 0 and 1. Unknown figures count
+// as free.
+func allocation(node *models.Node, resources *types.Resource) float64 {
+	reserved := models.AddResources(node.Reservations, resources)
+
+	cpu := 0.0
+	if node.CPUCount > 0 {
+		reservedCPU, _ := strconv.ParseFloat(reserved.NanoCPUs, 64)
+		cpu = (node.CPUUsedPercent + reservedCPU*100) / float64(100*node.CPUCount)
+	}
+
+	mem := 0.0
+	if node.MemUsedPercent > 0 {
+		total := float64(node.MemUsedBytes) / node.MemUsedPercent
+		mem = (float64(node.MemUsedBytes) + float64(reserved.MemoryBytes)) / total
+	}
+
+	return (cpu + mem) / 2
+}
+
+// Instance counts only break ties between nodes equally allocated
+const instanceWeight = 1e-6
+
+func binpack(c *candidate, req *Request, seed int64) float64 {
+	return allocation(c.node, req.Resources) + instanceWeight*float64(c.instances)
+}
+
+func spread(c *candidate, req *Request, seed int64) float64 {
+	return 1 - allocation(c.node, req.Resources) - instanceWeight*float64(c.instances)
+}
+
+// random scores the node with a hash of the seed, the service, the node and
+// its instance count, so that replicas of a service land on random nodes
+// reproducibly
+func random(c *candidate, req *Request, seed int64) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(strconv.FormatInt(seed, 10) + "/" + req.Service + "/" + c.ip + "/" + strconv.Itoa(c.instances)))
+	return float64(h.Sum64()%1000000) / 1000000
+}
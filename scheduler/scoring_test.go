@@ -0,0 +1,152 @@
+package scheduler
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/docker/cli/cli/compose/types"
+)
+
+func TestPlace(t *testing.T) {
+	zones := map[string]string{"10.0.0.1": "a", "10.0.0.2": "a", "10.0.0.3": "b"}
+
+	tests := []struct {
+		name     string
+		strategy string
+		req      *Request
+		replicas int
+		existing map[string][]string
+		want     []string
+	}{
+		{
+			name:     "spread puts each replica on its own node",
+			strategy: StrategySpread,
+			req:      &Request{Service: "s/web"},
+			replicas: 3,
+			want:     []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"},
+		},
+		{
+			name:     "spread avoids nodes already running instances",
+			strategy: StrategySpread,
+			req:      &Request{Service: "s/web"},
+			replicas: 1,
+			existing: map[string][]string{"s/db": {"10.0.0.1", "10.0.0.2"}},
+			want:     []string{"10.0.0.3"},
+		},
+		{
+			name:     "binpack fills the most allocated node",
+			strategy: StrategyBinpack,
+			req:      &Request{Service: "s/web", Resources: &types.Resource{NanoCPUs: "1"}},
+			replicas: 3,
+			want:     []string{"10.0.0.1", "10.0.0.1", "10.0.0.1"},
+		},
+		{
+			name:     "binpack moves on once the node is full",
+			strategy: StrategyBinpack,
+			req:      &Request{Service: "s/web", Resources: &types.Resource{NanoCPUs: "2.5"}},
+			replicas: 2,
+			want:     []string{"10.0.0.1", "10.0.0.2"},
+		},
+		{
+			name:     "spread preferences come before the score",
+			strategy: StrategyBinpack,
+			req: &Request{
+				Service:   "s/web",
+				Placement: &types.Placement{Preferences: []types.PlacementPreferences{{Spread: "node.labels.zone"}}},
+			},
+			replicas: 2,
+			want:     []string{"10.0.0.1", "10.0.0.3"},
+		},
+		{
+			name:     "spread preferences count the existing instances",
+			strategy: StrategySpread,
+			req: &Request{
+				Service:   "s/web",
+				Placement: &types.Placement{Preferences: []types.PlacementPreferences{{Spread: "node.labels.zone"}}},
+			},
+			replicas: 3,
+			existing: map[string][]string{"s/web": {"10.0.0.3"}},
+			want:     []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"},
+		},
+		{
+			name:     "no node has room",
+			strategy: StrategySpread,
+			req:      &Request{Service: "s/web", Resources: &types.Resource{NanoCPUs: "8"}},
+			replicas: 1,
+			want:     []string{""},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &ScoringScheduler{Strategy: test.strategy}
+			targets := testTargets(zones)
+			counts := testCounts(test.existing)
+
+			placed := make([]string, 0, test.replicas)
+			for i := 0; i < test.replicas; i++ {
+				ip, err := s.place(targets, counts, test.req, nil)
+				if err != nil {
+					t.Fatalf("place failed : %s", err.Error())
+				}
+				placed = append(placed, ip)
+			}
+			if !reflect.DeepEqual(placed, test.want) {
+				t.Errorf("placed on %v, want %v", placed, test.want)
+			}
+		})
+	}
+}
+
+func TestSpreadCounts(t *testing.T) {
+	targets := testTargets(map[string]string{"10.0.0.1": "a", "10.0.0.2": "a", "10.0.0.3": "b", "10.0.0.4": ""})
+	byZone := &types.Placement{Preferences: []types.PlacementPreferences{{Spread: "node.labels.zone"}}}
+	byZoneThenNode := &types.Placement{Preferences: []types.PlacementPreferences{{Spread: "node.labels.zone"}, {Spread: "node.ip"}}}
+
+	tests := []struct {
+		name      string
+		placement *types.Placement
+		instances []string
+		ip        string
+		want      []int
+	}{
+		{
+			name:      "no preference",
+			instances: []string{"10.0.0.1"},
+			ip:        "10.0.0.1",
+			want:      nil,
+		},
+		{
+			name:      "instances of the zone",
+			placement: byZone,
+			instances: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"},
+			ip:        "10.0.0.2",
+			want:      []int{2},
+		},
+		{
+			name:      "nodes without the label share the empty zone",
+			placement: byZone,
+			instances: []string{"10.0.0.1", "10.0.0.4"},
+			ip:        "10.0.0.4",
+			want:      []int{1},
+		},
+		{
+			name:      "one count per preference",
+			placement: byZoneThenNode,
+			instances: []string{"10.0.0.1", "10.0.0.1", "10.0.0.2"},
+			ip:        "10.0.0.1",
+			want:      []int{3, 2},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			counts := testCounts(map[string][]string{"s/web": test.instances})
+			req := &Request{Service: "s/web", Placement: test.placement}
+			got := spreadCounts(targets, counts.byService["s/web"], req, test.ip)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("spread counts %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,325 @@
+package simulation
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"kinetik-server/boltdb"
+	"kinetik-server/data"
+	"kinetik-server/deploy"
+	"kinetik-server/models"
+	"kinetik-server/scheduler"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/cli/cli/compose/types"
+)
+
+const usage = "Usage: kinetik-server simulate -nodes nodes.json [-scheduler dumb|notsosmart|scoring] [-strategy binpack|spread|random] [-json] stack.yml..."
+
+// Node is the spec of a simulated node : the figures it would report, plus
+// what placement constraints refer to. MemTotalBytes may be given instead of
+// MemUsedPercent.
+type Node struct {
+	models.Node
+	IP            string            `json:"ip"`
+	Name          string            `json:"name,omitempty"`
+	Provider      string            `json:"provider,omitempty"`
+	Region        string            `json:"region,omitempty"`
+	Size          string            `json:"size,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	MemTotalBytes uint64            `json:"mem_total_bytes,omitempty"`
+}
+
+// Placement is the node chosen for a replica, empty if none could host it
+type Placement struct {
+	Service string `json:"service"`
+	Replica int    `json:"replica"`
+	NodeIP  string `json:"node_ip"`
+}
+
+// NodeReport is the utilisation of a node once the replicas are placed,
+// between 0 and 1, counting its usage and the reservations of its replicas
+type NodeReport struct {
+	IP       string          `json:"ip"`
+	Name     string          `json:"name"`
+	Replicas int             `json:"replicas"`
+	Reserved *types.Resource `json:"reserved"`
+	CPU      float64         `json:"cpu"`
+	Memory   float64         `json:"memory"`
+
+	freeCPU    float64
+	freeMemory float64
+}
+
+// Fragmentation is the share of the free capacity of the cluster which is not
+// on the node with the most of it, between 0 and 1. A replica bigger than the
+// largest free block cannot be placed, even if the cluster has room for it.
+type Fragmentation struct {
+	CPU    float64 `json:"cpu"`
+	Memory float64 `json:"memory"`
+}
+
+type Report struct {
+	Scheduler     string         `json:"scheduler"`
+	Placements    []*Placement   `json:"placements"`
+	Nodes         []*NodeReport  `json:"nodes"`
+	Fragmentation *Fragmentation `json:"fragmentation"`
+	Unschedulable map[string]int `json:"unschedulable"` // Replicas by service
+}
+
+// Run places the replicas of the stacks on the nodes with the scheduler of the
+// server, without Docker, and reports the result. The stacks are named after
+// their files.
+func Run(args []string) (string, error) {
+	flags := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	nodesFile := flags.String("nodes", "", "")
+	schedulerName := flags.String("scheduler", os.Getenv("KINETIK_SCHEDULER"), "")
+	strategy := flags.String("strategy", os.Getenv("KINETIK_SCHEDULER_STRATEGY"), "")
+	asJSON := flags.Bool("json", false, "")
+	if err := flags.Parse(args); err != nil {
+		return usage, err
+	}
+	if *nodesFile == "" || flags.NArg() == 0 {
+		return usage, errors.New("nodes and stacks are required")
+	}
+	switch *schedulerName {
+	case "dumb", "notsosmart", "scoring", "":
+	default:
+		return usage, errors.New("Unknown scheduler " + *schedulerName)
+	}
+	if err := scheduler.ValidateStrategy(*strategy); err != nil {
+		return usage, err
+	}
+
+	nodes, err := loadNodes(*nodesFile)
+	if err != nil {
+		return "", err
+	}
+
+	dir, err := ioutil.TempDir("", "kinetik-simulation")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+	db, err := boltdb.OpenBoltDB(filepath.Join(dir, "kinetik.db"))
+	if err != nil {
+		return "", err
+	}
+	data.UseDB(db)
+
+	for _, node := range nodes {
+		if err := addNode(node); err != nil {
+			return "", errors.New("Cannot add node " + node.IP + " : " + err.Error())
+		}
+	}
+
+	services := make([]*models.Service, 0)
+	for _, file := range flags.Args() {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		stackName := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+		stack, err := deploy.BuildStack(stackName, string(content))
+		if err != nil {
+			return "", errors.New("Cannot load " + file + " : " + err.Error())
+		}
+		services = append(services, stack...)
+	}
+
+	os.Setenv("KINETIK_SCHEDULER", *schedulerName)
+	os.Setenv("KINETIK_SCHEDULER_STRATEGY", *strategy)
+
+	report := simulate(nodes, services)
+	if !*asJSON {
+		return report.String(), nil
+	}
+	buf, err := json.MarshalIndent(report, "", "  ")
+	return string(buf), err
+}
+
+func loadNodes(file string) ([]*Node, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	nodes := make([]*Node, 0)
+	if err := json.Unmarshal(content, &nodes); err != nil {
+		return nil, errors.New("Cannot decode " + file + " : " + err.Error())
+	}
+
+	seen := make(map[string]bool)
+	for _, node := range nodes {
+		if node.IP == "" || seen[node.IP] {
+			return nil, errors.New("Every node needs its own ip")
+		}
+		seen[node.IP] = true
+		if node.Name == "" {
+			node.Name = node.IP
+		}
+		if node.MemTotalBytes > 0 {
+			node.MemUsedPercent = float64(node.MemUsedBytes) / float64(node.MemTotalBytes)
+		}
+		// The scheduler derives the memory of a node from its usage
+		if node.CPUCount <= 0 || node.MemUsedBytes == 0 || node.MemUsedPercent <= 0 || node.MemUsedPercent >= 1 {
+			return nil, errors.New("Node " + node.IP + " needs cpu_count, mem_used_bytes and either mem_used_percent, between 0 and 1, or mem_total_bytes")
+		}
+	}
+	return nodes, nil
+}
+
+func addNode(node *Node) error {
+	// AddNode prints the node
+	err := data.GetDB().UpdateNode(node.IP, func(*models.Node) *models.Node {
+		return &node.Node
+	})
+	if err != nil {
+		return err
+	}
+	entry := models.NewNodeEntry(node.Name, node.Provider)
+	entry.PublicIP = node.IP
+	entry.Region = node.Region
+	entry.Size = node.Size
+	entry.Phase = models.PhaseReady
+	for key, value := range node.Labels {
+		entry.Labels[key] = value
+	}
+	return data.GetDB().SaveNodeEntry(entry)
+}
+
+func simulate(nodes []*Node, services []*models.Service) *Report {
+	sched := scheduler.GetScheduler()
+
+	reqs := make([]*scheduler.Request, 0)
+	placements := make([]*Placement, 0)
+	resources := make([]*types.Resource, 0)
+	for _, srv := range services {
+		for i := 0; i < int(srv.Replicas); i++ {
+			reqs = append(reqs, scheduler.NewRequest(srv))
+			placements = append(placements, &Placement{Service: srv.Identifier(), Replica: i})
+			resources = append(resources, srv.Constraints)
+		}
+	}
+
+	report := &Report{
+		Scheduler:     schedulerName(sched),
+		Placements:    placements,
+		Nodes:         make([]*NodeReport, 0, len(nodes)),
+		Unschedulable: make(map[string]int),
+	}
+
+	byIP := make(map[string]*NodeReport, len(nodes))
+	for _, node := range nodes {
+		byIP[node.IP] = &NodeReport{IP: node.IP, Name: node.Name, Reserved: &types.Resource{}}
+		report.Nodes = append(report.Nodes, byIP[node.IP])
+	}
+
+	for i, ip := range sched.DryRun(reqs) {
+		placements[i].NodeIP = ip
+		if ip == "" {
+			report.Unschedulable[placements[i].Service]++
+			continue
+		}
+		byIP[ip].Replicas++
+		byIP[ip].Reserved = models.AddResources(byIP[ip].Reserved, resources[i])
+	}
+
+	for _, node := range nodes {
+		byIP[node.IP].utilisation(node)
+	}
+	report.Fragmentation = fragmentation(report.Nodes)
+	return report
+}
+
+func schedulerName(sched scheduler.Scheduler) string {
+	switch s := sched.(type) {
+	case *scheduler.DumbScheduler:
+		return "dumb"
+	case *scheduler.NotSoSmartScheduler:
+		return "notsosmart"
+	case *scheduler.ScoringScheduler:
+		return "scoring (" + s.Strategy + ")"
+	}
+	return fmt.Sprintf("%T", sched)
+}
+
+func (r *NodeReport) utilisation(node *Node) {
+	cpus := float64(node.CPUCount)
+	reservedCPU, _ := strconv.ParseFloat(r.Reserved.NanoCPUs, 64)
+	usedCPU := node.CPUUsedPercent/100 + reservedCPU
+	r.CPU = usedCPU / cpus
+	r.freeCPU = nonNegative(cpus - usedCPU)
+
+	memory := float64(node.MemUsedBytes) / node.MemUsedPercent
+	usedMemory := float64(node.MemUsedBytes) + float64(r.Reserved.MemoryBytes)
+	r.Memory = usedMemory / memory
+	r.freeMemory = nonNegative(memory - usedMemory)
+}
+
+func fragmentation(nodes []*NodeReport) *Fragmentation {
+	share := func(free func(*NodeReport) float64) float64 {
+		total, largest := 0.0, 0.0
+		for _, node := range nodes {
+			total += free(node)
+			if free(node) > largest {
+				largest = free(node)
+			}
+		}
+		if total == 0 {
+			return 0
+		}
+		return 1 - largest/total
+	}
+	return &Fragmentation{
+		CPU:    share(func(n *NodeReport) float64 { return n.freeCPU }),
+		Memory: share(func(n *NodeReport) float64 { return n.freeMemory }),
+	}
+}
+
+func nonNegative(value float64) float64 {
+	if value < 0 {
+		return 0
+	}
+	return value
+}
+
+func (r *Report) String() string {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "Scheduler : %s\n\nPlacements\n", r.Scheduler)
+	for _, p := range r.Placements {
+		ip := p.NodeIP
+		if ip == "" {
+			ip = "unschedulable"
+		}
+		fmt.Fprintf(&buf, "  %s #%d -> %s\n", p.Service, p.Replica, ip)
+	}
+
+	fmt.Fprintf(&buf, "\nNodes\n")
+	for _, n := range r.Nodes {
+		fmt.Fprintf(&buf, "  %s (%s) : %d replicas, CPU %.1f%%, memory %.1f%%\n", n.Name, n.IP, n.Replicas, 100*n.CPU, 100*n.Memory)
+	}
+
+	fmt.Fprintf(&buf, "\nFragmentation : CPU %.1f%%, memory %.1f%%\n", 100*r.Fragmentation.CPU, 100*r.Fragmentation.Memory)
+
+	if len(r.Unschedulable) > 0 {
+		services := make([]string, 0, len(r.Unschedulable))
+		for service := range r.Unschedulable {
+			services = append(services, service)
+		}
+		sort.Strings(services)
+		fmt.Fprintf(&buf, "\nUnschedulable\n")
+		for _, service := range services {
+			fmt.Fprintf(&buf, "  %s : %d replicas\n", service, r.Unschedulable[service])
+		}
+	}
+	return buf.String()
+}